@@ -1,104 +1,86 @@
 package main
 
 import (
-	"crypto/sha256"
-	"fmt"
+	"context"
+	"embed"
+	"io/fs"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
-	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/metrics"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 	"httpfromtcp/internal/server"
 )
 
-const port = 42069
+//go:embed pages/*.html
+var pageFiles embed.FS
+
+const (
+	port            = 42069
+	shutdownTimeout = 30 * time.Second
+)
 
 func main() {
-	server, err := server.Serve(port, handler)
+	pages, err := fs.Sub(pageFiles, "pages")
+	if err != nil {
+		log.Fatalf("Error loading pages: %v", err)
+	}
+	statusPages, err := server.LoadStatusPages(pages)
+	if err != nil {
+		log.Fatalf("Error loading pages: %v", err)
+	}
+	registry := metrics.NewRegistry()
+	router := server.NewRouter()
+	router.Use(server.AccessLog(server.AccessLogConfig{Format: server.LogCombined}))
+	httpbin := &server.ReverseProxy{Upstream: &url.URL{Scheme: "https", Host: "httpbin.org"}, Prefix: "/httpbin"}
+	cache := &server.Cache{}
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
+		router.Handle(method, "/httpbin/{path...}", cache.Middleware(httpbin.ServeRequest))
+	}
+	router.Get("/yourproblem", statusPages.Handler(response.StatusBadRequest))
+	router.Get("/myproblem", statusPages.Handler(response.StatusInternalServerError))
+	router.Get("/video", videoHandler)
+	router.Get("/metrics", registry.ServeRequest)
+	router.Get("/{path...}", statusPages.Handler(response.StatusOK))
+
+	server, err := server.Serve(port, router.ServeRequest,
+		server.WithReadHeaderTimeout(10*time.Second),
+		server.WithIdleTimeout(2*time.Minute),
+		server.WithMetrics(registry),
+		// Uploads to httpbin go through as they arrive.
+		server.WithStreamedBodies(func(req *request.Request) bool {
+			return strings.HasPrefix(req.Path(), "/httpbin/")
+		}),
+	)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
-	log.Println("Server started on port", port)
+	log.Println("Server started on", server.Addr())
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	log.Println("Server gracefully stopped")
-}
-
-func handler(w *response.Writer, req *request.Request) {
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-		binPath := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-		res, err := http.Get("https://httpbin.org/" + binPath)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		w.WriteStatusLine(response.StatusOK)
-		h := response.GetDefaultHeaders(0)
-		h.Remove("content-length")
-		h.Remove("connection")
-		h.Override("content-type", res.Header.Get("Content-Type"))
-		h.Set("transfer-encoding", "chunked")
-		h.Set("trailer", "x-content-sha256, x-content-length")
-		w.WriteHeaders(h)
-
-		responseBody := []byte{}
-		buffer := make([]byte, 1024)
+	select {
+	case <-sigChan:
+	case <-server.Done():
+		log.Fatalf("Server stopped: %v", server.Err())
+	}
 
-		for {
-			n, err := res.Body.Read(buffer)
-			if n > 0 {
-				w.WriteChunkedBody(buffer[:n])
-				responseBody = append(responseBody, buffer[:n]...)
-			}
-			if err != nil {
-				w.WriteChunkedBodyDone()
-				break
-			}
-		}
-		trailers := headers.NewHeaders()
-		sum := sha256.Sum256(responseBody)
-		trailers.Set("x-content-sha256", fmt.Sprintf("%x", sum))
-		trailers.Set("x-content-length", fmt.Sprintf("%d", len(responseBody)))
-		w.WriteTrailers(trailers)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	cut, err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("Shutdown timed out, cut off %d connections: %v", cut, err)
 		return
 	}
+	log.Println("Server gracefully stopped")
+}
 
-	switch req.RequestLine.RequestTarget {
-	case "/yourproblem":
-		w.WriteStatusLine(response.StatusBadRequest)
-		headers := response.GetDefaultHeaders(len(server.BadRequestHTML))
-		headers.SetContentType("text/html")
-		w.WriteHeaders(headers)
-		w.WriteBody([]byte(server.BadRequestHTML))
-	case "/myproblem":
-		w.WriteStatusLine(response.StatusInternalServerError)
-		headers := response.GetDefaultHeaders(len(server.ServerErrorHTML))
-		headers.SetContentType("text/html")
-		w.WriteHeaders(headers)
-		w.WriteBody([]byte(server.ServerErrorHTML))
-	case "/video":
-		data, err := os.ReadFile("assets/vim.mp4")
-		if err != nil {
-			log.Fatal(err)
-		}
-		w.WriteStatusLine(response.StatusOK)
-		headers := response.GetDefaultHeaders(len(data))
-		headers.SetContentType("video/mp4")
-		w.WriteHeaders(headers)
-		w.WriteBody(data)
-	default:
-		w.WriteStatusLine(response.StatusOK)
-		headers := response.GetDefaultHeaders(len(server.SuccessHTML))
-		headers.SetContentType("text/html")
-		w.WriteHeaders(headers)
-		w.WriteBody([]byte(server.SuccessHTML))
-	}
+func videoHandler(w *response.Writer, req *request.Request) {
+	server.ServeFile(w, req, "assets/vim.mp4")
 }
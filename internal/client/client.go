@@ -0,0 +1,482 @@
+// Package client is an HTTP/1.1 client that writes requests with
+// request.Request.Write and reads responses with the same header parser
+// the server uses.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+)
+
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultMaxIdleConnsPerHost = 4
+	defaultIdleTimeout         = 90 * time.Second
+	keepAlivePeriod            = 30 * time.Second
+	// maxDiscard is how much of a redirect's body is read to keep the
+	// connection before giving up on it.
+	maxDiscard = 4 << 10
+)
+
+var (
+	ErrUnsupportedScheme = errors.New("client: unsupported URL scheme")
+	ErrBodyClosed        = errors.New("client: read on closed body")
+	ErrTooManyRedirects  = errors.New("client: too many redirects")
+)
+
+// Client sends requests and keeps connections open for the requests that
+// follow. The zero value is ready to use, and a Client is safe for
+// concurrent use.
+type Client struct {
+	// DialTimeout limits connecting, TLS handshake included, and
+	// defaults to 30 seconds.
+	DialTimeout time.Duration
+	// ResponseTimeout limits the wait for response headers once the
+	// request is sent. Zero means only the context limits it.
+	ResponseTimeout time.Duration
+	// MaxConnsPerHost caps the connections to one host, busy or idle.
+	// Requests beyond it wait for one to be free. Zero means no limit.
+	MaxConnsPerHost int
+	// MaxIdleConnsPerHost is how many idle connections to keep per host,
+	// 4 by default.
+	MaxIdleConnsPerHost int
+	// IdleTimeout is how long an idle connection is kept, 90 seconds by
+	// default.
+	IdleTimeout time.Duration
+	// TLSConfig is used for https URLs.
+	TLSConfig *tls.Config
+	// MaxRedirects is how many redirects Do follows before failing with
+	// ErrTooManyRedirects. Zero returns redirects to the caller instead.
+	MaxRedirects int
+	// Jar, if set, stores the cookies of responses and sends them back
+	// with later requests.
+	Jar *Jar
+
+	mu    sync.Mutex
+	hosts map[string]*hostConns
+}
+
+type hostConns struct {
+	idle []*conn
+	// open counts the connections dialed or being dialed, idle included.
+	open int
+	// waiters get a free connection, or nil when a slot opens up.
+	waiters []chan *conn
+}
+
+type conn struct {
+	key       string
+	nc        net.Conn
+	br        *bufio.Reader
+	idleSince time.Time
+	reused    bool
+}
+
+// NewRequest makes a request for rawURL, which must be absolute. Do
+// sends it to the host the URL names.
+func NewRequest(method, rawURL string, body []byte) (*request.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return nil, fmt.Errorf("client: %q is not an absolute URL", rawURL)
+	}
+	h := headers.NewHeaders()
+	h.Set("host", u.Host)
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: method, RequestTarget: u.String(), HttpVersion: "1.1"},
+		Headers:     h,
+		Body:        body,
+	}, nil
+}
+
+func (c *Client) Get(ctx context.Context, rawURL string) (*Response, error) {
+	req, err := NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(ctx, req)
+}
+
+// Do sends req, whose target must be an absolute URL, and reads the
+// response headers. The caller must close the response body; reading it
+// to the end lets the connection be reused. Cancelling ctx aborts the
+// request, including reading the body.
+func (c *Client) Do(ctx context.Context, req *request.Request) (*Response, error) {
+	u, err := requestURL(req)
+	if err != nil {
+		return nil, err
+	}
+	for hops := 0; ; hops++ {
+		res, err := c.send(ctx, req, u)
+		if err != nil {
+			return nil, err
+		}
+		res.URL = u
+		if c.Jar != nil {
+			c.Jar.SetCookies(u, res.SetCookies)
+		}
+		next, ok := redirectTarget(res, u)
+		if !ok || c.MaxRedirects <= 0 {
+			return res, nil
+		}
+		following := redirect(req, res.StatusCode, u, next)
+		// A streamed body has been used up and can't be sent again.
+		if following.BodyReader != nil {
+			return res, nil
+		}
+		// Reading a short body to the end keeps the connection.
+		io.Copy(io.Discard, io.LimitReader(res.Body, maxDiscard))
+		res.Body.Close()
+		if hops >= c.MaxRedirects {
+			return nil, fmt.Errorf("%w: more than %d", ErrTooManyRedirects, c.MaxRedirects)
+		}
+		req = following
+		u = next
+	}
+}
+
+func requestURL(req *request.Request) (*url.URL, error) {
+	u, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("client: %q is not an absolute URL", req.RequestLine.RequestTarget)
+	}
+	return u, nil
+}
+
+// send makes one request to u, the target of req.
+func (c *Client) send(ctx context.Context, req *request.Request, u *url.URL) (*Response, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), map[string]string{"http": "80", "https": "443"}[u.Scheme])
+	}
+
+	// Origin servers get the path and query only.
+	out := *req
+	out.RequestLine.RequestTarget = u.RequestURI()
+	out.Headers = headers.NewHeaders()
+	for key, value := range req.Headers {
+		out.Headers[key] = value
+	}
+	if out.Headers["host"] == "" {
+		out.Headers["host"] = u.Host
+	}
+	if c.Jar != nil {
+		if stored := c.Jar.header(u); stored != "" {
+			// Cookie pairs are separated by semicolons, not commas.
+			if given := out.Headers["cookie"]; given != "" {
+				stored = given + "; " + stored
+			}
+			out.Headers.Override("cookie", stored)
+		}
+	}
+	key := u.Scheme + "://" + addr
+	for attempt := 0; ; attempt++ {
+		pc, err := c.getConn(ctx, key, u.Scheme, addr, u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.roundTrip(ctx, pc, &out)
+		// The server may have closed an idle connection just as it was
+		// picked up. That is worth one retry if resending is harmless and
+		// the body, if streamed, can still be sent.
+		if err != nil && pc.reused && attempt == 0 && ctx.Err() == nil && idempotent(out.RequestLine.Method) && out.BodyReader == nil {
+			continue
+		}
+		return res, err
+	}
+}
+
+func (c *Client) roundTrip(ctx context.Context, pc *conn, req *request.Request) (*Response, error) {
+	// Cancelling ctx fails any read or write in progress.
+	stop := context.AfterFunc(ctx, func() { pc.nc.SetDeadline(time.Unix(1, 0)) })
+	fail := func(err error) (*Response, error) {
+		stop()
+		c.closeConn(pc)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("client: %s %s: %w", req.RequestLine.Method, req.Headers["host"], err)
+	}
+
+	if err := req.Write(pc.nc); err != nil {
+		return fail(err)
+	}
+	if c.ResponseTimeout > 0 {
+		pc.nc.SetReadDeadline(time.Now().Add(c.ResponseTimeout))
+	}
+	res, err := ReadResponse(pc.br, req.RequestLine.Method)
+	if err != nil {
+		return fail(err)
+	}
+	pc.nc.SetReadDeadline(time.Time{})
+
+	reusable := !res.close && !hasToken(strings.ToLower(req.Headers["connection"]), "close")
+	b := &body{r: res.body, ctx: ctx, client: c, pc: pc, stop: stop, reusable: reusable}
+	if res.empty() {
+		b.finish(reusable)
+	}
+	res.Body = b
+	return res, nil
+}
+
+// CloseIdleConnections closes the connections not in use.
+func (c *Client) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, h := range c.hosts {
+		for _, pc := range h.idle {
+			pc.nc.Close()
+			c.freeSlot(h)
+		}
+		h.idle = nil
+	}
+}
+
+// getConn returns an idle connection to key, dials a new one or, at the
+// host's limit, waits for one to be released.
+func (c *Client) getConn(ctx context.Context, key, scheme, addr, serverName string) (*conn, error) {
+	for {
+		c.mu.Lock()
+		if c.hosts == nil {
+			c.hosts = map[string]*hostConns{}
+		}
+		h := c.hosts[key]
+		if h == nil {
+			h = &hostConns{}
+			c.hosts[key] = h
+		}
+		for len(h.idle) > 0 {
+			pc := h.idle[len(h.idle)-1]
+			h.idle = h.idle[:len(h.idle)-1]
+			if time.Since(pc.idleSince) > c.idleTimeout() {
+				pc.nc.Close()
+				c.freeSlot(h)
+				continue
+			}
+			c.mu.Unlock()
+			pc.reused = true
+			return pc, nil
+		}
+		if c.MaxConnsPerHost <= 0 || h.open < c.MaxConnsPerHost {
+			h.open++
+			c.mu.Unlock()
+			pc, err := c.dial(ctx, scheme, addr, serverName)
+			if err != nil {
+				c.mu.Lock()
+				c.freeSlot(h)
+				c.mu.Unlock()
+				return nil, err
+			}
+			pc.key = key
+			return pc, nil
+		}
+		ready := make(chan *conn, 1)
+		h.waiters = append(h.waiters, ready)
+		c.mu.Unlock()
+
+		select {
+		case pc := <-ready:
+			if pc != nil {
+				pc.reused = true
+				return pc, nil
+			}
+		case <-ctx.Done():
+			c.mu.Lock()
+			for i, w := range h.waiters {
+				if w == ready {
+					h.waiters = append(h.waiters[:i], h.waiters[i+1:]...)
+					break
+				}
+			}
+			c.mu.Unlock()
+			// Something may have been handed over in the meantime.
+			select {
+			case pc := <-ready:
+				if pc != nil {
+					c.putConn(pc)
+				} else {
+					c.mu.Lock()
+					c.wake(h, nil)
+					c.mu.Unlock()
+				}
+			default:
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Client) dial(ctx context.Context, scheme, addr, serverName string) (*conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.dialTimeout())
+	defer cancel()
+	d := net.Dialer{KeepAlive: keepAlivePeriod}
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	if scheme == "https" {
+		config := &tls.Config{}
+		if c.TLSConfig != nil {
+			config = c.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = serverName
+		}
+		config.NextProtos = []string{"http/1.1"}
+		tc := tls.Client(nc, config)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("client: %w", err)
+		}
+		nc = tc
+	}
+	return &conn{nc: nc, br: bufio.NewReader(nc)}, nil
+}
+
+// putConn makes pc available to the next request.
+func (c *Client) putConn(pc *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.hosts[pc.key]
+	if c.wake(h, pc) {
+		return
+	}
+	if len(h.idle) >= c.maxIdle() {
+		pc.nc.Close()
+		c.freeSlot(h)
+		return
+	}
+	pc.idleSince = time.Now()
+	h.idle = append(h.idle, pc)
+}
+
+func (c *Client) closeConn(pc *conn) {
+	pc.nc.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.freeSlot(c.hosts[pc.key])
+}
+
+// freeSlot accounts for a closed connection, letting a waiter dial.
+func (c *Client) freeSlot(h *hostConns) {
+	h.open--
+	c.wake(h, nil)
+}
+
+// wake hands pc, or a free slot if pc is nil, to the longest waiter.
+func (c *Client) wake(h *hostConns, pc *conn) bool {
+	if len(h.waiters) == 0 {
+		return false
+	}
+	w := h.waiters[0]
+	h.waiters = h.waiters[1:]
+	w <- pc
+	return true
+}
+
+func (c *Client) dialTimeout() time.Duration {
+	if c.DialTimeout > 0 {
+		return c.DialTimeout
+	}
+	return defaultDialTimeout
+}
+
+func (c *Client) maxIdle() int {
+	if c.MaxIdleConnsPerHost > 0 {
+		return c.MaxIdleConnsPerHost
+	}
+	return defaultMaxIdleConnsPerHost
+}
+
+func (c *Client) idleTimeout() time.Duration {
+	if c.IdleTimeout > 0 {
+		return c.IdleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// body returns the connection to the pool once it has been read to the
+// end, and closes it if it is abandoned earlier.
+type body struct {
+	r        io.Reader
+	ctx      context.Context
+	client   *Client
+	pc       *conn
+	stop     func() bool
+	reusable bool
+
+	mu     sync.Mutex
+	done   bool
+	closed bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, ErrBodyClosed
+	}
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.r.Read(p)
+	switch {
+	case err == io.EOF:
+		b.finish(b.reusable)
+	case err != nil:
+		b.finish(false)
+		if b.ctx.Err() != nil {
+			err = b.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+func (b *body) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if !b.done {
+		b.finish(false)
+	}
+	return nil
+}
+
+func (b *body) finish(reuse bool) {
+	b.done = true
+	// stop fails if ctx was cancelled, which has already spoiled the
+	// connection's deadline.
+	if b.stop() && reuse {
+		b.client.putConn(b.pc)
+		return
+	}
+	b.client.closeConn(b.pc)
+}
@@ -0,0 +1,367 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		name, method, raw string
+		code              response.StatusCode
+		body              string
+		length            int64
+		close             bool
+		trailers          map[string]string
+	}{
+		{name: "content-length", raw: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhelloNEXT", code: 200, body: "hello", length: 5},
+		{name: "chunked with trailers", raw: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Sum: abc\r\n\r\nNEXT",
+			code: 200, body: "hello world", length: -1, trailers: map[string]string{"x-sum": "abc"}},
+		{name: "close-delimited", raw: "HTTP/1.1 200 OK\r\n\r\nuntil the end", code: 200, body: "until the end", length: -1, close: true},
+		{name: "HEAD has no body", method: "HEAD", raw: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nNEXT", code: 200, length: 5},
+		{name: "204 has no body", raw: "HTTP/1.1 204 No Content\r\n\r\nNEXT", code: 204, length: -1},
+		{name: "interim responses are skipped", raw: "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nokNEXT", code: 201, body: "ok", length: 2},
+		{name: "HTTP/1.0 closes by default", raw: "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok", code: 200, body: "ok", length: 2, close: true},
+		{name: "connection close", raw: "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nok", code: 200, body: "ok", length: 2, close: true},
+	}
+	for _, tt := range tests {
+		// Test: Each way of framing a body ends where it should
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = "GET"
+			}
+			br := bufio.NewReader(strings.NewReader(tt.raw))
+			res, err := ReadResponse(br, method)
+			require.NoError(t, err)
+			assert.Equal(t, tt.code, res.StatusCode)
+			assert.Equal(t, tt.length, res.ContentLength)
+			assert.Equal(t, tt.close, res.close)
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(body))
+			for key, value := range tt.trailers {
+				assert.Equal(t, value, res.Trailers[key])
+			}
+			if !tt.close {
+				rest, _ := io.ReadAll(br)
+				assert.Equal(t, "NEXT", string(rest))
+			}
+		})
+	}
+
+	// Test: Malformed and truncated responses are errors
+	for _, raw := range []string{
+		"HTTP/2 200 OK\r\n\r\n",
+		"HTTP/1.1 2000 OK\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nBad Header\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: -1\r\n\r\n",
+	} {
+		_, err := ReadResponse(bufio.NewReader(strings.NewReader(raw)), "GET")
+		assert.ErrorIs(t, err, ErrMalformedResponse, raw)
+	}
+	for _, raw := range []string{
+		"HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nshort",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel",
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n",
+	} {
+		res, err := ReadResponse(bufio.NewReader(strings.NewReader(raw)), "GET")
+		require.NoError(t, err)
+		_, err = io.ReadAll(res.Body)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF, raw)
+	}
+}
+
+// upstream is a bare-bones server: handle answers each request on w and
+// says whether to keep the connection open.
+type upstream struct {
+	addr     string
+	accepted atomic.Int32
+}
+
+func startUpstream(t *testing.T, handle func(w io.Writer, req *request.Request) bool) *upstream {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	u := &upstream{addr: l.Addr().String()}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			u.accepted.Add(1)
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					req, err := request.RequestFromReader(br)
+					if err != nil || !handle(c, req) {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return u
+}
+
+func echo(w io.Writer, req *request.Request) bool {
+	body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + req.Headers["host"] + " " + string(req.Body)
+	io.WriteString(w, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+	return true
+}
+
+func readBody(t *testing.T, res *Response) string {
+	t.Helper()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	return string(body)
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	u := startUpstream(t, echo)
+	c := &Client{}
+	ctx := context.Background()
+
+	// Test: The request goes out in origin-form with Host and body
+	req, err := NewRequest("POST", "http://"+u.addr+"/submit?x=1", []byte("hi"))
+	require.NoError(t, err)
+	res, err := c.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusOK, res.StatusCode)
+	assert.Equal(t, "POST /submit?x=1 "+u.addr+" hi", readBody(t, res))
+
+	// Test: A body read to the end frees the connection for the next request
+	for range 3 {
+		res, err = c.Get(ctx, "http://"+u.addr+"/again")
+		require.NoError(t, err)
+		readBody(t, res)
+	}
+	assert.Equal(t, int32(1), u.accepted.Load())
+
+	// Test: A body closed early takes its connection with it
+	res, err = c.Get(ctx, "http://"+u.addr+"/early")
+	require.NoError(t, err)
+	res.Body.Close()
+	_, err = res.Body.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, ErrBodyClosed)
+	res, err = c.Get(ctx, "http://"+u.addr+"/after")
+	require.NoError(t, err)
+	readBody(t, res)
+	assert.Equal(t, int32(2), u.accepted.Load())
+
+	// Test: A connection the server closed while idle is retried on a new one
+	closing := startUpstream(t, func(w io.Writer, req *request.Request) bool {
+		echo(w, req)
+		return false
+	})
+	for range 2 {
+		res, err = c.Get(ctx, "http://"+closing.addr+"/")
+		require.NoError(t, err)
+		readBody(t, res)
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(2), closing.accepted.Load())
+
+	// Test: Only http and https are supported
+	_, err = c.Get(ctx, "ftp://"+u.addr+"/")
+	assert.ErrorIs(t, err, ErrUnsupportedScheme)
+}
+
+func TestClientMaxConnsPerHost(t *testing.T) {
+	var inFlight, most atomic.Int32
+	u := startUpstream(t, func(w io.Writer, req *request.Request) bool {
+		n := inFlight.Add(1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		inFlight.Add(-1)
+		return echo(w, req)
+	})
+	c := &Client{MaxConnsPerHost: 2}
+
+	// Test: Requests over the limit wait for a connection instead of dialing
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.Get(context.Background(), "http://"+u.addr+"/")
+			if assert.NoError(t, err) {
+				io.ReadAll(res.Body)
+				res.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), most.Load())
+	assert.Equal(t, int32(2), u.accepted.Load())
+
+	// Test: A waiting request gives up when its context ends
+	block := make(chan struct{})
+	defer close(block)
+	slow := startUpstream(t, func(w io.Writer, req *request.Request) bool {
+		<-block
+		return false
+	})
+	one := &Client{MaxConnsPerHost: 1}
+	go one.Get(context.Background(), "http://"+slow.addr+"/")
+	require.Eventually(t, func() bool { return slow.accepted.Load() == 1 }, time.Second, 5*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := one.Get(ctx, "http://"+slow.addr+"/")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestClientTimeouts(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	silent := startUpstream(t, func(w io.Writer, req *request.Request) bool {
+		if req.Path() == "/trickle" {
+			io.WriteString(w, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello")
+		}
+		<-block
+		return false
+	})
+
+	// Test: ResponseTimeout bounds the wait for headers
+	c := &Client{ResponseTimeout: 50 * time.Millisecond}
+	_, err := c.Get(context.Background(), "http://"+silent.addr+"/")
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr), "%v", err)
+	assert.True(t, netErr.Timeout())
+
+	// Test: Cancelling the context aborts the request
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = (&Client{}).Get(ctx, "http://"+silent.addr+"/")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Test: ...and a body still being read
+	ctx, cancel = context.WithCancel(context.Background())
+	res, err := (&Client{}).Get(ctx, "http://"+silent.addr+"/trickle")
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(res.Body, buf)
+	require.NoError(t, err)
+	cancel()
+	_, err = io.ReadAll(res.Body)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestClientRedirects(t *testing.T) {
+	show := func(w io.Writer, req *request.Request) bool {
+		body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body) +
+			"|" + req.Headers["authorization"] + "|" + req.Headers["cookie"]
+		head := "HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"
+		if req.RequestLine.Method == "HEAD" {
+			body = ""
+		}
+		io.WriteString(w, head+body)
+		return true
+	}
+	other := startUpstream(t, show)
+	u := startUpstream(t, func(w io.Writer, req *request.Request) bool {
+		code := strings.TrimPrefix(req.Path(), "/")
+		switch {
+		case code == "loop":
+			io.WriteString(w, "HTTP/1.1 302 Found\r\nLocation: /loop\r\nContent-Length: 0\r\n\r\n")
+		case code == "away":
+			io.WriteString(w, "HTTP/1.1 302 Found\r\nLocation: http://"+other.addr+"/there\r\nContent-Length: 0\r\n\r\n")
+		case code == "login":
+			io.WriteString(w, "HTTP/1.1 303 See Other\r\nSet-Cookie: session=abc; Path=/\r\nLocation: /home\r\nContent-Length: 0\r\n\r\n")
+		case len(code) == 3:
+			body := "moved"
+			if req.RequestLine.Method == "HEAD" {
+				body = ""
+			}
+			io.WriteString(w, "HTTP/1.1 "+code+" Moved\r\nLocation: /done\r\nContent-Length: 5\r\n\r\n"+body)
+		default:
+			return show(w, req)
+		}
+		return true
+	})
+	ctx := context.Background()
+	c := &Client{MaxRedirects: 3}
+
+	tests := []struct {
+		code, method, want string
+	}{
+		{"301", "POST", "GET /done |secret|"},
+		{"302", "POST", "GET /done |secret|"},
+		{"303", "PUT", "GET /done |secret|"},
+		{"303", "HEAD", ""},
+		{"307", "POST", "POST /done data|secret|"},
+		{"308", "PUT", "PUT /done data|secret|"},
+		{"302", "DELETE", "DELETE /done data|secret|"},
+	}
+	for _, tt := range tests {
+		// Test: Each redirect code keeps or drops the method and body as RFC 9110 says
+		req, err := NewRequest(tt.method, "http://"+u.addr+"/"+tt.code, []byte("data"))
+		require.NoError(t, err)
+		req.Headers.Set("authorization", "secret")
+		res, err := c.Do(ctx, req)
+		require.NoError(t, err, tt.code)
+		assert.Equal(t, response.StatusOK, res.StatusCode, tt.code)
+		assert.Equal(t, "/done", res.URL.Path, tt.code)
+		assert.Equal(t, tt.want, readBody(t, res), "%s %s", tt.code, tt.method)
+	}
+
+	// Test: Redirect bodies are drained so the connection is reused
+	assert.Equal(t, int32(1), u.accepted.Load())
+
+	// Test: Without MaxRedirects the redirect itself is returned
+	res, err := (&Client{}).Get(ctx, "http://"+u.addr+"/302")
+	require.NoError(t, err)
+	assert.Equal(t, response.StatusFound, res.StatusCode)
+	assert.Equal(t, "/done", res.Headers["location"])
+	assert.Equal(t, "moved", readBody(t, res))
+
+	// Test: Following stops after MaxRedirects hops
+	_, err = c.Get(ctx, "http://"+u.addr+"/loop")
+	assert.ErrorIs(t, err, ErrTooManyRedirects)
+
+	// Test: Credentials are not sent on to another origin
+	req, err := NewRequest("GET", "http://"+u.addr+"/away", nil)
+	require.NoError(t, err)
+	req.Headers.Set("authorization", "secret")
+	req.Headers.Set("cookie", "a=1")
+	res, err = c.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /there ||", readBody(t, res))
+	assert.Equal(t, other.addr, res.URL.Host)
+
+	// Test: Cookies set on a redirect go with the next hop and later requests
+	jarred := &Client{MaxRedirects: 3, Jar: &Jar{}}
+	res, err = jarred.Get(ctx, "http://"+u.addr+"/login")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /home ||session=abc", readBody(t, res))
+	req, err = NewRequest("GET", "http://"+u.addr+"/later", nil)
+	require.NoError(t, err)
+	req.Headers.Set("cookie", "a=1")
+	res, err = jarred.Do(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "GET /later ||a=1; session=abc", readBody(t, res))
+}
@@ -0,0 +1,242 @@
+package client
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookie is a cookie as stored by a Jar.
+type Cookie struct {
+	Name  string
+	Value string
+	// Domain is the host the cookie was set by, or the domain it named
+	// to cover subdomains as well.
+	Domain string
+	Path   string
+	// Expires is zero for a session cookie, kept until the jar goes away.
+	Expires  time.Time
+	Secure   bool
+	HttpOnly bool
+	SameSite string
+
+	// hostOnly is set when there was no Domain attribute, so only the
+	// exact host gets the cookie back.
+	hostOnly bool
+	created  time.Time
+}
+
+// cookieDateFormats are the Expires formats seen in the wild, the first
+// being the one RFC 6265 asks servers to send.
+var cookieDateFormats = []string{
+	"Mon, 02 Jan 2006 15:04:05 MST",
+	"Mon, 02-Jan-2006 15:04:05 MST",
+	"Monday, 02-Jan-06 15:04:05 MST",
+	"Mon Jan _2 15:04:05 2006",
+	"Mon, 02-Jan-06 15:04:05 MST",
+}
+
+// Jar keeps cookies from responses and picks the ones to send with each
+// request, following RFC 6265. Without a public suffix list it only
+// refuses cookies for top-level domains, so it should not be shared
+// between untrusted sites. The zero value is an empty jar.
+type Jar struct {
+	mu      sync.Mutex
+	cookies map[string]*Cookie
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// SetCookies stores the cookies from the Set-Cookie fields of a response
+// to u, replacing any with the same name, domain and path. A cookie that
+// has already expired deletes its namesake.
+func (j *Jar) SetCookies(u *url.URL, setCookies []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cookies == nil {
+		j.cookies = map[string]*Cookie{}
+	}
+	now := j.clock()
+	for _, line := range setCookies {
+		c, ok := parseSetCookie(line, u, now)
+		if !ok {
+			continue
+		}
+		key := c.Domain + ";" + c.Path + ";" + c.Name
+		old, exists := j.cookies[key]
+		if !c.Expires.IsZero() && !c.Expires.After(now) {
+			delete(j.cookies, key)
+			continue
+		}
+		if exists {
+			c.created = old.created
+		}
+		j.cookies[key] = c
+	}
+}
+
+// Cookies returns the cookies to send to u, longest path first.
+func (j *Jar) Cookies(u *url.URL) []*Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.clock()
+	host := canonicalHost(u)
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	var matched []*Cookie
+	for key, c := range j.cookies {
+		if !c.Expires.IsZero() && !c.Expires.After(now) {
+			delete(j.cookies, key)
+			continue
+		}
+		if !c.domainMatch(host) || !pathMatch(path, c.Path) || c.Secure && u.Scheme != "https" {
+			continue
+		}
+		copied := *c
+		matched = append(matched, &copied)
+	}
+	sort.Slice(matched, func(a, b int) bool {
+		if len(matched[a].Path) != len(matched[b].Path) {
+			return len(matched[a].Path) > len(matched[b].Path)
+		}
+		if !matched[a].created.Equal(matched[b].created) {
+			return matched[a].created.Before(matched[b].created)
+		}
+		return matched[a].Name < matched[b].Name
+	})
+	return matched
+}
+
+// header is the Cookie field for a request to u, or an empty string.
+func (j *Jar) header(u *url.URL) string {
+	var pairs []string
+	for _, c := range j.Cookies(u) {
+		pairs = append(pairs, c.Name+"="+c.Value)
+	}
+	return strings.Join(pairs, "; ")
+}
+
+func (j *Jar) clock() time.Time {
+	if j.now != nil {
+		return j.now()
+	}
+	return time.Now()
+}
+
+// parseSetCookie follows RFC 6265 sections 5.2 and 5.3, reporting false
+// for a cookie the user agent must ignore.
+func parseSetCookie(line string, u *url.URL, now time.Time) (*Cookie, bool) {
+	parts := strings.Split(line, ";")
+	name, value, ok := strings.Cut(parts[0], "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return nil, false
+	}
+	value = strings.TrimSpace(value)
+	if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	c := &Cookie{Name: name, Value: value, created: now}
+
+	host := canonicalHost(u)
+	var domain, path string
+	var maxAge *time.Time
+	for _, attr := range parts[1:] {
+		key, val, _ := strings.Cut(attr, "=")
+		key, val = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(val)
+		switch key {
+		case "expires":
+			for _, layout := range cookieDateFormats {
+				if t, err := time.Parse(layout, val); err == nil {
+					c.Expires = t
+					break
+				}
+			}
+		case "max-age":
+			seconds, err := strconv.Atoi(val)
+			if err != nil {
+				continue
+			}
+			// Zero or less means expire now; Max-Age beats Expires.
+			t := now.Add(time.Duration(seconds) * time.Second)
+			if seconds <= 0 {
+				t = time.Unix(0, 0)
+			}
+			maxAge = &t
+		case "domain":
+			domain = strings.ToLower(strings.TrimPrefix(val, "."))
+		case "path":
+			if strings.HasPrefix(val, "/") {
+				path = val
+			}
+		case "secure":
+			c.Secure = true
+		case "httponly":
+			c.HttpOnly = true
+		case "samesite":
+			c.SameSite = val
+		}
+	}
+	if maxAge != nil {
+		c.Expires = *maxAge
+	}
+
+	switch {
+	case domain == "" || domain == host:
+		c.Domain, c.hostOnly = host, domain == ""
+	case net.ParseIP(host) != nil || !strings.Contains(domain, ".") || !strings.HasSuffix(host, "."+domain):
+		// A cookie may only cover the host that set it and the domains
+		// above it, and never a whole top-level domain.
+		return nil, false
+	default:
+		c.Domain = domain
+	}
+	if path == "" {
+		path = defaultCookiePath(u.EscapedPath())
+	}
+	c.Path = path
+	// Only a secure origin can set a secure cookie.
+	if c.Secure && u.Scheme != "https" {
+		return nil, false
+	}
+	return c, true
+}
+
+func (c *Cookie) domainMatch(host string) bool {
+	if c.hostOnly || net.ParseIP(host) != nil {
+		return host == c.Domain
+	}
+	return host == c.Domain || strings.HasSuffix(host, "."+c.Domain)
+}
+
+// pathMatch is RFC 6265 section 5.1.4: the cookie path is the request
+// path or a directory above it.
+func pathMatch(path, cookiePath string) bool {
+	if path == cookiePath {
+		return true
+	}
+	return strings.HasPrefix(path, cookiePath) &&
+		(strings.HasSuffix(cookiePath, "/") || path[len(cookiePath)] == '/')
+}
+
+// defaultCookiePath is the directory of the request path.
+func defaultCookiePath(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/"
+	}
+	i := strings.LastIndex(path, "/")
+	if i == 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+func canonicalHost(u *url.URL) string {
+	return strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJar(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	j := &Jar{now: func() time.Time { return now }}
+	parse := func(raw string) *url.URL {
+		u, err := url.Parse(raw)
+		require.NoError(t, err)
+		return u
+	}
+	names := func(raw string) []string {
+		var out []string
+		for _, c := range j.Cookies(parse(raw)) {
+			out = append(out, c.Name+"="+c.Value)
+		}
+		return out
+	}
+
+	j.SetCookies(parse("http://www.example.com/app/login"), []string{
+		"host=1",
+		"wide=2; Domain=.Example.com; Path=/",
+		"deep=3; Path=/app/admin",
+		`quoted="4"; Path=/`,
+		"secure=5; Secure",
+		"tld=6; Domain=com",
+		"elsewhere=7; Domain=other.com",
+		"noequals",
+	})
+
+	// Test: Host-only cookies stay with their host, domain cookies cover subdomains
+	assert.Equal(t, []string{"host=1", "quoted=4", "wide=2"}, names("http://www.example.com/app/x"))
+	assert.Equal(t, []string{"wide=2"}, names("http://api.example.com/app/x"))
+	assert.Empty(t, names("http://example.org/"))
+
+	// Test: The default path is the directory of the request, longer paths come first
+	assert.Equal(t, []string{"deep=3", "host=1", "quoted=4", "wide=2"}, names("http://www.example.com/app/admin/users"))
+	assert.Equal(t, []string{"quoted=4", "wide=2"}, names("http://www.example.com/application"))
+
+	// Test: Secure cookies are only taken from and sent to https
+	j.SetCookies(parse("https://www.example.com/"), []string{"secure=5; Secure; Path=/"})
+	assert.NotContains(t, names("http://www.example.com/"), "secure=5")
+	assert.Contains(t, names("https://www.example.com/"), "secure=5")
+
+	// Test: Max-Age beats Expires and cookies go once they expire
+	j.SetCookies(parse("http://www.example.com/"), []string{
+		"short=1; Max-Age=60; Expires=Wed, 01 Jan 2025 00:00:00 GMT",
+		"dated=2; Expires=Sat, 01 Jun 2024 13:00:00 GMT",
+	})
+	assert.Subset(t, names("http://www.example.com/"), []string{"short=1", "dated=2"})
+	now = now.Add(2 * time.Minute)
+	assert.NotContains(t, names("http://www.example.com/"), "short=1")
+	assert.Contains(t, names("http://www.example.com/"), "dated=2")
+
+	// Test: A replaced cookie keeps its place, an expired one deletes it
+	j.SetCookies(parse("http://www.example.com/"), []string{"quoted=new; Path=/", "wide=; Domain=example.com; Path=/; Max-Age=0"})
+	assert.Equal(t, []string{"host=1", "dated=2", "quoted=new"}, names("http://www.example.com/app/x"))
+	assert.Equal(t, "host=1; dated=2; quoted=new", j.header(parse("http://www.example.com/app/x")))
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"net/url"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// credentials are dropped on a redirect to another origin, which has no
+// business seeing them. The jar adds back any cookies the new origin has.
+var credentials = []string{"authorization", "proxy-authorization", "cookie"}
+
+// redirectTarget returns where res redirects to, if anywhere.
+func redirectTarget(res *Response, u *url.URL) (*url.URL, bool) {
+	switch res.StatusCode {
+	case response.StatusMovedPermanently, response.StatusFound, response.StatusSeeOther,
+		response.StatusTemporaryRedirect, response.StatusPermanentRedirect:
+	default:
+		return nil, false
+	}
+	location := res.Headers["location"]
+	if location == "" {
+		return nil, false
+	}
+	next, err := u.Parse(location)
+	if err != nil || next.Scheme != "http" && next.Scheme != "https" {
+		return nil, false
+	}
+	// The fragment stays with the client, as with any request.
+	next.Fragment, next.RawFragment = "", ""
+	return next, true
+}
+
+// redirect builds the request that follows req to next after a redirect
+// with code, per RFC 9110 section 15.4.
+func redirect(req *request.Request, code response.StatusCode, from, next *url.URL) *request.Request {
+	out := *req
+	out.RequestLine.RequestTarget = next.String()
+	out.Headers = headers.NewHeaders()
+	for key, value := range req.Headers {
+		out.Headers[key] = value
+	}
+	out.Headers.Override("host", next.Host)
+
+	// 303 always means fetch the result with GET. Browsers have long done
+	// the same for POST after 301 and 302, which RFC 9110 allows. 307 and
+	// 308 exist to keep the method and body.
+	method := req.RequestLine.Method
+	if code == response.StatusSeeOther && method != "HEAD" ||
+		(code == response.StatusMovedPermanently || code == response.StatusFound) && method == "POST" {
+		out.RequestLine.Method = "GET"
+		out.Body, out.BodyReader = nil, nil
+		for _, name := range []string{"content-length", "content-type", "transfer-encoding"} {
+			out.Headers.Remove(name)
+		}
+	}
+
+	if from.Scheme != next.Scheme || from.Host != next.Host {
+		for _, name := range credentials {
+			out.Headers.Remove(name)
+		}
+	}
+	return &out
+}
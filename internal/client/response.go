@@ -0,0 +1,287 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/response"
+)
+
+// maxHeaderBytes bounds the status line and headers, or trailers, of a
+// response.
+const maxHeaderBytes = 1 << 20
+
+var ErrMalformedResponse = errors.New("client: malformed response")
+
+type Response struct {
+	StatusCode response.StatusCode
+	// Reason is the reason phrase of the status line.
+	Reason string
+	// Proto is "HTTP/1.1" or "HTTP/1.0".
+	Proto   string
+	Headers headers.Headers
+	// SetCookies holds each Set-Cookie field on its own, since unlike
+	// other fields they can't be joined into one line with commas.
+	SetCookies []string
+	// ContentLength is -1 if the body is chunked or runs until the
+	// connection closes.
+	ContentLength int64
+	Body          io.ReadCloser
+	// Trailers holds the fields after a chunked body, once Body has been
+	// read to the end.
+	Trailers headers.Headers
+	// URL is where the response came from, after any redirects.
+	URL *url.URL
+
+	// close is set if the connection can't carry another response.
+	close bool
+	body  io.Reader
+}
+
+// ReadResponse reads the response to a request with method from br,
+// skipping interim 1xx responses. The body stays in br, to be read
+// through Body.
+func ReadResponse(br *bufio.Reader, method string) (*Response, error) {
+	for {
+		res, err := readHead(br)
+		if err != nil {
+			return nil, err
+		}
+		// 101 hands the connection over to another protocol; other 1xx
+		// come before the real response.
+		if res.StatusCode >= 100 && res.StatusCode < 200 && res.StatusCode != response.StatusSwitchingProtocols {
+			continue
+		}
+		if err := res.frameBody(br, method); err != nil {
+			return nil, err
+		}
+		res.Body = io.NopCloser(res.body)
+		return res, nil
+	}
+}
+
+func readHead(br *bufio.Reader) (*Response, error) {
+	limit := maxHeaderBytes
+	line, err := readLine(br, &limit)
+	if err != nil {
+		return nil, err
+	}
+	proto, rest, _ := strings.Cut(strings.TrimSuffix(line, "\r\n"), " ")
+	code, reason, _ := strings.Cut(rest, " ")
+	if proto != "HTTP/1.1" && proto != "HTTP/1.0" {
+		return nil, fmt.Errorf("%w: status line %q", ErrMalformedResponse, line)
+	}
+	status, err := strconv.Atoi(code)
+	if err != nil || len(code) != 3 || status < 100 {
+		return nil, fmt.Errorf("%w: status line %q", ErrMalformedResponse, line)
+	}
+
+	res := &Response{
+		StatusCode: response.StatusCode(status),
+		Reason:     reason,
+		Proto:      proto,
+		Headers:    headers.NewHeaders(),
+	}
+	if err := readHeaders(br, res.Headers, &res.SetCookies, &limit); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// readHeaders parses header lines into h up to the blank line that ends
+// them, collecting Set-Cookie values in setCookies if it isn't nil.
+func readHeaders(br *bufio.Reader, h headers.Headers, setCookies *[]string, limit *int) error {
+	for {
+		line, err := readLine(br, limit)
+		if err != nil {
+			return err
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok && setCookies != nil && strings.EqualFold(name, "set-cookie") {
+			*setCookies = append(*setCookies, strings.TrimSpace(value))
+		}
+		n, done, err := h.Parse([]byte(line))
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+		}
+		if n == 0 {
+			return fmt.Errorf("%w: line %q", ErrMalformedResponse, line)
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+func readLine(br *bufio.Reader, limit *int) (string, error) {
+	line, err := br.ReadSlice('\n')
+	*limit -= len(line)
+	switch {
+	case errors.Is(err, bufio.ErrBufferFull) || *limit < 0:
+		return "", fmt.Errorf("%w: header too large", ErrMalformedResponse)
+	case err == io.EOF && len(line) > 0:
+		return "", io.ErrUnexpectedEOF
+	case err != nil:
+		return "", err
+	}
+	return string(line), nil
+}
+
+// frameBody works out where the body ends, per RFC 9112 section 6.3.
+func (res *Response) frameBody(br *bufio.Reader, method string) error {
+	connection := strings.ToLower(res.Headers["connection"])
+	res.close = hasToken(connection, "close") ||
+		res.Proto == "HTTP/1.0" && !hasToken(connection, "keep-alive")
+
+	res.ContentLength = -1
+	if cl := res.Headers["content-length"]; cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%w: content-length %q", ErrMalformedResponse, cl)
+		}
+		res.ContentLength = n
+	}
+
+	code := res.StatusCode
+	te := strings.ToLower(res.Headers["transfer-encoding"])
+	switch {
+	case method == "HEAD" || code < 200 || code == response.StatusNoContent || code == response.StatusNotModified:
+		res.body = eofReader{}
+	case te != "":
+		// Chunked must be the last coding; anything else runs until the
+		// connection closes.
+		res.ContentLength = -1
+		if codings := strings.Split(te, ","); strings.TrimSpace(codings[len(codings)-1]) == "chunked" {
+			res.Trailers = headers.NewHeaders()
+			res.body = &chunkedReader{br: br, trailers: res.Trailers}
+		} else {
+			res.body, res.close = br, true
+		}
+	case res.ContentLength >= 0:
+		res.body = &lengthReader{r: br, n: res.ContentLength}
+	default:
+		res.body, res.close = br, true
+	}
+	return nil
+}
+
+// empty reports whether the body is known to have no bytes, so the
+// connection is free as soon as the headers are read.
+func (res *Response) empty() bool {
+	if _, ok := res.body.(eofReader); ok {
+		return true
+	}
+	lr, ok := res.body.(*lengthReader)
+	return ok && lr.n == 0
+}
+
+func hasToken(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.TrimSpace(v) == token {
+			return true
+		}
+	}
+	return false
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// lengthReader reads a body of n bytes, failing if the connection ends
+// first.
+type lengthReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *lengthReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if err == io.EOF && l.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && l.n == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+type chunkedReader struct {
+	br       *bufio.Reader
+	trailers headers.Headers
+	// n is what is left of the current chunk.
+	n   int64
+	err error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.err == nil {
+		if c.n > 0 {
+			if int64(len(p)) > c.n {
+				p = p[:c.n]
+			}
+			n, err := c.br.Read(p)
+			c.n -= int64(n)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err == nil && c.n == 0 {
+				err = c.readCRLF()
+			}
+			c.err = err
+			return n, nil
+		}
+		c.err = c.nextChunk()
+	}
+	return 0, c.err
+}
+
+func (c *chunkedReader) nextChunk() error {
+	limit := maxHeaderBytes
+	line, err := readLine(c.br, &limit)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	// Chunk extensions are allowed after a semicolon and ignored.
+	size, _, _ := strings.Cut(strings.TrimSuffix(line, "\r\n"), ";")
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("%w: chunk size %q", ErrMalformedResponse, line)
+	}
+	if n == 0 {
+		if err := readHeaders(c.br, c.trailers, nil, &limit); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	c.n = n
+	return nil
+}
+
+func (c *chunkedReader) readCRLF() error {
+	var crlf [2]byte
+	if _, err := io.ReadFull(c.br, crlf[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if string(crlf[:]) != "\r\n" {
+		return fmt.Errorf("%w: chunk not followed by CRLF", ErrMalformedResponse)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package hpack
+
+import (
+	"sort"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+)
+
+// sensitiveHeaders are never indexed: they carry credentials that a
+// compression oracle could otherwise recover.
+var sensitiveHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+}
+
+// FromHeaders converts h into header fields sorted by name, so repeated
+// encodings of the same headers produce the same block.
+func FromHeaders(h headers.Headers) []HeaderField {
+	fields := make([]HeaderField, 0, len(h))
+	for name, value := range h {
+		name = strings.ToLower(name)
+		fields = append(fields, HeaderField{
+			Name:      name,
+			Value:     value,
+			Sensitive: sensitiveHeaders[name],
+		})
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Name < fields[j].Name
+	})
+	return fields
+}
+
+// ToHeaders collects regular fields into Headers, skipping pseudo-header
+// fields. Repeated cookie fields are joined with "; " as HTTP/2 requires;
+// everything else is combined the way headers.Set does.
+func ToHeaders(fields []HeaderField) headers.Headers {
+	h := headers.NewHeaders()
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			continue
+		}
+		if f.Name == "cookie" && h["cookie"] != "" {
+			h.Override("cookie", h["cookie"]+"; "+f.Value)
+			continue
+		}
+		h.Set(f.Name, f.Value)
+	}
+	return h
+}
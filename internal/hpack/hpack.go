@@ -0,0 +1,439 @@
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+const DefaultTableSize = 4096
+
+var (
+	ErrIntegerOverflow = errors.New("hpack: integer overflow")
+	ErrTruncated       = errors.New("hpack: truncated header block")
+	ErrStringLength    = errors.New("hpack: string literal too long")
+)
+
+type HeaderField struct {
+	Name  string
+	Value string
+	// Sensitive fields are encoded as never-indexed literals so that
+	// intermediaries do not add them to their tables either.
+	Sensitive bool
+}
+
+// Size is the entry size defined in RFC 7541 section 4.1.
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+var staticTable = [...]HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+type dynamicTable struct {
+	// entries are stored oldest first; index 1 is the last element.
+	entries []HeaderField
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.Size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	drop := 0
+	for t.size > t.maxSize && drop < len(t.entries) {
+		t.size -= t.entries[drop].Size()
+		drop++
+	}
+	if drop > 0 {
+		t.entries = append(t.entries[:0], t.entries[drop:]...)
+	}
+}
+
+func (t *dynamicTable) get(i int) (HeaderField, bool) {
+	if i < 1 || i > len(t.entries) {
+		return HeaderField{}, false
+	}
+	return t.entries[len(t.entries)-i], true
+}
+
+func appendInt(dst []byte, prefixBits uint8, first byte, v uint64) []byte {
+	limit := uint64(1)<<prefixBits - 1
+	if v < limit {
+		return append(dst, first|byte(v))
+	}
+	dst = append(dst, first|byte(limit))
+	v -= limit
+	for v >= 128 {
+		dst = append(dst, byte(v&0x7f)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func readInt(p []byte, prefixBits uint8) (uint64, []byte, error) {
+	if len(p) == 0 {
+		return 0, nil, ErrTruncated
+	}
+	limit := uint64(1)<<prefixBits - 1
+	v := uint64(p[0]) & limit
+	p = p[1:]
+	if v < limit {
+		return v, p, nil
+	}
+	var shift uint
+	for {
+		if len(p) == 0 {
+			return 0, nil, ErrTruncated
+		}
+		b := p[0]
+		p = p[1:]
+		if shift > 56 {
+			return 0, nil, ErrIntegerOverflow
+		}
+		v += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, p, nil
+		}
+		shift += 7
+	}
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = appendInt(dst, 7, 0, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func readString(p []byte, maxLen int) (string, []byte, error) {
+	if len(p) == 0 {
+		return "", nil, ErrTruncated
+	}
+	huffman := p[0]&0x80 != 0
+	n, p, err := readInt(p, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if n > uint64(len(p)) {
+		return "", nil, ErrTruncated
+	}
+	if maxLen > 0 && n > uint64(maxLen) {
+		return "", nil, ErrStringLength
+	}
+	raw := p[:n]
+	p = p[n:]
+	if !huffman {
+		return string(raw), p, nil
+	}
+	s, err := huffmanDecode(raw, maxLen)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, p, nil
+}
+
+type Decoder struct {
+	table dynamicTable
+	// allowedTableSize is the upper bound advertised to the peer (e.g. via
+	// SETTINGS_HEADER_TABLE_SIZE); size updates above it are errors.
+	allowedTableSize uint32
+	// MaxStringLength bounds any single decoded name or value. Zero means
+	// no limit.
+	MaxStringLength int
+}
+
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{
+		table:            dynamicTable{maxSize: maxTableSize},
+		allowedTableSize: maxTableSize,
+	}
+}
+
+func (d *Decoder) SetAllowedMaxTableSize(n uint32) {
+	d.allowedTableSize = n
+}
+
+func (d *Decoder) DynamicTableSize() uint32 {
+	return d.table.size
+}
+
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	p := block
+	sawField := false
+	for len(p) > 0 {
+		b := p[0]
+		var err error
+		switch {
+		case b&0x80 != 0:
+			var idx uint64
+			idx, p, err = readInt(p, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, ok := d.at(idx)
+			if !ok {
+				return nil, fmt.Errorf("hpack: invalid index %d", idx)
+			}
+			fields = append(fields, f)
+			sawField = true
+		case b&0xc0 == 0x40:
+			var f HeaderField
+			f, p, err = d.readLiteral(p, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+			fields = append(fields, f)
+			sawField = true
+		case b&0xe0 == 0x20:
+			if sawField {
+				return nil, errors.New("hpack: table size update after header field")
+			}
+			var size uint64
+			size, p, err = readInt(p, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedTableSize) {
+				return nil, fmt.Errorf("hpack: table size update %d exceeds limit %d", size, d.allowedTableSize)
+			}
+			d.table.setMaxSize(uint32(size))
+		default:
+			var f HeaderField
+			f, p, err = d.readLiteral(p, 4)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = b&0xf0 == 0x10
+			fields = append(fields, f)
+			sawField = true
+		}
+	}
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(p []byte, prefixBits uint8) (HeaderField, []byte, error) {
+	idx, p, err := readInt(p, prefixBits)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	var f HeaderField
+	if idx == 0 {
+		f.Name, p, err = readString(p, d.MaxStringLength)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+	} else {
+		named, ok := d.at(idx)
+		if !ok {
+			return HeaderField{}, nil, fmt.Errorf("hpack: invalid index %d", idx)
+		}
+		f.Name = named.Name
+	}
+	f.Value, p, err = readString(p, d.MaxStringLength)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+	return f, p, nil
+}
+
+func (d *Decoder) at(idx uint64) (HeaderField, bool) {
+	if idx == 0 {
+		return HeaderField{}, false
+	}
+	if idx <= uint64(len(staticTable)) {
+		return staticTable[idx-1], true
+	}
+	return d.table.get(int(idx) - len(staticTable))
+}
+
+type Encoder struct {
+	table dynamicTable
+	// maxTableSizeLimit is the largest table the peer's decoder accepts.
+	maxTableSizeLimit uint32
+	// pendingMin and pendingUpdate record size changes that must be
+	// signalled at the start of the next header block.
+	pendingMin    uint32
+	pendingUpdate bool
+	// DisableHuffman sends every string literal raw. By default Huffman
+	// coding is used whenever it is not longer.
+	DisableHuffman bool
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{
+		table:             dynamicTable{maxSize: DefaultTableSize},
+		maxTableSizeLimit: DefaultTableSize,
+	}
+}
+
+// SetMaxDynamicTableSizeLimit applies the peer's SETTINGS_HEADER_TABLE_SIZE,
+// shrinking the table if it no longer fits.
+func (e *Encoder) SetMaxDynamicTableSizeLimit(n uint32) {
+	e.maxTableSizeLimit = n
+	if e.table.maxSize > n {
+		e.SetMaxDynamicTableSize(n)
+	}
+}
+
+func (e *Encoder) SetMaxDynamicTableSize(n uint32) {
+	n = min(n, e.maxTableSizeLimit)
+	if !e.pendingUpdate || n < e.pendingMin {
+		e.pendingMin = n
+	}
+	e.pendingUpdate = true
+	e.table.setMaxSize(n)
+}
+
+func (e *Encoder) DynamicTableSize() uint32 {
+	return e.table.size
+}
+
+// Encode appends the representation of fields to dst. Fields are added to
+// the dynamic table unless they are Sensitive, which are sent as
+// never-indexed literals.
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	if e.pendingUpdate {
+		if e.pendingMin < e.table.maxSize {
+			dst = appendInt(dst, 5, 0x20, uint64(e.pendingMin))
+		}
+		dst = appendInt(dst, 5, 0x20, uint64(e.table.maxSize))
+		e.pendingUpdate = false
+	}
+	for _, f := range fields {
+		dst = e.encodeField(dst, f)
+	}
+	return dst
+}
+
+func (e *Encoder) encodeField(dst []byte, f HeaderField) []byte {
+	idx, fullMatch := e.search(f)
+	if fullMatch && !f.Sensitive {
+		return appendInt(dst, 7, 0x80, uint64(idx))
+	}
+
+	switch {
+	case f.Sensitive:
+		dst = appendInt(dst, 4, 0x10, uint64(idx))
+	case f.Size() > e.table.maxSize:
+		dst = appendInt(dst, 4, 0x00, uint64(idx))
+	default:
+		dst = appendInt(dst, 6, 0x40, uint64(idx))
+		e.table.add(HeaderField{Name: f.Name, Value: f.Value})
+	}
+	if idx == 0 {
+		dst = e.appendString(dst, f.Name)
+	}
+	return e.appendString(dst, f.Value)
+}
+
+// search returns the index of a matching entry, preferring a full match
+// and the static table for name-only matches.
+func (e *Encoder) search(f HeaderField) (int, bool) {
+	nameIdx := 0
+	for i, s := range staticTable {
+		if s.Name != f.Name {
+			continue
+		}
+		if s.Value == f.Value {
+			return i + 1, true
+		}
+		if nameIdx == 0 {
+			nameIdx = i + 1
+		}
+	}
+	for i := 1; i <= len(e.table.entries); i++ {
+		d, _ := e.table.get(i)
+		if d.Name != f.Name {
+			continue
+		}
+		if d.Value == f.Value {
+			return len(staticTable) + i, true
+		}
+		if nameIdx == 0 {
+			nameIdx = len(staticTable) + i
+		}
+	}
+	return nameIdx, false
+}
+
+func (e *Encoder) appendString(dst []byte, s string) []byte {
+	if e.DisableHuffman {
+		return appendString(dst, s)
+	}
+	n := huffmanEncodedLen(s)
+	if n > len(s) {
+		return appendString(dst, s)
+	}
+	dst = appendInt(dst, 7, 0x80, uint64(n))
+	return appendHuffman(dst, s)
+}
@@ -0,0 +1,277 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"httpfromtcp/internal/headers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+type exampleBlock struct {
+	wire      string
+	fields    []HeaderField
+	tableSize uint32
+}
+
+func TestIntegerRepresentation(t *testing.T) {
+	// C.1.1: 10 with a 5-bit prefix
+	assert.Equal(t, []byte{0x0a}, appendInt(nil, 5, 0, 10))
+	// C.1.2: 1337 with a 5-bit prefix
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendInt(nil, 5, 0, 1337))
+	// C.1.3: 42 starting at an octet boundary
+	assert.Equal(t, []byte{0x2a}, appendInt(nil, 8, 0, 42))
+
+	v, rest, err := readInt([]byte{0x1f, 0x9a, 0x0a, 0xff}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1337), v)
+	assert.Equal(t, []byte{0xff}, rest)
+
+	_, _, err = readInt([]byte{0x1f, 0x9a}, 5)
+	assert.ErrorIs(t, err, ErrTruncated)
+	_, _, err = readInt([]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 5)
+	assert.ErrorIs(t, err, ErrIntegerOverflow)
+}
+
+func TestSingleFieldExamples(t *testing.T) {
+	// C.2.1: Literal header field with indexing
+	d := NewDecoder(DefaultTableSize)
+	fields, err := d.Decode(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "custom-key", Value: "custom-header"}}, fields)
+	assert.Equal(t, uint32(55), d.DynamicTableSize())
+
+	// C.2.2: Literal header field without indexing
+	d = NewDecoder(DefaultTableSize)
+	fields, err = d.Decode(unhex(t, "040c 2f73 616d 706c 652f 7061 7468"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: ":path", Value: "/sample/path"}}, fields)
+	assert.Equal(t, uint32(0), d.DynamicTableSize())
+
+	// C.2.3: Literal header field never indexed
+	d = NewDecoder(DefaultTableSize)
+	fields, err = d.Decode(unhex(t, "1008 7061 7373 776f 7264 0673 6563 7265 74"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "password", Value: "secret", Sensitive: true}}, fields)
+	assert.Equal(t, uint32(0), d.DynamicTableSize())
+
+	e := NewEncoder()
+	e.DisableHuffman = true
+	assert.Equal(t, unhex(t, "1008 7061 7373 776f 7264 0673 6563 7265 74"),
+		e.Encode(nil, []HeaderField{{Name: "password", Value: "secret", Sensitive: true}}))
+	assert.Equal(t, uint32(0), e.DynamicTableSize())
+
+	// C.2.4: Indexed header field
+	d = NewDecoder(DefaultTableSize)
+	fields, err = d.Decode(unhex(t, "82"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: ":method", Value: "GET"}}, fields)
+}
+
+var requestExamples = [][]HeaderField{
+	{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	},
+	{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "cache-control", Value: "no-cache"},
+	},
+	{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "custom-key", Value: "custom-value"},
+	},
+}
+
+var responseExamples = [][]HeaderField{
+	{
+		{Name: ":status", Value: "302"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	},
+	{
+		{Name: ":status", Value: "307"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	},
+	{
+		{Name: ":status", Value: "200"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:22 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+		{Name: "content-encoding", Value: "gzip"},
+		{Name: "set-cookie", Value: "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+	},
+}
+
+func TestRFCExamples(t *testing.T) {
+	cases := []struct {
+		name      string
+		tableSize uint32
+		huffman   bool
+		blocks    []exampleBlock
+	}{
+		{"C.3 requests without huffman", DefaultTableSize, false, []exampleBlock{
+			{"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", requestExamples[0], 57},
+			{"8286 84be 5808 6e6f 2d63 6163 6865", requestExamples[1], 110},
+			{"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65", requestExamples[2], 164},
+		}},
+		{"C.4 requests with huffman", DefaultTableSize, true, []exampleBlock{
+			{"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff", requestExamples[0], 57},
+			{"8286 84be 5886 a8eb 1064 9cbf", requestExamples[1], 110},
+			{"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf", requestExamples[2], 164},
+		}},
+		{"C.5 responses without huffman", 256, false, []exampleBlock{
+			{"4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d", responseExamples[0], 222},
+			{"4803 3330 37c1 c0bf", responseExamples[1], 222},
+			{"88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d 54c0 5a04 677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e 3d31", responseExamples[2], 215},
+		}},
+		{"C.6 responses with huffman", 256, true, []exampleBlock{
+			{"4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3", responseExamples[0], 222},
+			{"4883 640e ffc1 c0bf", responseExamples[1], 222},
+			{"88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed 4ee5 b106 3d50 07", responseExamples[2], 215},
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewDecoder(tc.tableSize)
+			e := NewEncoder()
+			e.table.setMaxSize(tc.tableSize)
+			e.DisableHuffman = !tc.huffman
+
+			for i, b := range tc.blocks {
+				wire := unhex(t, b.wire)
+
+				fields, err := d.Decode(wire)
+				require.NoError(t, err, "block %d", i)
+				assert.Equal(t, b.fields, fields, "decoded block %d", i)
+				assert.Equal(t, b.tableSize, d.DynamicTableSize(), "decoder table after block %d", i)
+
+				assert.Equal(t, wire, e.Encode(nil, b.fields), "encoded block %d", i)
+				assert.Equal(t, b.tableSize, e.DynamicTableSize(), "encoder table after block %d", i)
+			}
+		})
+	}
+}
+
+func TestDynamicTableSizeUpdate(t *testing.T) {
+	e := NewEncoder()
+	d := NewDecoder(DefaultTableSize)
+
+	fields := []HeaderField{{Name: "custom-key", Value: "custom-value"}}
+	_, err := d.Decode(e.Encode(nil, fields))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(54), d.DynamicTableSize())
+
+	// Test: Shrinking to zero then growing signals both sizes and evicts
+	e.SetMaxDynamicTableSize(0)
+	e.SetMaxDynamicTableSize(100)
+	block := e.Encode(nil, nil)
+	assert.Equal(t, []byte{0x20, 0x3f, 0x45}, block)
+	_, err = d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), d.DynamicTableSize())
+
+	// Test: The peer's limit caps the table
+	e.SetMaxDynamicTableSizeLimit(50)
+	block = e.Encode(nil, fields)
+	assert.Equal(t, byte(0x3f), block[0])
+	assert.Equal(t, uint32(0), e.DynamicTableSize())
+
+	// Test: Updates above the advertised limit are rejected
+	d = NewDecoder(DefaultTableSize)
+	_, err = d.Decode(appendInt(nil, 5, 0x20, DefaultTableSize+1))
+	assert.Error(t, err)
+
+	// Test: Updates after a field are rejected
+	_, err = d.Decode([]byte{0x82, 0x20})
+	assert.Error(t, err)
+}
+
+func TestHuffman(t *testing.T) {
+	for _, s := range []string{"", "www.example.com", "no-cache", "\x00\xff binary \x7f", strings.Repeat("z", 300)} {
+		encoded := appendHuffman(nil, s)
+		assert.Equal(t, huffmanEncodedLen(s), len(encoded))
+		decoded, err := huffmanDecode(encoded, 0)
+		require.NoError(t, err)
+		assert.Equal(t, s, decoded)
+	}
+
+	// Test: Padding longer than 7 bits
+	_, err := huffmanDecode([]byte{0xff, 0xff}, 0)
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+
+	// Test: Padding that is not a prefix of EOS
+	_, err = huffmanDecode([]byte{0x00}, 0)
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+
+	// Test: Explicit EOS symbol
+	_, err = huffmanDecode([]byte{0xff, 0xff, 0xff, 0xff}, 0)
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+}
+
+func TestDecoderLimits(t *testing.T) {
+	d := NewDecoder(DefaultTableSize)
+	d.MaxStringLength = 4
+	_, err := d.Decode(unhex(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572"))
+	assert.ErrorIs(t, err, ErrStringLength)
+
+	_, err = NewDecoder(DefaultTableSize).Decode([]byte{0xbe})
+	assert.Error(t, err)
+	_, err = NewDecoder(DefaultTableSize).Decode([]byte{0x40, 0x0a, 'a'})
+	assert.ErrorIs(t, err, ErrTruncated)
+}
+
+func TestHeadersConversion(t *testing.T) {
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/html")
+	h.Set("authorization", "Bearer secret")
+	h.Set("accept", "*/*")
+
+	fields := FromHeaders(h)
+	assert.Equal(t, []HeaderField{
+		{Name: "accept", Value: "*/*"},
+		{Name: "authorization", Value: "Bearer secret", Sensitive: true},
+		{Name: "content-type", Value: "text/html"},
+	}, fields)
+
+	block := NewEncoder().Encode(nil, fields)
+	decoded, err := NewDecoder(DefaultTableSize).Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+
+	back := ToHeaders(append([]HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "cookie", Value: "a=1"},
+		{Name: "cookie", Value: "b=2"},
+		{Name: "via", Value: "1.1 a"},
+		{Name: "via", Value: "1.1 b"},
+	}, decoded...))
+	assert.Equal(t, "text/html", back["content-type"])
+	assert.Equal(t, "Bearer secret", back["authorization"])
+	assert.Equal(t, "*/*", back["accept"])
+	assert.Equal(t, "a=1; b=2", back["cookie"])
+	assert.Equal(t, "1.1 a, 1.1 b", back["via"])
+	assert.NotContains(t, back, ":status")
+}
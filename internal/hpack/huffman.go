@@ -0,0 +1,100 @@
+package hpack
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidHuffman = errors.New("hpack: invalid huffman-encoded data")
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      int
+}
+
+var (
+	huffmanRootOnce sync.Once
+	huffmanRoot     *huffmanNode
+)
+
+func buildHuffmanTree() {
+	huffmanRoot = &huffmanNode{sym: -1}
+	for sym, e := range huffmanTable {
+		n := huffmanRoot
+		for i := int(e.length) - 1; i >= 0; i-- {
+			bit := (e.code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{sym: -1}
+			}
+			n = n.children[bit]
+		}
+		n.sym = sym
+	}
+}
+
+func huffmanDecode(p []byte, maxLen int) (string, error) {
+	huffmanRootOnce.Do(buildHuffmanTree)
+
+	var sb strings.Builder
+	n := huffmanRoot
+	// pending counts bits consumed since the last complete symbol and
+	// allOnes tracks whether they could be a prefix of EOS (valid padding).
+	pending := 0
+	allOnes := true
+	for _, b := range p {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			n = n.children[bit]
+			if n == nil {
+				return "", ErrInvalidHuffman
+			}
+			pending++
+			allOnes = allOnes && bit == 1
+			if n.sym < 0 {
+				continue
+			}
+			if n.sym == 256 {
+				return "", ErrInvalidHuffman
+			}
+			if maxLen > 0 && sb.Len() >= maxLen {
+				return "", ErrStringLength
+			}
+			sb.WriteByte(byte(n.sym))
+			n = huffmanRoot
+			pending = 0
+			allOnes = true
+		}
+	}
+	if pending > 7 || !allOnes {
+		return "", ErrInvalidHuffman
+	}
+	return sb.String(), nil
+}
+
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanTable[s[i]].length)
+	}
+	return (bits + 7) / 8
+}
+
+func appendHuffman(dst []byte, s string) []byte {
+	var acc uint64
+	var n uint
+	for i := 0; i < len(s); i++ {
+		e := huffmanTable[s[i]]
+		acc = acc<<e.length | uint64(e.code)
+		n += uint(e.length)
+		for n >= 8 {
+			n -= 8
+			dst = append(dst, byte(acc>>n))
+		}
+	}
+	if n > 0 {
+		// Pad with the most significant bits of EOS (all ones).
+		dst = append(dst, byte(acc<<(8-n))|byte(0xff>>n))
+	}
+	return dst
+}
@@ -0,0 +1,195 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	frameHeaderLen     = 9
+	defaultWindowSize  = 65535
+	maxWindowSize      = 1<<31 - 1
+	defaultFrameSize   = 16384
+	maxFrameSizeLimit  = 1<<24 - 1
+	defaultStreamLimit = 250
+)
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+type Setting struct {
+	ID  SettingID
+	Val uint32
+}
+
+type frameHeader struct {
+	length   uint32
+	typ      FrameType
+	flags    uint8
+	streamID uint32
+}
+
+func (h frameHeader) has(flag uint8) bool {
+	return h.flags&flag != 0
+}
+
+type frame struct {
+	frameHeader
+	payload []byte
+}
+
+// connError terminates the connection with a GOAWAY; streamError only
+// resets the one stream.
+type connError struct {
+	code   ErrCode
+	reason string
+}
+
+func (e connError) Error() string {
+	return fmt.Sprintf("http2: connection error %d: %s", e.code, e.reason)
+}
+
+type streamError struct {
+	streamID uint32
+	code     ErrCode
+	reason   string
+}
+
+func (e streamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d: %s", e.streamID, e.code, e.reason)
+}
+
+func readFrame(r *bufio.Reader, maxSize uint32) (*frame, error) {
+	var head [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	f := &frame{frameHeader: frameHeader{
+		length:   uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2]),
+		typ:      FrameType(head[3]),
+		flags:    head[4],
+		streamID: binary.BigEndian.Uint32(head[5:]) & (1<<31 - 1),
+	}}
+	if f.length > maxSize {
+		return nil, connError{ErrCodeFrameSize, fmt.Sprintf("frame of %d bytes exceeds limit", f.length)}
+	}
+	f.payload = make([]byte, f.length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func appendFrameHeader(dst []byte, typ FrameType, flags uint8, streamID uint32, length int) []byte {
+	dst = append(dst, byte(length>>16), byte(length>>8), byte(length), byte(typ), flags)
+	return binary.BigEndian.AppendUint32(dst, streamID&(1<<31-1))
+}
+
+// stripPadding removes the pad length byte and trailing padding from
+// DATA and HEADERS payloads.
+func stripPadding(f *frame) ([]byte, error) {
+	p := f.payload
+	if !f.has(flagPadded) {
+		return p, nil
+	}
+	if len(p) == 0 {
+		return nil, connError{ErrCodeFrameSize, "missing pad length"}
+	}
+	padLen := int(p[0])
+	p = p[1:]
+	if padLen > len(p) {
+		return nil, connError{ErrCodeProtocol, "padding exceeds payload"}
+	}
+	return p[:len(p)-padLen], nil
+}
+
+func parseSettings(p []byte) ([]Setting, error) {
+	if len(p)%6 != 0 {
+		return nil, connError{ErrCodeFrameSize, "settings payload not a multiple of 6"}
+	}
+	settings := make([]Setting, 0, len(p)/6)
+	for i := 0; i < len(p); i += 6 {
+		s := Setting{
+			ID:  SettingID(binary.BigEndian.Uint16(p[i:])),
+			Val: binary.BigEndian.Uint32(p[i+2:]),
+		}
+		switch s.ID {
+		case SettingEnablePush:
+			if s.Val > 1 {
+				return nil, connError{ErrCodeProtocol, "invalid ENABLE_PUSH"}
+			}
+		case SettingInitialWindowSize:
+			if s.Val > maxWindowSize {
+				return nil, connError{ErrCodeFlowControl, "INITIAL_WINDOW_SIZE too large"}
+			}
+		case SettingMaxFrameSize:
+			if s.Val < defaultFrameSize || s.Val > maxFrameSizeLimit {
+				return nil, connError{ErrCodeProtocol, "invalid MAX_FRAME_SIZE"}
+			}
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+func appendSettings(dst []byte, settings ...Setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.ID))
+		dst = binary.BigEndian.AppendUint32(dst, s.Val)
+	}
+	return dst
+}
@@ -0,0 +1,1011 @@
+package http2
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/hpack"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+const (
+	maxHeaderBlockSize  = 1 << 20
+	defaultMaxBodyBytes = 10 << 20
+)
+
+var (
+	ErrBadPreface   = errors.New("http2: invalid client preface")
+	errStreamClosed = errors.New("http2: stream closed")
+	errClientGoAway = errors.New("http2: client sent GOAWAY")
+)
+
+type Server struct {
+	// Handler has the same shape as server.Handler so existing handlers
+	// serve HTTP/2 streams unchanged.
+	Handler              func(w *response.Writer, req *request.Request)
+	MaxConcurrentStreams uint32
+	// MaxBodyBytes limits a request body, which is held in memory until
+	// the handler runs, and defaults to 10 MiB. A longer body is answered
+	// with 413 as soon as it crosses the limit.
+	MaxBodyBytes int64
+	// ReadHeaderTimeout limits how long the client may take to send the
+	// connection preface, and to finish a header block it has started.
+	ReadHeaderTimeout time.Duration
+	// IdleTimeout closes a connection with GOAWAY once it has gone this
+	// long with no open streams and no frames from the client.
+	IdleTimeout time.Duration
+	// Shutdown, when closed, makes every connection send GOAWAY, refuse
+	// new streams and close once the open ones have finished.
+	Shutdown <-chan struct{}
+}
+
+func (s *Server) maxBodyBytes() int64 {
+	if s.MaxBodyBytes > 0 {
+		return s.MaxBodyBytes
+	}
+	return defaultMaxBodyBytes
+}
+
+// IsH2CUpgrade reports whether req asks to switch to cleartext HTTP/2.
+func IsH2CUpgrade(req *request.Request) bool {
+	if req.Headers["http2-settings"] == "" {
+		return false
+	}
+	return headerContainsToken(req.Headers["upgrade"], "h2c") &&
+		headerContainsToken(req.Headers["connection"], "upgrade") &&
+		headerContainsToken(req.Headers["connection"], "http2-settings")
+}
+
+// ServeConn speaks HTTP/2 on conn until the peer goes away. br must hold
+// anything already read from conn. For an h2c upgrade, upgrade is the
+// HTTP/1.1 request (the 101 already sent); it is answered on stream 1.
+func (s *Server) ServeConn(conn net.Conn, br *bufio.Reader, upgrade *request.Request) error {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	maxStreams := s.MaxConcurrentStreams
+	if maxStreams == 0 {
+		maxStreams = defaultStreamLimit
+	}
+	sc := &serverConn{
+		srv:               s,
+		conn:              conn,
+		br:                br,
+		bw:                bufio.NewWriter(conn),
+		enc:               hpack.NewEncoder(),
+		dec:               hpack.NewDecoder(hpack.DefaultTableSize),
+		streams:           map[uint32]*stream{},
+		sendWindow:        defaultWindowSize,
+		recvWindow:        defaultWindowSize,
+		peerInitialWindow: defaultWindowSize,
+		peerMaxFrameSize:  defaultFrameSize,
+		maxStreams:        maxStreams,
+		done:              make(chan struct{}),
+	}
+	sc.dec.MaxStringLength = maxHeaderBlockSize
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		sc.tlsState = &state
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc.serve(upgrade)
+}
+
+type streamState int
+
+const (
+	stateOpen streamState = iota
+	stateHalfClosedRemote
+	stateClosed
+)
+
+type serverConn struct {
+	srv      *Server
+	conn     net.Conn
+	br       *bufio.Reader
+	tlsState *tls.ConnectionState
+
+	writeMu sync.Mutex
+	bw      *bufio.Writer
+	enc     *hpack.Encoder
+
+	dec        *hpack.Decoder
+	continuing *headerBlock
+
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	sendWindow        int64
+	recvWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	lastStreamID      uint32
+	maxStreams        uint32
+	closed            bool
+	goingAway         bool
+	// peerGoneAway is set once the client has sent GOAWAY.
+	peerGoneAway bool
+	// midHeaders is set while the reader waits for the rest of a header
+	// block, which ReadHeaderTimeout bounds rather than IdleTimeout.
+	midHeaders bool
+
+	handlers sync.WaitGroup
+	done     chan struct{}
+}
+
+type headerBlock struct {
+	streamID  uint32
+	block     []byte
+	endStream bool
+	refused   bool
+}
+
+type stream struct {
+	sc            *serverConn
+	id            uint32
+	state         streamState
+	sendWindow    int64
+	recvWindow    int64
+	req           *request.Request
+	contentLength int64
+	wroteHeaders  bool
+	ended         bool
+	reset         bool
+}
+
+func (sc *serverConn) serve(upgrade *request.Request) error {
+	defer sc.shutdown()
+	if sc.srv.Shutdown != nil {
+		go sc.drainOnShutdown()
+	}
+
+	if upgrade != nil {
+		if err := sc.applyUpgradeSettings(upgrade); err != nil {
+			sc.goAway(ErrCodeProtocol)
+			return err
+		}
+	}
+
+	setReadDeadline(sc.conn, sc.srv.ReadHeaderTimeout)
+	settings := appendSettings(nil,
+		Setting{SettingMaxConcurrentStreams, sc.maxStreams},
+		Setting{SettingMaxFrameSize, defaultFrameSize},
+	)
+	if err := sc.writeFrame(FrameSettings, 0, 0, settings); err != nil {
+		return err
+	}
+
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.br, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		sc.goAway(ErrCodeProtocol)
+		return ErrBadPreface
+	}
+
+	first, err := readFrame(sc.br, defaultFrameSize)
+	if err != nil {
+		return err
+	}
+	if first.typ != FrameSettings || first.has(flagAck) {
+		sc.goAway(ErrCodeProtocol)
+		return connError{ErrCodeProtocol, "first frame must be SETTINGS"}
+	}
+	if err := sc.processFrame(first); err != nil {
+		if stop, err := sc.handleError(err); stop {
+			return err
+		}
+	}
+
+	if upgrade != nil {
+		st := sc.newStream(1)
+		st.state = stateHalfClosedRemote
+		st.req = upgrade
+		sc.dispatch(st)
+	}
+
+	for {
+		sc.refreshDeadline()
+		f, err := readFrame(sc.br, defaultFrameSize)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// Idle for too long, or stalled halfway through a header block.
+			sc.goAway(ErrCodeNo)
+			return err
+		}
+		if err == nil {
+			err = sc.processFrame(f)
+		}
+		if err != nil {
+			if stop, err := sc.handleError(err); stop {
+				return err
+			}
+		}
+	}
+}
+
+// refreshDeadline sets the read deadline for the next frame: the rest of
+// a header block gets ReadHeaderTimeout, a connection with no open
+// streams IdleTimeout, and one with open streams waits on them.
+func (sc *serverConn) refreshDeadline() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.midHeaders = sc.continuing != nil
+	if sc.midHeaders {
+		setReadDeadline(sc.conn, sc.srv.ReadHeaderTimeout)
+		return
+	}
+	if len(sc.streams) > 0 {
+		sc.conn.SetReadDeadline(time.Time{})
+		return
+	}
+	setReadDeadline(sc.conn, sc.srv.IdleTimeout)
+}
+
+// startIdleLocked starts IdleTimeout when the last open stream closes,
+// since the reader may be blocked on a frame without a deadline.
+func (sc *serverConn) startIdleLocked() {
+	if len(sc.streams) == 0 && !sc.midHeaders {
+		setReadDeadline(sc.conn, sc.srv.IdleTimeout)
+	}
+}
+
+func setReadDeadline(conn net.Conn, d time.Duration) {
+	if d <= 0 {
+		conn.SetReadDeadline(time.Time{})
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(d))
+}
+
+// handleError resets the stream for stream errors and reports whether
+// the connection must stop for anything else.
+func (sc *serverConn) handleError(err error) (bool, error) {
+	var se streamError
+	if errors.As(err, &se) {
+		sc.resetStream(se.streamID, se.code)
+		return false, nil
+	}
+	var ce connError
+	if errors.As(err, &ce) {
+		sc.goAway(ce.code)
+		return true, err
+	}
+	if errors.Is(err, errClientGoAway) {
+		// Frames still have to be read so that handlers waiting for a
+		// WINDOW_UPDATE can finish; no new streams are accepted.
+		sc.mu.Lock()
+		first := !sc.peerGoneAway
+		sc.peerGoneAway, sc.goingAway = true, true
+		sc.mu.Unlock()
+		if first {
+			go func() {
+				sc.handlers.Wait()
+				sc.conn.Close()
+			}()
+		}
+		return false, nil
+	}
+	if errors.Is(err, io.EOF) {
+		return true, nil
+	}
+	sc.mu.Lock()
+	goneAway := sc.peerGoneAway
+	sc.mu.Unlock()
+	if goneAway {
+		// The connection was closed above once the handlers were done.
+		return true, nil
+	}
+	return true, err
+}
+
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	if !sc.closed {
+		close(sc.done)
+	}
+	sc.closed = true
+	for _, st := range sc.streams {
+		st.reset = true
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+}
+
+// drainOnShutdown waits for the server to shut down, then announces it
+// with GOAWAY and closes the connection once its open streams are done.
+func (sc *serverConn) drainOnShutdown() {
+	select {
+	case <-sc.srv.Shutdown:
+	case <-sc.done:
+		return
+	}
+	sc.mu.Lock()
+	if sc.closed {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goingAway = true
+	sc.mu.Unlock()
+
+	sc.goAway(ErrCodeNo)
+
+	sc.mu.Lock()
+	for len(sc.streams) > 0 && !sc.closed {
+		sc.cond.Wait()
+	}
+	sc.mu.Unlock()
+	sc.handlers.Wait()
+	sc.conn.Close()
+}
+
+func (sc *serverConn) applyUpgradeSettings(req *request.Request) error {
+	raw := strings.TrimRight(req.Headers["http2-settings"], "=")
+	payload, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return connError{ErrCodeProtocol, "invalid HTTP2-Settings header"}
+	}
+	settings, err := parseSettings(payload)
+	if err != nil {
+		return err
+	}
+	return sc.applySettings(settings)
+}
+
+func (sc *serverConn) processFrame(f *frame) error {
+	if sc.continuing != nil && (f.typ != FrameContinuation || f.streamID != sc.continuing.streamID) {
+		return connError{ErrCodeProtocol, "expected CONTINUATION frame"}
+	}
+
+	switch f.typ {
+	case FrameData:
+		return sc.processData(f)
+	case FrameHeaders:
+		return sc.processHeaders(f)
+	case FrameContinuation:
+		if sc.continuing == nil {
+			return connError{ErrCodeProtocol, "unexpected CONTINUATION frame"}
+		}
+		sc.continuing.block = append(sc.continuing.block, f.payload...)
+		if len(sc.continuing.block) > maxHeaderBlockSize {
+			return connError{ErrCodeEnhanceYourCalm, "header block too large"}
+		}
+		if f.has(flagEndHeaders) {
+			return sc.finishHeaders()
+		}
+		return nil
+	case FramePriority:
+		if f.streamID == 0 {
+			return connError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(f.payload) != 5 {
+			return streamError{f.streamID, ErrCodeFrameSize, "PRIORITY payload must be 5 bytes"}
+		}
+		if binary.BigEndian.Uint32(f.payload)&(1<<31-1) == f.streamID {
+			return streamError{f.streamID, ErrCodeProtocol, "stream depends on itself"}
+		}
+		return nil
+	case FrameRSTStream:
+		if f.streamID == 0 {
+			return connError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+		}
+		if len(f.payload) != 4 {
+			return connError{ErrCodeFrameSize, "RST_STREAM payload must be 4 bytes"}
+		}
+		if sc.isIdle(f.streamID) {
+			return connError{ErrCodeProtocol, "RST_STREAM on idle stream"}
+		}
+		sc.mu.Lock()
+		if st := sc.streams[f.streamID]; st != nil {
+			sc.closeStreamLocked(st)
+		}
+		sc.mu.Unlock()
+		return nil
+	case FrameSettings:
+		return sc.processSettings(f)
+	case FramePushPromise:
+		return connError{ErrCodeProtocol, "client sent PUSH_PROMISE"}
+	case FramePing:
+		if f.streamID != 0 {
+			return connError{ErrCodeProtocol, "PING on non-zero stream"}
+		}
+		if len(f.payload) != 8 {
+			return connError{ErrCodeFrameSize, "PING payload must be 8 bytes"}
+		}
+		if f.has(flagAck) {
+			return nil
+		}
+		return sc.writeFrame(FramePing, flagAck, 0, f.payload)
+	case FrameGoAway:
+		if f.streamID != 0 {
+			return connError{ErrCodeProtocol, "GOAWAY on non-zero stream"}
+		}
+		return errClientGoAway
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	}
+	return nil
+}
+
+func (sc *serverConn) isIdle(id uint32) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return id > sc.lastStreamID
+}
+
+func (sc *serverConn) processSettings(f *frame) error {
+	if f.streamID != 0 {
+		return connError{ErrCodeProtocol, "SETTINGS on non-zero stream"}
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return connError{ErrCodeFrameSize, "SETTINGS ack with payload"}
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(FrameSettings, flagAck, 0, nil)
+}
+
+func (sc *serverConn) applySettings(settings []Setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.ID {
+		case SettingInitialWindowSize:
+			delta := int64(s.Val) - sc.peerInitialWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return connError{ErrCodeFlowControl, "stream window overflow"}
+				}
+			}
+			sc.peerInitialWindow = int64(s.Val)
+		case SettingMaxFrameSize:
+			sc.peerMaxFrameSize = s.Val
+		case SettingHeaderTableSize:
+			sc.writeMu.Lock()
+			sc.enc.SetMaxDynamicTableSizeLimit(s.Val)
+			sc.writeMu.Unlock()
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(f *frame) error {
+	if len(f.payload) != 4 {
+		return connError{ErrCodeFrameSize, "WINDOW_UPDATE payload must be 4 bytes"}
+	}
+	inc := int64(binary.BigEndian.Uint32(f.payload) & (1<<31 - 1))
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID == 0 {
+		if inc == 0 {
+			return connError{ErrCodeProtocol, "zero window increment"}
+		}
+		sc.sendWindow += inc
+		if sc.sendWindow > maxWindowSize {
+			return connError{ErrCodeFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	if f.streamID > sc.lastStreamID {
+		return connError{ErrCodeProtocol, "WINDOW_UPDATE on idle stream"}
+	}
+	st := sc.streams[f.streamID]
+	if st == nil {
+		return nil
+	}
+	if inc == 0 {
+		return streamError{f.streamID, ErrCodeProtocol, "zero window increment"}
+	}
+	st.sendWindow += inc
+	if st.sendWindow > maxWindowSize {
+		return streamError{f.streamID, ErrCodeFlowControl, "stream window overflow"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f *frame) error {
+	id := f.streamID
+	if id == 0 || id%2 == 0 {
+		return connError{ErrCodeProtocol, "invalid stream id for HEADERS"}
+	}
+	payload, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	if f.has(flagPriority) {
+		if len(payload) < 5 {
+			return connError{ErrCodeFrameSize, "HEADERS priority truncated"}
+		}
+		if binary.BigEndian.Uint32(payload)&(1<<31-1) == id {
+			return streamError{id, ErrCodeProtocol, "stream depends on itself"}
+		}
+		payload = payload[5:]
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[id]
+	refused := false
+	switch {
+	case st != nil:
+		if st.state != stateOpen {
+			sc.mu.Unlock()
+			return connError{ErrCodeStreamClosed, "HEADERS on half-closed stream"}
+		}
+		if !f.has(flagEndStream) {
+			sc.mu.Unlock()
+			return connError{ErrCodeProtocol, "trailers without END_STREAM"}
+		}
+	case id <= sc.lastStreamID:
+		sc.mu.Unlock()
+		return connError{ErrCodeProtocol, "HEADERS on closed or lower stream id"}
+	default:
+		sc.lastStreamID = id
+		refused = sc.goingAway || uint32(len(sc.streams)) >= sc.maxStreams
+	}
+	sc.mu.Unlock()
+
+	sc.continuing = &headerBlock{
+		streamID:  id,
+		block:     append([]byte(nil), payload...),
+		endStream: f.has(flagEndStream),
+		refused:   refused,
+	}
+	if f.has(flagEndHeaders) {
+		return sc.finishHeaders()
+	}
+	return nil
+}
+
+func (sc *serverConn) finishHeaders() error {
+	hb := sc.continuing
+	sc.continuing = nil
+
+	// Always decode so the HPACK table stays in sync, even for streams we
+	// are about to refuse.
+	fields, err := sc.dec.Decode(hb.block)
+	if err != nil {
+		return connError{ErrCodeCompression, err.Error()}
+	}
+	if hb.refused {
+		return streamError{hb.streamID, ErrCodeRefusedStream, "too many concurrent streams"}
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[hb.streamID]
+	sc.mu.Unlock()
+
+	if st != nil {
+		for _, f := range fields {
+			if strings.HasPrefix(f.Name, ":") {
+				return streamError{st.id, ErrCodeProtocol, "pseudo-header in trailers"}
+			}
+			st.req.Headers.Set(f.Name, f.Value)
+		}
+		return sc.endRequest(st)
+	}
+
+	req, contentLength, err := requestFromFields(fields)
+	if err != nil {
+		return streamError{hb.streamID, ErrCodeProtocol, err.Error()}
+	}
+	req.RemoteAddr = sc.conn.RemoteAddr().String()
+	req.SetTLS(sc.tlsState)
+	st = sc.newStream(hb.streamID)
+	st.req = req
+	st.contentLength = contentLength
+	if contentLength > sc.srv.maxBodyBytes() {
+		return sc.tooLarge(st)
+	}
+	if hb.endStream {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processData(f *frame) error {
+	id := f.streamID
+	if id == 0 {
+		return connError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+
+	sc.mu.Lock()
+	if id > sc.lastStreamID {
+		sc.mu.Unlock()
+		return connError{ErrCodeProtocol, "DATA on idle stream"}
+	}
+	n := int64(len(f.payload))
+	if n > sc.recvWindow {
+		sc.mu.Unlock()
+		return connError{ErrCodeFlowControl, "connection receive window exceeded"}
+	}
+	sc.recvWindow -= n
+	st := sc.streams[id]
+	open := st != nil && st.state == stateOpen
+	sc.mu.Unlock()
+
+	if err := sc.replenish(nil, n); err != nil {
+		return err
+	}
+	if !open {
+		return streamError{id, ErrCodeStreamClosed, "DATA on closed stream"}
+	}
+	if n > st.recvWindow {
+		return streamError{id, ErrCodeFlowControl, "stream receive window exceeded"}
+	}
+	st.recvWindow -= n
+
+	data, err := stripPadding(f)
+	if err != nil {
+		return err
+	}
+	// Window is handed back as data arrives, so the limit is what keeps
+	// a body without a content-length from growing without bound.
+	if int64(len(st.req.Body)+len(data)) > sc.srv.maxBodyBytes() {
+		return sc.tooLarge(st)
+	}
+	st.req.Body = append(st.req.Body, data...)
+	if st.contentLength >= 0 && int64(len(st.req.Body)) > st.contentLength {
+		return streamError{id, ErrCodeProtocol, "body exceeds content-length"}
+	}
+
+	if f.has(flagEndStream) {
+		return sc.endRequest(st)
+	}
+	return sc.replenish(st, n)
+}
+
+// replenish hands consumed receive window back to the peer straight away,
+// since request bodies are buffered in memory, up to MaxBodyBytes, rather
+// than read by the handler. A nil stream means the connection window.
+func (sc *serverConn) replenish(st *stream, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	streamID := uint32(0)
+	if st == nil {
+		sc.mu.Lock()
+		sc.recvWindow += n
+		sc.mu.Unlock()
+	} else {
+		streamID = st.id
+		st.recvWindow += n
+	}
+	return sc.writeFrame(FrameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(n)))
+}
+
+func (sc *serverConn) endRequest(st *stream) error {
+	if st.contentLength >= 0 && int64(len(st.req.Body)) != st.contentLength {
+		return streamError{st.id, ErrCodeProtocol, "body does not match content-length"}
+	}
+	sc.mu.Lock()
+	st.state = stateHalfClosedRemote
+	sc.mu.Unlock()
+	sc.dispatch(st)
+	return nil
+}
+
+// tooLarge answers 413 to a request whose body is over MaxBodyBytes
+// without waiting for the rest, then resets the stream so the client
+// stops sending it.
+func (sc *serverConn) tooLarge(st *stream) error {
+	sc.mu.Lock()
+	sc.closeStreamLocked(st)
+	sc.mu.Unlock()
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(response.StatusContentTooLarge))}}
+	if err := sc.writeHeaderBlock(st.id, fields, true); err != nil {
+		return err
+	}
+	return sc.writeFrame(FrameRSTStream, 0, st.id, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeNo)))
+}
+
+func (sc *serverConn) newStream(id uint32) *stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st := &stream{
+		sc:            sc,
+		id:            id,
+		state:         stateOpen,
+		sendWindow:    sc.peerInitialWindow,
+		recvWindow:    defaultWindowSize,
+		contentLength: -1,
+	}
+	sc.streams[id] = st
+	if id > sc.lastStreamID {
+		sc.lastStreamID = id
+	}
+	return st
+}
+
+func (sc *serverConn) dispatch(st *stream) {
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		defer func() {
+			// A handler that panics can't have finished its response, so
+			// the stream is reset rather than ended.
+			if recover() != nil {
+				sc.resetStream(st.id, ErrCodeInternal)
+				return
+			}
+			st.finish()
+		}()
+		w := response.NewStreamWriter(st)
+		sc.srv.Handler(w, st.req)
+	}()
+}
+
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.mu.Lock()
+	if st := sc.streams[id]; st != nil {
+		sc.closeStreamLocked(st)
+	}
+	sc.mu.Unlock()
+	sc.writeFrame(FrameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+func (sc *serverConn) closeStreamLocked(st *stream) {
+	st.state = stateClosed
+	st.reset = true
+	delete(sc.streams, st.id)
+	sc.startIdleLocked()
+	sc.cond.Broadcast()
+}
+
+func (sc *serverConn) goAway(code ErrCode) {
+	sc.mu.Lock()
+	last := sc.lastStreamID
+	sc.mu.Unlock()
+	payload := binary.BigEndian.AppendUint32(nil, last)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	sc.writeFrame(FrameGoAway, 0, 0, payload)
+}
+
+func (sc *serverConn) writeFrame(typ FrameType, flags uint8, streamID uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	return sc.writeFrameLocked(typ, flags, streamID, payload)
+}
+
+func (sc *serverConn) writeFrameLocked(typ FrameType, flags uint8, streamID uint32, payload []byte) error {
+	buf := appendFrameHeader(nil, typ, flags, streamID, len(payload))
+	if _, err := sc.bw.Write(buf); err != nil {
+		return err
+	}
+	if _, err := sc.bw.Write(payload); err != nil {
+		return err
+	}
+	return sc.bw.Flush()
+}
+
+func (sc *serverConn) writeHeaderBlock(streamID uint32, fields []hpack.HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	maxSize := int(sc.peerMaxFrameSize)
+	sc.mu.Unlock()
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	block := sc.enc.Encode(nil, fields)
+
+	typ := FrameHeaders
+	flags := uint8(0)
+	if endStream {
+		flags |= flagEndStream
+	}
+	for {
+		n := min(len(block), maxSize)
+		if n == len(block) {
+			flags |= flagEndHeaders
+		}
+		if err := sc.writeFrameLocked(typ, flags, streamID, block[:n]); err != nil {
+			return err
+		}
+		block = block[n:]
+		if len(block) == 0 {
+			return nil
+		}
+		typ = FrameContinuation
+		flags = 0
+	}
+}
+
+func (st *stream) WriteHeaders(statusCode response.StatusCode, h headers.Headers) error {
+	if st.isReset() {
+		return errStreamClosed
+	}
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(statusCode))}}
+	fields = append(fields, fieldsFromHeaders(h)...)
+	st.wroteHeaders = true
+	return st.sc.writeHeaderBlock(st.id, fields, false)
+}
+
+func (st *stream) WriteData(p []byte) (int, error) {
+	sc := st.sc
+	written := 0
+	for len(p) > 0 {
+		sc.mu.Lock()
+		for !st.reset && (sc.sendWindow <= 0 || st.sendWindow <= 0) {
+			sc.cond.Wait()
+		}
+		if st.reset {
+			sc.mu.Unlock()
+			return written, errStreamClosed
+		}
+		n := min(int64(len(p)), sc.sendWindow, st.sendWindow, int64(sc.peerMaxFrameSize))
+		sc.sendWindow -= n
+		st.sendWindow -= n
+		sc.mu.Unlock()
+
+		if err := sc.writeFrame(FrameData, 0, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += int(n)
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (st *stream) WriteTrailers(h headers.Headers) error {
+	if st.isReset() {
+		return errStreamClosed
+	}
+	st.ended = true
+	return st.sc.writeHeaderBlock(st.id, fieldsFromHeaders(h), true)
+}
+
+func (st *stream) isReset() bool {
+	st.sc.mu.Lock()
+	defer st.sc.mu.Unlock()
+	return st.reset
+}
+
+// finish ends the stream once the handler returns, whatever it managed
+// to write.
+func (st *stream) finish() {
+	sc := st.sc
+	if !st.isReset() && !st.ended {
+		if !st.wroteHeaders {
+			sc.writeHeaderBlock(st.id, []hpack.HeaderField{{Name: ":status", Value: "200"}}, true)
+		} else {
+			sc.writeFrame(FrameData, flagEndStream, st.id, nil)
+		}
+	}
+	sc.mu.Lock()
+	if sc.streams[st.id] == st {
+		st.state = stateClosed
+		delete(sc.streams, st.id)
+		sc.startIdleLocked()
+		sc.cond.Broadcast()
+	}
+	sc.mu.Unlock()
+}
+
+var connectionSpecific = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+func fieldsFromHeaders(h headers.Headers) []hpack.HeaderField {
+	fields := hpack.FromHeaders(h)
+	n := 0
+	for _, f := range fields {
+		if !connectionSpecific[f.Name] {
+			fields[n] = f
+			n++
+		}
+	}
+	return fields[:n]
+}
+
+func requestFromFields(fields []hpack.HeaderField) (*request.Request, int64, error) {
+	req := &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "2"},
+		Headers:     headers.NewHeaders(),
+	}
+	var scheme, authority string
+	seen := map[string]bool{}
+	regular := false
+	var cookies []string
+
+	for _, f := range fields {
+		if f.Name != strings.ToLower(f.Name) {
+			return nil, 0, errors.New("uppercase header name")
+		}
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return nil, 0, errors.New("pseudo-header after regular header")
+			}
+			if seen[f.Name] {
+				return nil, 0, errors.New("duplicate pseudo-header " + f.Name)
+			}
+			seen[f.Name] = true
+			switch f.Name {
+			case ":method":
+				req.RequestLine.Method = f.Value
+			case ":path":
+				req.RequestLine.RequestTarget = f.Value
+			case ":scheme":
+				scheme = f.Value
+			case ":authority":
+				authority = f.Value
+			default:
+				return nil, 0, errors.New("invalid pseudo-header " + f.Name)
+			}
+			continue
+		}
+		regular = true
+		if connectionSpecific[f.Name] {
+			return nil, 0, errors.New("connection-specific header " + f.Name)
+		}
+		if f.Name == "te" && f.Value != "trailers" {
+			return nil, 0, errors.New("invalid te header")
+		}
+		if f.Name == "cookie" {
+			cookies = append(cookies, f.Value)
+			continue
+		}
+		req.Headers.Set(f.Name, f.Value)
+	}
+
+	if req.RequestLine.Method == "CONNECT" {
+		if authority == "" || scheme != "" || seen[":path"] {
+			return nil, 0, errors.New("malformed CONNECT request")
+		}
+		req.RequestLine.RequestTarget = authority
+	} else if req.RequestLine.Method == "" || scheme == "" || req.RequestLine.RequestTarget == "" {
+		return nil, 0, errors.New("missing required pseudo-header")
+	}
+	if len(cookies) > 0 {
+		req.Headers.Override("cookie", strings.Join(cookies, "; "))
+	}
+	if authority != "" && req.Headers["host"] == "" {
+		req.Headers.Set("host", authority)
+	}
+
+	contentLength := int64(-1)
+	if cl := req.Headers["content-length"]; cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			return nil, 0, errors.New("invalid content-length")
+		}
+		contentLength = n
+	}
+	return req, contentLength, nil
+}
+
+func headerContainsToken(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,549 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/hpack"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+	enc  *hpack.Encoder
+	dec  *hpack.Decoder
+}
+
+type testResponse struct {
+	headers  map[string]string
+	body     string
+	trailers map[string]string
+	reset    ErrCode
+}
+
+func startServer(t *testing.T, s *Server, upgrade *request.Request) net.Conn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s.ServeConn(conn, nil, upgrade)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func newTestClient(t *testing.T, handler func(w *response.Writer, req *request.Request), settings ...Setting) *testClient {
+	t.Helper()
+	conn := startServer(t, &Server{Handler: handler, MaxConcurrentStreams: 4}, nil)
+	c := &testClient{t: t, conn: conn, br: bufio.NewReader(conn), enc: hpack.NewEncoder(), dec: hpack.NewDecoder(hpack.DefaultTableSize)}
+	c.handshake(settings...)
+	return c
+}
+
+func (c *testClient) handshake(settings ...Setting) {
+	c.t.Helper()
+	_, err := c.conn.Write([]byte(ClientPreface))
+	require.NoError(c.t, err)
+	c.writeFrame(FrameSettings, 0, 0, appendSettings(nil, settings...))
+
+	f := c.readFrame()
+	require.Equal(c.t, FrameSettings, f.typ)
+	require.False(c.t, f.has(flagAck))
+	c.writeFrame(FrameSettings, flagAck, 0, nil)
+
+	f = c.readFrame()
+	require.Equal(c.t, FrameSettings, f.typ)
+	require.True(c.t, f.has(flagAck))
+}
+
+func (c *testClient) writeFrame(typ FrameType, flags uint8, streamID uint32, payload []byte) {
+	c.t.Helper()
+	buf := appendFrameHeader(nil, typ, flags, streamID, len(payload))
+	_, err := c.conn.Write(append(buf, payload...))
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) readFrame() *frame {
+	c.t.Helper()
+	f, err := readFrame(c.br, maxFrameSizeLimit)
+	require.NoError(c.t, err)
+	return f
+}
+
+func (c *testClient) writeRequest(streamID uint32, method, path string, endStream bool, extra ...hpack.HeaderField) {
+	c.t.Helper()
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "localhost:42069"},
+	}
+	flags := uint8(flagEndHeaders)
+	if endStream {
+		flags |= flagEndStream
+	}
+	c.writeFrame(FrameHeaders, flags, streamID, c.enc.Encode(nil, append(fields, extra...)))
+}
+
+// readResponses collects frames until every listed stream has ended or
+// been reset, skipping connection-level frames.
+func (c *testClient) readResponses(streamIDs ...uint32) map[uint32]*testResponse {
+	c.t.Helper()
+	responses := map[uint32]*testResponse{}
+	for _, id := range streamIDs {
+		responses[id] = &testResponse{}
+	}
+	pending := len(streamIDs)
+	for pending > 0 {
+		f := c.readFrame()
+		r := responses[f.streamID]
+		switch f.typ {
+		case FrameHeaders:
+			require.NotNil(c.t, r)
+			fields, err := c.dec.Decode(f.payload)
+			require.NoError(c.t, err)
+			m := map[string]string{}
+			for _, field := range fields {
+				m[field.Name] = field.Value
+			}
+			if r.headers == nil {
+				r.headers = m
+			} else {
+				r.trailers = m
+			}
+		case FrameData:
+			require.NotNil(c.t, r)
+			r.body += string(f.payload)
+		case FrameRSTStream:
+			require.NotNil(c.t, r)
+			r.reset = ErrCode(binary.BigEndian.Uint32(f.payload))
+			pending--
+			continue
+		case FrameGoAway:
+			c.t.Fatalf("unexpected GOAWAY with code %d", binary.BigEndian.Uint32(f.payload[4:]))
+		default:
+			continue
+		}
+		if f.has(flagEndStream) {
+			pending--
+		}
+	}
+	return responses
+}
+
+func (c *testClient) expectGoAway(code ErrCode) {
+	c.t.Helper()
+	for {
+		f := c.readFrame()
+		if f.typ == FrameGoAway {
+			assert.Equal(c.t, code, ErrCode(binary.BigEndian.Uint32(f.payload[4:])))
+			return
+		}
+	}
+}
+
+func helloHandler(w *response.Writer, req *request.Request) {
+	body := "hello " + req.RequestLine.Method + " " + req.RequestLine.RequestTarget
+	w.WriteStatusLine(response.StatusOK)
+	h := response.GetDefaultHeaders(len(body))
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
+
+func TestPriorKnowledgeRequest(t *testing.T) {
+	var got *request.Request
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		got = req
+		helloHandler(w, req)
+	})
+
+	c.writeRequest(1, "GET", "/coffee", true,
+		hpack.HeaderField{Name: "user-agent", Value: "test"},
+		hpack.HeaderField{Name: "cookie", Value: "a=1"},
+		hpack.HeaderField{Name: "cookie", Value: "b=2"},
+	)
+	r := c.readResponses(1)[1]
+
+	assert.Equal(t, "200", r.headers[":status"])
+	assert.Equal(t, "text/plain", r.headers["content-type"])
+	assert.NotContains(t, r.headers, "connection")
+	assert.Equal(t, "hello GET /coffee", r.body)
+
+	require.NotNil(t, got)
+	assert.Equal(t, "2", got.RequestLine.HttpVersion)
+	assert.Equal(t, "localhost:42069", got.Headers["host"])
+	assert.Equal(t, "test", got.Headers["user-agent"])
+	assert.Equal(t, "a=1; b=2", got.Headers["cookie"])
+}
+
+func TestRequestBodyAndTrailers(t *testing.T) {
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		h := response.GetDefaultHeaders(0)
+		h.Remove("content-length")
+		h.Set("transfer-encoding", "chunked")
+		h.Set("trailer", "x-body-length")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody(req.Body)
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("x-body-length", fmt.Sprint(len(req.Body)))
+		w.WriteTrailers(trailers)
+	})
+
+	c.writeRequest(1, "POST", "/submit", false, hpack.HeaderField{Name: "content-length", Value: "11"})
+	c.writeFrame(FrameData, 0, 1, []byte("hello "))
+	c.writeFrame(FrameData, flagEndStream|flagPadded, 1, append([]byte{3}, "world\x00\x00\x00"...))
+	r := c.readResponses(1)[1]
+
+	assert.Equal(t, "hello world", r.body)
+	assert.NotContains(t, r.headers, "transfer-encoding")
+	assert.Equal(t, "11", r.trailers["x-body-length"])
+}
+
+func TestMultiplexedStreams(t *testing.T) {
+	release := make(chan struct{})
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		}
+		helloHandler(w, req)
+		if req.RequestLine.RequestTarget == "/fast" {
+			close(release)
+		}
+	})
+
+	c.writeRequest(1, "GET", "/slow", true)
+	c.writeRequest(3, "GET", "/fast", true)
+	responses := c.readResponses(1, 3)
+	assert.Equal(t, "hello GET /slow", responses[1].body)
+	assert.Equal(t, "hello GET /fast", responses[3].body)
+}
+
+func TestFlowControl(t *testing.T) {
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		body := strings.Repeat("x", 25)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}, Setting{SettingInitialWindowSize, 10})
+
+	c.writeRequest(1, "GET", "/", true)
+
+	received := 0
+	for received < 25 {
+		f := c.readFrame()
+		if f.typ != FrameData {
+			continue
+		}
+		assert.LessOrEqual(t, len(f.payload), 10)
+		received += len(f.payload)
+		if received%10 == 0 {
+			// Nothing else may arrive until the window is reopened.
+			c.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, err := c.br.Peek(1)
+			require.Error(t, err)
+			c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			c.writeFrame(FrameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 10))
+		}
+	}
+	assert.Equal(t, 25, received)
+}
+
+func TestPing(t *testing.T) {
+	c := newTestClient(t, helloHandler)
+	c.writeFrame(FramePing, 0, 0, []byte("12345678"))
+	f := c.readFrame()
+	assert.Equal(t, FramePing, f.typ)
+	assert.True(t, f.has(flagAck))
+	assert.Equal(t, "12345678", string(f.payload))
+}
+
+func TestStreamErrors(t *testing.T) {
+	c := newTestClient(t, helloHandler)
+
+	// Test: Uppercase header name
+	c.writeRequest(1, "GET", "/", true, hpack.HeaderField{Name: "User-Agent", Value: "x"})
+	assert.Equal(t, ErrCodeProtocol, c.readResponses(1)[1].reset)
+
+	// Test: Connection-specific header
+	c.writeRequest(3, "GET", "/", true, hpack.HeaderField{Name: "connection", Value: "keep-alive"})
+	assert.Equal(t, ErrCodeProtocol, c.readResponses(3)[3].reset)
+
+	// Test: Content-length mismatch
+	c.writeRequest(5, "POST", "/", false, hpack.HeaderField{Name: "content-length", Value: "3"})
+	c.writeFrame(FrameData, flagEndStream, 5, []byte("toolong"))
+	assert.Equal(t, ErrCodeProtocol, c.readResponses(5)[5].reset)
+
+	// Test: The connection is still usable
+	c.writeRequest(7, "GET", "/after", true)
+	assert.Equal(t, "hello GET /after", c.readResponses(7)[7].body)
+}
+
+func TestConcurrentStreamLimit(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		<-block
+	})
+	for id := uint32(1); id <= 7; id += 2 {
+		c.writeRequest(id, "GET", "/", true)
+	}
+	c.writeRequest(9, "GET", "/", true)
+	assert.Equal(t, ErrCodeRefusedStream, c.readResponses(9)[9].reset)
+}
+
+func TestConnectionErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		send func(c *testClient)
+		code ErrCode
+	}{
+		{"DATA on stream 0", func(c *testClient) { c.writeFrame(FrameData, 0, 0, []byte("x")) }, ErrCodeProtocol},
+		{"even stream id", func(c *testClient) { c.writeRequest(2, "GET", "/", true) }, ErrCodeProtocol},
+		{"bad ping length", func(c *testClient) { c.writeFrame(FramePing, 0, 0, []byte("1234")) }, ErrCodeFrameSize},
+		{"zero connection window increment", func(c *testClient) {
+			c.writeFrame(FrameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, 0))
+		}, ErrCodeProtocol},
+		{"connection window overflow", func(c *testClient) {
+			c.writeFrame(FrameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, maxWindowSize))
+		}, ErrCodeFlowControl},
+		{"interrupted header block", func(c *testClient) {
+			c.writeFrame(FrameHeaders, 0, 1, c.enc.Encode(nil, []hpack.HeaderField{{Name: ":method", Value: "GET"}}))
+			c.writeFrame(FramePing, 0, 0, []byte("12345678"))
+		}, ErrCodeProtocol},
+		{"invalid hpack", func(c *testClient) { c.writeFrame(FrameHeaders, flagEndHeaders, 1, []byte{0xff}) }, ErrCodeCompression},
+		{"push promise", func(c *testClient) { c.writeFrame(FramePushPromise, flagEndHeaders, 1, []byte{0, 0, 0, 2}) }, ErrCodeProtocol},
+		{"invalid max frame size", func(c *testClient) {
+			c.writeFrame(FrameSettings, 0, 0, appendSettings(nil, Setting{SettingMaxFrameSize, 100}))
+		}, ErrCodeProtocol},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient(t, helloHandler)
+			tc.send(c)
+			c.expectGoAway(tc.code)
+		})
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	settings := base64.RawURLEncoding.EncodeToString(appendSettings(nil, Setting{SettingInitialWindowSize, 1 << 20}))
+	upgrade := &request.Request{
+		RequestLine: request.RequestLine{HttpVersion: "1.1", Method: "GET", RequestTarget: "/upgraded"},
+		Headers: map[string]string{
+			"host":           "localhost:42069",
+			"connection":     "Upgrade, HTTP2-Settings",
+			"upgrade":        "h2c",
+			"http2-settings": settings,
+		},
+	}
+	require.True(t, IsH2CUpgrade(upgrade))
+
+	conn := startServer(t, &Server{Handler: helloHandler}, upgrade)
+	c := &testClient{t: t, conn: conn, br: bufio.NewReader(conn), enc: hpack.NewEncoder(), dec: hpack.NewDecoder(hpack.DefaultTableSize)}
+	c.handshake()
+
+	r := c.readResponses(1)[1]
+	assert.Equal(t, "200", r.headers[":status"])
+	assert.Equal(t, "hello GET /upgraded", r.body)
+
+	c.writeRequest(3, "GET", "/next", true)
+	assert.Equal(t, "hello GET /next", c.readResponses(3)[3].body)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	shutdown := make(chan struct{})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	conn := startServer(t, &Server{
+		Handler: func(w *response.Writer, req *request.Request) {
+			close(started)
+			<-release
+			helloHandler(w, req)
+		},
+		Shutdown: shutdown,
+	}, nil)
+	c := &testClient{t: t, conn: conn, br: bufio.NewReader(conn), enc: hpack.NewEncoder(), dec: hpack.NewDecoder(hpack.DefaultTableSize)}
+	c.handshake()
+
+	c.writeRequest(1, "GET", "/slow", true)
+	<-started
+	close(shutdown)
+
+	// Test: Shutdown is announced with GOAWAY NO_ERROR naming the last stream
+	f := c.readFrame()
+	require.Equal(t, FrameGoAway, f.typ)
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(f.payload))
+	assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(f.payload[4:])))
+
+	// Test: New streams are refused while draining
+	c.writeRequest(3, "GET", "/late", true)
+	assert.Equal(t, ErrCodeRefusedStream, c.readResponses(3)[3].reset)
+
+	// Test: In-flight streams complete before the connection closes
+	close(release)
+	assert.Equal(t, "hello GET /slow", c.readResponses(1)[1].body)
+	_, err := readFrame(c.br, maxFrameSizeLimit)
+	assert.Error(t, err)
+}
+
+func TestTimeouts(t *testing.T) {
+	newClient := func(s *Server) *testClient {
+		conn := startServer(t, s, nil)
+		c := &testClient{t: t, conn: conn, br: bufio.NewReader(conn), enc: hpack.NewEncoder(), dec: hpack.NewDecoder(hpack.DefaultTableSize)}
+		c.handshake()
+		return c
+	}
+	slow := func(w *response.Writer, req *request.Request) {
+		time.Sleep(200 * time.Millisecond)
+		helloHandler(w, req)
+	}
+
+	// Test: A stream outlasting IdleTimeout isn't cut off, and the
+	// connection closes with GOAWAY once it has been idle that long
+	c := newClient(&Server{Handler: slow, IdleTimeout: 100 * time.Millisecond})
+	c.writeRequest(1, "GET", "/slow", true)
+	assert.Equal(t, "hello GET /slow", c.readResponses(1)[1].body)
+	start := time.Now()
+	c.expectGoAway(ErrCodeNo)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	_, err := readFrame(c.br, maxFrameSizeLimit)
+	assert.Error(t, err)
+
+	// Test: Frames keep an idle connection open
+	c = newClient(&Server{Handler: helloHandler, IdleTimeout: 150 * time.Millisecond})
+	for range 3 {
+		time.Sleep(75 * time.Millisecond)
+		c.writeFrame(FramePing, 0, 0, make([]byte, 8))
+		f := c.readFrame()
+		require.Equal(t, FramePing, f.typ)
+	}
+	c.writeRequest(1, "GET", "/", true)
+	assert.Equal(t, "hello GET /", c.readResponses(1)[1].body)
+
+	// Test: A header block left unfinished runs into ReadHeaderTimeout
+	c = newClient(&Server{Handler: helloHandler, ReadHeaderTimeout: 100 * time.Millisecond})
+	c.writeFrame(FrameHeaders, flagEndStream, 1, c.enc.Encode(nil, []hpack.HeaderField{{Name: ":method", Value: "GET"}}))
+	c.expectGoAway(ErrCodeNo)
+
+	// Test: So does a client that never sends the preface
+	conn := startServer(t, &Server{Handler: helloHandler, ReadHeaderTimeout: 100 * time.Millisecond}, nil)
+	br := bufio.NewReader(conn)
+	f, err := readFrame(br, maxFrameSizeLimit)
+	require.NoError(t, err)
+	assert.Equal(t, FrameSettings, f.typ)
+	_, err = readFrame(br, maxFrameSizeLimit)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHandlerPanic(t *testing.T) {
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/panic" {
+			w.WriteStatusLine(response.StatusOK)
+			w.WriteHeaders(response.GetDefaultHeaders(10))
+			panic("boom")
+		}
+		helloHandler(w, req)
+	})
+
+	// Test: A panicking handler resets its stream
+	c.writeRequest(1, "GET", "/panic", true)
+	r := c.readResponses(1)[1]
+	assert.Equal(t, "200", r.headers[":status"])
+	assert.Equal(t, ErrCodeInternal, r.reset)
+
+	// Test: Other streams on the connection are unaffected
+	c.writeRequest(3, "GET", "/fine", true)
+	assert.Equal(t, "hello GET /fine", c.readResponses(3)[3].body)
+}
+
+func TestClientGoAwayWhileStalled(t *testing.T) {
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		body := strings.Repeat("x", 20)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}, Setting{SettingInitialWindowSize, 10})
+
+	c.writeRequest(1, "GET", "/", true)
+	received := 0
+	for received < 10 {
+		if f := c.readFrame(); f.typ == FrameData {
+			received += len(f.payload)
+		}
+	}
+
+	// Test: After the client's GOAWAY, frames are still read so a handler
+	// stalled on a zero window can finish once it is reopened
+	c.writeFrame(FrameGoAway, 0, 0, binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 0), uint32(ErrCodeNo)))
+	c.writeRequest(3, "GET", "/late", true)
+	assert.Equal(t, ErrCodeRefusedStream, c.readResponses(3)[3].reset)
+	c.writeFrame(FrameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 10))
+	assert.Equal(t, strings.Repeat("x", 10), c.readResponses(1)[1].body)
+
+	// Test: The connection closes once the handlers are done
+	_, err := readFrame(c.br, maxFrameSizeLimit)
+	assert.Error(t, err)
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	var calls atomic.Int32
+	conn := startServer(t, &Server{MaxBodyBytes: 10, Handler: func(w *response.Writer, req *request.Request) {
+		calls.Add(1)
+		helloHandler(w, req)
+	}}, nil)
+	c := &testClient{t: t, conn: conn, br: bufio.NewReader(conn), enc: hpack.NewEncoder(), dec: hpack.NewDecoder(hpack.DefaultTableSize)}
+	c.handshake()
+	expectRefused := func(id uint32) {
+		t.Helper()
+		r := c.readResponses(id)[id]
+		assert.Equal(t, "413", r.headers[":status"])
+		f := c.readFrame()
+		require.Equal(t, FrameRSTStream, f.typ)
+		assert.Equal(t, id, f.streamID)
+		assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(f.payload)))
+	}
+
+	// Test: A body without a content-length is cut off with a 413 once it
+	// crosses the limit, before it is complete
+	c.writeRequest(1, "POST", "/upload", false)
+	c.writeFrame(FrameData, 0, 1, []byte("12345678"))
+	c.writeFrame(FrameData, 0, 1, []byte("12345678"))
+	expectRefused(1)
+
+	// Test: A content-length over the limit is refused straight away
+	c.writeRequest(3, "POST", "/upload", false, hpack.HeaderField{Name: "content-length", Value: "11"})
+	expectRefused(3)
+
+	// Test: A body within the limit reaches the handler
+	c.writeRequest(5, "POST", "/upload", false)
+	c.writeFrame(FrameData, flagEndStream, 5, []byte("1234567890"))
+	r := c.readResponses(5)[5]
+	assert.Equal(t, "200", r.headers[":status"])
+	assert.Equal(t, int32(1), calls.Load())
+}
@@ -0,0 +1,200 @@
+// Package metrics keeps counters, gauges and histograms and exposes them
+// in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets suit latencies in seconds, from 5ms to 10s.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ExponentialBuckets returns count upper bounds, the first being start and
+// each following one factor times the last.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+// family is a metric name with one series per set of label values.
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       atomicFloat
+	// Histograms only. counts[i] is the number of observations in bucket
+	// i, not cumulative; the last entry is +Inf.
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.RLock()
+	s, ok := f.series[key]
+	f.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.series[key]; ok {
+		return s
+	}
+	s = &series{labelValues: slices.Clone(values)}
+	if f.kind == kindHistogram {
+		s.counts = make([]uint64, len(f.buckets)+1)
+	}
+	f.series[key] = s
+	return s
+}
+
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (a *atomicFloat) add(v float64) {
+	for {
+		old := a.bits.Load()
+		if a.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (a *atomicFloat) set(v float64) {
+	a.bits.Store(math.Float64bits(v))
+}
+
+func (a *atomicFloat) load() float64 {
+	return math.Float64frombits(a.bits.Load())
+}
+
+// Counter only goes up.
+type Counter struct {
+	s *series
+}
+
+func (c *Counter) Inc() {
+	c.s.value.add(1)
+}
+
+// Add panics if v is negative.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.s.value.add(v)
+}
+
+func (c *Counter) Value() float64 {
+	return c.s.value.load()
+}
+
+// Gauge can go up and down.
+type Gauge struct {
+	s *series
+}
+
+func (g *Gauge) Set(v float64) {
+	g.s.value.set(v)
+}
+
+func (g *Gauge) Add(v float64) {
+	g.s.value.add(v)
+}
+
+func (g *Gauge) Inc() {
+	g.s.value.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.s.value.add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.s.value.load()
+}
+
+// Histogram counts observations into buckets by upper bound.
+type Histogram struct {
+	f *family
+	s *series
+}
+
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.f.buckets, v)
+	h.s.mu.Lock()
+	h.s.counts[i]++
+	h.s.sum += v
+	h.s.mu.Unlock()
+}
+
+// Count returns how many values have been observed.
+func (h *Histogram) Count() uint64 {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	var n uint64
+	for _, c := range h.s.counts {
+		n += c
+	}
+	return n
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	f *family
+}
+
+// With returns the counter for the label values, in the order the labels
+// were registered.
+func (v *CounterVec) With(values ...string) *Counter {
+	return &Counter{v.f.with(values)}
+}
+
+type GaugeVec struct {
+	f *family
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{v.f.with(values)}
+}
+
+type HistogramVec struct {
+	f *family
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{v.f, v.f.with(values)}
+}
@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func text(t *testing.T, r *Registry) string {
+	t.Helper()
+	var b strings.Builder
+	require.NoError(t, r.WriteText(&b))
+	return b.String()
+}
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	up := r.NewCounter("jobs_total", "Jobs run.")
+	temp := r.NewGauge("temperature_celsius", "")
+	requests := r.NewCounterVec("requests_total", "Requests by code.", "method", "code")
+	latency := r.NewHistogramVec("latency_seconds", "Line one\nback\\slash.", []float64{0.1, 1}, "path")
+
+	up.Inc()
+	up.Add(2.5)
+	temp.Set(21)
+	temp.Dec()
+	requests.With("POST", "500").Inc()
+	requests.With("GET", "200").Add(3)
+	latency.With(`/a"b`).Observe(0.05)
+	latency.With(`/a"b`).Observe(0.1)
+	latency.With(`/a"b`).Observe(0.5)
+	latency.With(`/a"b`).Observe(7)
+
+	// Test: Families come out in registration order with series sorted by labels
+	want := `# HELP jobs_total Jobs run.
+# TYPE jobs_total counter
+jobs_total 3.5
+# TYPE temperature_celsius gauge
+temperature_celsius 20
+# HELP requests_total Requests by code.
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 3
+requests_total{method="POST",code="500"} 1
+# HELP latency_seconds Line one\nback\\slash.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/a\"b",le="0.1"} 2
+latency_seconds_bucket{path="/a\"b",le="1"} 3
+latency_seconds_bucket{path="/a\"b",le="+Inf"} 4
+latency_seconds_sum{path="/a\"b"} 7.65
+latency_seconds_count{path="/a\"b"} 4
+`
+	assert.Equal(t, want, text(t, r))
+	assert.Equal(t, uint64(4), latency.With(`/a"b`).Count())
+
+	// Test: The handler serves the same text with the exposition content type
+	var buf bytes.Buffer
+	r.ServeRequest(response.New(&buf), &request.Request{})
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"), buf.String())
+	assert.Contains(t, buf.String(), "content-type: "+ContentType+"\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"+want))
+}
+
+func TestRegistrationErrors(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("ok_total", "")
+
+	// Test: Duplicate and invalid names panic
+	assert.Panics(t, func() { r.NewGauge("ok_total", "") })
+	assert.Panics(t, func() { r.NewCounter("bad-name", "") })
+	assert.Panics(t, func() { r.NewCounterVec("x_total", "", "bad-label") })
+	assert.Panics(t, func() { r.NewHistogramVec("h", "", nil, "le") })
+	assert.Panics(t, func() { r.NewHistogram("unsorted", "", []float64{2, 1}) })
+
+	// Test: Wrong number of label values and negative counter increments panic
+	v := r.NewCounterVec("labelled_total", "", "a", "b")
+	assert.Panics(t, func() { v.With("only-one") })
+	assert.Panics(t, func() { v.With("1", "2").Add(-1) })
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("hits_total", "", "worker")
+	h := r.NewHistogram("sizes", "", ExponentialBuckets(1, 10, 3))
+	assert.Equal(t, []float64{1, 10, 100}, ExponentialBuckets(1, 10, 3))
+
+	// Test: Updates from many goroutines are all counted
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				c.With("shared").Inc()
+				h.Observe(5)
+				text(t, r)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 8000.0, c.With("shared").Value())
+	assert.Contains(t, text(t, r), "sizes_bucket{le=\"10\"} 8000\n")
+}
@@ -0,0 +1,207 @@
+package request
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+)
+
+var (
+	// ErrInvalidFraming means the headers don't say unambiguously where
+	// the body ends.
+	ErrInvalidFraming = errors.New("invalid message framing")
+	// ErrUnsupportedTransferCoding is a Transfer-Encoding other than
+	// chunked, which the server answers with 501.
+	ErrUnsupportedTransferCoding = errors.New("unsupported transfer coding")
+)
+
+// maxTrailerBytes bounds the trailer section after the last chunk.
+const maxTrailerBytes = 64 << 10
+
+// checkFraming enforces RFC 9112 section 6.3: Content-Length has to be a
+// single number, and Transfer-Encoding, which can only be chunked, can't
+// come with one. Anything else lets two parsers disagree on where the
+// request ends, which is how requests get smuggled past a proxy.
+func (r *Request) checkFraming() error {
+	te, chunked := r.Headers["transfer-encoding"]
+	cl, hasLength := r.Headers["content-length"]
+	switch {
+	case chunked && hasLength:
+		return fmt.Errorf("%w: transfer-encoding with content-length", ErrInvalidFraming)
+	case chunked && !strings.EqualFold(strings.TrimSpace(te), "chunked"):
+		return fmt.Errorf("%w: %q", ErrUnsupportedTransferCoding, te)
+	case hasLength:
+		if _, ok := parseLength(cl); !ok {
+			return fmt.Errorf("%w: content-length %q", ErrInvalidFraming, cl)
+		}
+	}
+	return nil
+}
+
+// parseLength accepts only digits, so a repeated Content-Length, which
+// arrives joined as "5, 5", is refused along with signs and spaces.
+func parseLength(value string) (int64, bool) {
+	if value == "" || strings.Trim(value, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	return n, err == nil
+}
+
+// bodyReader reads the body that follows the headers in br, taking off
+// any chunked framing. Trailer fields are added to r.Headers once the
+// last chunk has been read.
+func (r *Request) bodyReader(br *bufio.Reader) io.Reader {
+	if _, ok := r.Headers["transfer-encoding"]; ok {
+		return &chunkedReader{br: br, trailers: r.Headers}
+	}
+	n, _ := parseLength(r.Headers["content-length"])
+	return &lengthReader{r: br, n: n}
+}
+
+// lengthReader reads a body of n bytes, failing if the connection ends
+// first.
+type lengthReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *lengthReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if err == io.EOF && l.n > 0 {
+		err = fmt.Errorf("body shorter than content-length: %w", io.ErrUnexpectedEOF)
+	}
+	if err == nil && l.n == 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+type chunkedReader struct {
+	br       *bufio.Reader
+	trailers headers.Headers
+	// n is what is left of the current chunk.
+	n   int64
+	err error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.err == nil {
+		if c.n > 0 {
+			if int64(len(p)) > c.n {
+				p = p[:c.n]
+			}
+			n, err := c.br.Read(p)
+			c.n -= int64(n)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err == nil && c.n == 0 {
+				err = c.readCRLF()
+			}
+			c.err = err
+			return n, nil
+		}
+		c.err = c.nextChunk()
+	}
+	return 0, c.err
+}
+
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	// Chunk extensions are allowed after a semicolon and ignored.
+	size, _, _ := strings.Cut(line, ";")
+	size = strings.TrimRight(size, " \t")
+	if size == "" || strings.Trim(strings.ToLower(size), "0123456789abcdef") != "" {
+		return fmt.Errorf("%w: chunk size %q", ErrInvalidFraming, line)
+	}
+	n, err := strconv.ParseInt(size, 16, 64)
+	if err != nil {
+		return fmt.Errorf("%w: chunk size %q", ErrInvalidFraming, line)
+	}
+	if n == 0 {
+		if err := c.readTrailers(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	c.n = n
+	return nil
+}
+
+// readTrailers adds the fields after the last chunk to the headers.
+func (c *chunkedReader) readTrailers() error {
+	trailers := headers.NewHeaders()
+	read := 0
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if read += len(line); read > maxTrailerBytes {
+			return fmt.Errorf("%w: trailers exceed %d bytes", ErrHeaderTooLarge, maxTrailerBytes)
+		}
+		if line == "" {
+			break
+		}
+		if _, _, err := trailers.Parse([]byte(line + crlf)); err != nil {
+			return err
+		}
+	}
+	for key, value := range trailers {
+		// Fields that frame or route the message can't arrive late.
+		switch key {
+		case "content-length", "transfer-encoding", "host", "trailer":
+		default:
+			c.trailers.Set(key, value)
+		}
+	}
+	return nil
+}
+
+// readLine reads a CRLF-terminated line, without the CRLF.
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.br.ReadSlice('\n')
+	switch {
+	case errors.Is(err, bufio.ErrBufferFull):
+		return "", fmt.Errorf("%w: chunk line exceeds %d bytes", ErrHeaderTooLarge, c.br.Size())
+	case err == io.EOF:
+		return "", io.ErrUnexpectedEOF
+	case err != nil:
+		return "", err
+	}
+	s, ok := strings.CutSuffix(string(line), crlf)
+	if !ok {
+		return "", fmt.Errorf("%w: line not ended by CRLF", ErrInvalidFraming)
+	}
+	return s, nil
+}
+
+func (c *chunkedReader) readCRLF() error {
+	var end [2]byte
+	if _, err := io.ReadFull(c.br, end[:]); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if string(end[:]) != crlf {
+		return fmt.Errorf("%w: chunk not followed by CRLF", ErrInvalidFraming)
+	}
+	return nil
+}
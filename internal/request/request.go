@@ -1,11 +1,13 @@
 package request
 
 import (
-	"bytes"
+	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -23,7 +25,19 @@ type Request struct {
 	RequestLine RequestLine
 	Headers     headers.Headers
 	Body        []byte
-	state       parserState
+	// BodyReader, when set, streams a body that was left unread, and Body
+	// is empty. Write sends it as it is read.
+	BodyReader io.Reader
+	Params     map[string]string
+	// Pattern is the route pattern that matched the request, if any.
+	Pattern string
+	// RemoteAddr is the network address of the client, set by the server.
+	RemoteAddr string
+	// TLS is nil unless the request arrived over TLS.
+	TLS *tls.ConnectionState
+	// Peer is the verified client certificate identity, if any.
+	Peer  *PeerIdentity
+	state parserState
 }
 
 type RequestLine struct {
@@ -34,89 +48,148 @@ type RequestLine struct {
 
 const crlf = "\r\n"
 
+var ErrHeaderTooLarge = errors.New("request line or header too large")
+
+// Path returns the request target without its query string. For an
+// absolute-form target, as sent to a proxy, that is the path of the URL.
+func (r *Request) Path() string {
+	target := r.RequestLine.RequestTarget
+	if r.IsAbsoluteForm() {
+		_, rest, _ := strings.Cut(target, "://")
+		i := strings.IndexAny(rest, "/?#")
+		if i < 0 || rest[i] != '/' {
+			return "/"
+		}
+		target = rest[i:]
+	}
+	path, _, _ := strings.Cut(target, "?")
+	return path
+}
+
+// IsAbsoluteForm reports whether the request target is a whole URL, the
+// form clients use to ask a forward proxy for another host.
+func (r *Request) IsAbsoluteForm() bool {
+	return isAbsoluteURL(r.RequestLine.RequestTarget)
+}
+
+// PathValue returns the value captured for a named segment of the route
+// pattern that matched the request, or an empty string.
+func (r *Request) PathValue(name string) string {
+	return r.Params[name]
+}
+
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	br, ok := reader.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(reader)
+	}
+
+	request, err := HeadersFromReader(br)
+	if err != nil {
+		return request, err
+	}
+	if err := request.ReadBody(br); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// HeadersFromReader parses the request line and headers, leaving the
+// body in br for ReadBody. Splitting the two lets the server give each
+// its own deadline.
+func HeadersFromReader(br *bufio.Reader) (*Request, error) {
 	request := &Request{
 		Headers: headers.NewHeaders(),
 		state:   Initialized,
 	}
+	if err := request.readUntil(br, ParsingBody); err != nil {
+		return request, err
+	}
+	return request, nil
+}
 
-	buffer := make([]byte, 8)
-	readToIndex := 0
-	for request.state == Initialized {
-		if readToIndex >= len(buffer) {
-			newBuffer := make([]byte, len(buffer)*2)
-			copy(newBuffer, buffer)
-			buffer = newBuffer
-		}
-
-		bytesRead, err := reader.Read(buffer[readToIndex:])
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				request.state = Done
-				break
-			}
-			return nil, err
-		}
-		readToIndex += bytesRead
-
-		bytesParsed, err := request.parse(buffer[:readToIndex])
-		if err != nil {
-			return request, err
-		}
-
-		copy(buffer, buffer[bytesParsed:readToIndex])
-		readToIndex -= bytesParsed
+// ReadBody reads the body announced by the headers from br, which must be
+// the reader the headers came from, decoding it if it is chunked.
+func (r *Request) ReadBody(br *bufio.Reader) error {
+	if r.state != ParsingBody {
+		return fmt.Errorf("reading body before the headers are done")
+	}
+	body, err := io.ReadAll(r.bodyReader(br))
+	if err != nil {
+		return err
 	}
+	if len(body) > 0 {
+		r.Body = body
+	}
+	r.state = Done
+	return nil
+}
 
-	idx := bytes.LastIndex(buffer, []byte(crlf))
-	if idx != -1 {
-		buffer = buffer[idx+2:]
-	} else {
-		buffer = make([]byte, 8)
+// StreamBody leaves the body announced by the headers in br and sets
+// BodyReader to read it, decoding it if it is chunked. The caller has to
+// read it to the end before reading the next request from br.
+func (r *Request) StreamBody(br *bufio.Reader) error {
+	if r.state != ParsingBody {
+		return fmt.Errorf("streaming body before the headers are done")
 	}
-	for request.state != Done {
-		if readToIndex >= len(buffer) {
-			newBuffer := make([]byte, len(buffer)*2)
-			copy(newBuffer, buffer)
-			buffer = newBuffer
-		}
+	r.BodyReader = r.bodyReader(br)
+	r.state = Done
+	return nil
+}
 
-		bytesRead, err := reader.Read(buffer[readToIndex:])
+func (r *Request) readUntil(br *bufio.Reader, stop parserState) error {
+	// Start with whatever is buffered so a request without a body never
+	// blocks on the connection.
+	want := 0
+	for r.state < stop {
+		want = max(want, br.Buffered())
+		data, readErr := br.Peek(want)
+		bytesParsed, err := r.parse(data, stop)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				request.state = Done
-				contentLengthHeader := request.Headers["content-length"]
-				if contentLengthHeader == "" {
-					break
-				}
-				contentLength, err := strconv.Atoi(contentLengthHeader)
-				if err != nil {
-					return nil, err
-				}
-				if len(request.Body) < contentLength {
-					return nil, fmt.Errorf("body shorter than content-length")
-				}
-				break
-			}
-			return nil, err
+			return err
 		}
-		readToIndex += bytesRead
-
-		bytesParsed, err := request.parse(buffer[:readToIndex])
-		if err != nil {
-			return request, err
+		br.Discard(bytesParsed)
+		if bytesParsed > 0 {
+			want = 1
+		} else {
+			want = len(data) + 1
+		}
+		if readErr == nil || r.state >= stop {
+			continue
 		}
 
-		copy(buffer, buffer[bytesParsed:readToIndex])
-		readToIndex -= bytesParsed
+		if errors.Is(readErr, bufio.ErrBufferFull) {
+			return fmt.Errorf("%w: exceeds %d bytes", ErrHeaderTooLarge, br.Size())
+		}
+		if !errors.Is(readErr, io.EOF) {
+			return readErr
+		}
+		if err := r.finish(len(data) - bytesParsed); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return request, nil
+func (r *Request) finish(unparsed int) error {
+	switch r.state {
+	case Initialized:
+		if unparsed == 0 {
+			return io.EOF
+		}
+		return io.ErrUnexpectedEOF
+	case ParsingHeaders:
+		if err := r.checkFraming(); err != nil {
+			return err
+		}
+	}
+	r.state = ParsingBody
+	return nil
 }
 
-func (r *Request) parse(data []byte) (int, error) {
+func (r *Request) parse(data []byte, stop parserState) (int, error) {
 	totalBytesParsed := 0
-	for r.state != Done {
+	for r.state < stop {
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
 			return totalBytesParsed, err
@@ -145,28 +218,14 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return n, err
 		}
 		if done {
+			if err := r.checkFraming(); err != nil {
+				return n, err
+			}
 			r.state = ParsingBody
 		}
 		return n, nil
-	case ParsingBody:
-		if r.Headers["content-length"] == "" {
-			r.state = Done
-			return 0, nil
-		}
-		r.Body = append(r.Body, data...)
-		contentLength, err := strconv.Atoi(r.Headers["content-length"])
-		if err != nil {
-			return 0, err
-		}
-		if len(r.Body) > contentLength {
-			return len(data), fmt.Errorf("body is longer than content-length")
-		}
-		if len(r.Body) == contentLength {
-			r.state = Done
-		}
-		return len(data), nil
-	case Done:
-		return 0, fmt.Errorf("trying to read data in a done state")
+	case ParsingBody, Done:
+		return 0, fmt.Errorf("trying to parse headers after they are done")
 	default:
 		return 0, fmt.Errorf("unknown state")
 	}
@@ -197,6 +256,10 @@ func parseRequestLine(message string) (*RequestLine, int, error) {
 		return nil, 0, errors.New("Request not supported")
 	}
 
+	if !validTarget(parts[0], parts[1]) {
+		return nil, 0, errors.New("Request target has the wrong form for the method")
+	}
+
 	httpVersion := strings.Split(parts[2], "/")[1]
 
 	return &RequestLine{
@@ -205,3 +268,37 @@ func parseRequestLine(message string) (*RequestLine, int, error) {
 		Method:        parts[0],
 	}, crlfIdx + 2, nil
 }
+
+// validTarget checks the target against the four forms of RFC 9112
+// section 3.2: a path, a whole URL, host:port for CONNECT and "*" for
+// OPTIONS.
+func validTarget(method, target string) bool {
+	switch {
+	case method == "CONNECT":
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" {
+			return false
+		}
+		n, err := strconv.Atoi(port)
+		return err == nil && n > 0 && n <= 65535
+	case target == "*":
+		return method == "OPTIONS"
+	}
+	return strings.HasPrefix(target, "/") || isAbsoluteURL(target)
+}
+
+// isAbsoluteURL reports whether target starts with a scheme and an
+// authority.
+func isAbsoluteURL(target string) bool {
+	scheme, rest, ok := strings.Cut(target, "://")
+	if !ok || scheme == "" || rest == "" || rest[0] == '/' {
+		return false
+	}
+	for i, c := range scheme {
+		letter := 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+		if !letter && (i == 0 || !('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.')) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,7 +1,13 @@
 package request
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"io"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -70,6 +76,42 @@ func TestRequestLineParse(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestRequestTargetForms(t *testing.T) {
+	parse := func(line string) (*Request, error) {
+		return RequestFromReader(strings.NewReader(line + " HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	}
+
+	// Test: Absolute-form targets are accepted and Path gives their path
+	for target, path := range map[string]string{
+		"http://example.com/a/b?x=1": "/a/b",
+		"https://example.com:8443/":  "/",
+		"http://example.com":         "/",
+		"http://example.com?x=1":     "/",
+	} {
+		r, err := parse("GET " + target)
+		require.NoError(t, err, target)
+		assert.True(t, r.IsAbsoluteForm(), target)
+		assert.Equal(t, path, r.Path(), target)
+	}
+
+	// Test: CONNECT takes host:port and "*" is only for OPTIONS
+	r, err := parse("CONNECT example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:443", r.RequestLine.RequestTarget)
+	assert.False(t, r.IsAbsoluteForm())
+	_, err = parse("OPTIONS *")
+	require.NoError(t, err)
+
+	// Test: Targets in the wrong form for their method are refused
+	for _, line := range []string{
+		"CONNECT /", "CONNECT example.com", "CONNECT example.com:http", "CONNECT :443",
+		"GET *", "GET example.com:443", "GET coffee", "GET 1http://example.com/", "GET http:///path",
+	} {
+		_, err := parse(line)
+		assert.Error(t, err, line)
+	}
+}
+
 func TestHeadersParse(t *testing.T) {
 	// Test: Standard Headers
 	reader := &chunkReader{
@@ -199,6 +241,90 @@ func TestBodyParse(t *testing.T) {
 	assert.Equal(t, "", string(r.Body))
 }
 
+func TestChunkedBodyParse(t *testing.T) {
+	// Test: Chunks are joined, extensions ignored and trailers added
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5;name=value\r\nhello\r\n" +
+			"7\r\n, world\r\n" +
+			"0\r\n" +
+			"Checksum: abc\r\n" +
+			"Content-Length: 99\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", string(r.Body))
+	assert.Equal(t, "abc", r.Headers["checksum"])
+	assert.NotContains(t, r.Headers, "content-length")
+
+	// Test: Malformed or truncated chunks are errors
+	for _, chunks := range []string{
+		"5\r\nhello\r\n",
+		"5\r\nhelloXX0\r\n\r\n",
+		"+5\r\nhello\r\n0\r\n\r\n",
+		"zz\r\n",
+		"5\nhello\r\n0\r\n\r\n",
+	} {
+		_, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + chunks))
+		assert.Error(t, err, "%q", chunks)
+	}
+}
+
+func TestBodyFraming(t *testing.T) {
+	parse := func(fields string) error {
+		_, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\n" + fields + "\r\n"))
+		return err
+	}
+
+	// Test: Transfer-Encoding and Content-Length together are refused
+	assert.ErrorIs(t, parse("Transfer-Encoding: chunked\r\nContent-Length: 5\r\n"), ErrInvalidFraming)
+
+	// Test: Repeated, conflicting or signed lengths are refused
+	for _, fields := range []string{
+		"Content-Length: 5\r\nContent-Length: 5\r\n",
+		"Content-Length: 5\r\nContent-Length: 6\r\n",
+		"Content-Length: +5\r\n",
+		"Content-Length: -1\r\n",
+		"Content-Length: \r\n",
+	} {
+		assert.ErrorIs(t, parse(fields), ErrInvalidFraming, fields)
+	}
+
+	// Test: Transfer codings other than chunked are not implemented
+	assert.ErrorIs(t, parse("Transfer-Encoding: gzip, chunked\r\n"), ErrUnsupportedTransferCoding)
+}
+
+func TestPipelinedParse(t *testing.T) {
+	// Test: Bytes after a request are left in the reader
+	reader := bufio.NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /next HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/submit", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+	assert.Equal(t, "localhost:42069", r.Headers["host"])
+
+	// Test: Clean EOF before a new request
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, io.EOF)
+}
+
 type chunkReader struct {
 	data            string
 	numBytesPerRead int
@@ -221,3 +347,79 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	}
 	return n, nil
 }
+
+func TestSetTLS(t *testing.T) {
+	spiffe, err := url.Parse("spiffe://example.org/billing")
+	require.NoError(t, err)
+	leaf := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "billing", Organization: []string{"Example"}},
+		DNSNames: []string{"billing.internal"},
+		URIs:     []*url.URL{spiffe},
+	}
+	root := &x509.Certificate{Subject: pkix.Name{CommonName: "Root CA"}}
+	r := &Request{}
+
+	// Test: A verified chain becomes the peer identity
+	r.SetTLS(&tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf, root}}})
+	require.NotNil(t, r.TLS)
+	require.NotNil(t, r.Peer)
+	assert.Equal(t, "billing", r.Peer.Subject.CommonName)
+	assert.Equal(t, []string{"Example"}, r.Peer.Subject.Organization)
+	assert.Equal(t, []string{"billing.internal"}, r.Peer.DNSNames)
+	assert.Equal(t, "spiffe://example.org/billing", r.Peer.URIs[0].String())
+	assert.Equal(t, []*x509.Certificate{leaf, root}, r.Peer.Chain)
+
+	// Test: Unverified certificates are not an identity
+	r.SetTLS(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}})
+	assert.NotNil(t, r.TLS)
+	assert.Nil(t, r.Peer)
+
+	// Test: Plain connections clear both
+	r.SetTLS(nil)
+	assert.Nil(t, r.TLS)
+	assert.Nil(t, r.Peer)
+}
+
+func TestWrite(t *testing.T) {
+	// Test: A written request reads back the same
+	r := &Request{
+		RequestLine: RequestLine{Method: "POST", RequestTarget: "/submit?x=1"},
+		Headers:     map[string]string{"x-b": "2", "host": "example.com", "accept": "*/*"},
+		Body:        []byte("hello"),
+	}
+	var buf strings.Builder
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "POST /submit?x=1 HTTP/1.1\r\nhost: example.com\r\naccept: */*\r\nx-b: 2\r\ncontent-length: 5\r\n\r\nhello", buf.String())
+	back, err := RequestFromReader(strings.NewReader(buf.String()))
+	require.NoError(t, err)
+	assert.Equal(t, r.RequestLine.RequestTarget, back.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(back.Body))
+
+	// Test: Line breaks in a value are refused rather than sent
+	r.Headers["x-b"] = "2\r\nx-injected: yes"
+	assert.ErrorIs(t, r.Write(io.Discard), ErrInvalidRequest)
+	r.Headers["x-b"] = "2"
+	r.RequestLine.RequestTarget = "/a b"
+	assert.ErrorIs(t, r.Write(io.Discard), ErrInvalidRequest)
+
+	// Test: A streamed body without a length goes out chunked, and one
+	// with a length has to match it
+	r = &Request{
+		RequestLine: RequestLine{Method: "PUT", RequestTarget: "/upload"},
+		Headers:     map[string]string{},
+		BodyReader:  strings.NewReader("streamed"),
+	}
+	buf.Reset()
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "PUT /upload HTTP/1.1\r\ntransfer-encoding: chunked\r\n\r\n8\r\nstreamed\r\n0\r\n\r\n", buf.String())
+	back, err = RequestFromReader(strings.NewReader(buf.String()))
+	require.NoError(t, err)
+	assert.Equal(t, "streamed", string(back.Body))
+	r.Headers["content-length"] = "8"
+	r.BodyReader = strings.NewReader("streamed")
+	buf.Reset()
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, "PUT /upload HTTP/1.1\r\ncontent-length: 8\r\n\r\nstreamed", buf.String())
+	r.BodyReader = strings.NewReader("short")
+	assert.ErrorIs(t, r.Write(io.Discard), io.ErrUnexpectedEOF)
+}
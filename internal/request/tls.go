@@ -0,0 +1,43 @@
+package request
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+)
+
+// PeerIdentity describes a client certificate that was verified during
+// the TLS handshake.
+type PeerIdentity struct {
+	// Chain runs from the client's certificate up to a trusted root.
+	Chain   []*x509.Certificate
+	Subject pkix.Name
+	// Subject alternative names of the client's certificate.
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+}
+
+// SetTLS records the state of the TLS connection a request arrived on.
+// Peer is only set when the client presented a certificate that verified
+// against the server's CA pool.
+func (r *Request) SetTLS(state *tls.ConnectionState) {
+	r.TLS = state
+	r.Peer = nil
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return
+	}
+	chain := state.VerifiedChains[0]
+	leaf := chain[0]
+	r.Peer = &PeerIdentity{
+		Chain:          chain,
+		Subject:        leaf.Subject,
+		DNSNames:       leaf.DNSNames,
+		EmailAddresses: leaf.EmailAddresses,
+		IPAddresses:    leaf.IPAddresses,
+		URIs:           leaf.URIs,
+	}
+}
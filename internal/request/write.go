@@ -0,0 +1,109 @@
+package request
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidRequest = errors.New("invalid request")
+
+// Write sends r in wire format: the request line, the headers with Host
+// first, and the body. A body without a content-length gets one, so the
+// request can be read back by RequestFromReader; a BodyReader without
+// one is sent chunked.
+func (r *Request) Write(w io.Writer) error {
+	method, target := r.RequestLine.Method, r.RequestLine.RequestTarget
+	if method == "" || strings.ContainsAny(method, " \r\n") || target == "" || strings.ContainsAny(target, " \r\n") {
+		return ErrInvalidRequest
+	}
+	version := r.RequestLine.HttpVersion
+	if version == "" {
+		version = "1.1"
+	}
+
+	keys := make([]string, 0, len(r.Headers))
+	for key, value := range r.Headers {
+		// A line break would let a value smuggle in headers of its own.
+		if strings.ContainsAny(key, " :\r\n") || strings.ContainsAny(value, "\r\n") {
+			return ErrInvalidRequest
+		}
+		if key != "host" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if _, ok := r.Headers["host"]; ok {
+		keys = append([]string{"host"}, keys...)
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(method + " " + target + " HTTP/" + version + crlf)
+	for _, key := range keys {
+		bw.WriteString(key + ": " + r.Headers[key] + crlf)
+	}
+	framed := r.Headers["content-length"] != "" || r.Headers["transfer-encoding"] != ""
+	switch {
+	case r.BodyReader != nil && !framed:
+		bw.WriteString("transfer-encoding: chunked" + crlf)
+	case len(r.Body) > 0 && !framed:
+		bw.WriteString("content-length: " + strconv.Itoa(len(r.Body)) + crlf)
+	}
+	bw.WriteString(crlf)
+	if r.BodyReader != nil {
+		return r.writeStream(bw)
+	}
+	bw.Write(r.Body)
+	return bw.Flush()
+}
+
+// writeStream copies BodyReader to bw as it arrives: as is when the
+// headers give a content-length, which it has to match, and as chunks
+// otherwise.
+func (r *Request) writeStream(bw *bufio.Writer) error {
+	body, left := r.BodyReader, int64(-1)
+	chunked := r.Headers["content-length"] == ""
+	if !chunked {
+		n, ok := parseLength(r.Headers["content-length"])
+		if !ok {
+			return ErrInvalidRequest
+		}
+		body, left = io.LimitReader(body, n), n
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if chunked {
+				bw.WriteString(strconv.FormatInt(int64(n), 16) + crlf)
+			}
+			bw.Write(buf[:n])
+			if chunked {
+				bw.WriteString(crlf)
+			}
+			left -= int64(n)
+			// Flush as it goes, so the body moves at the pace it arrives.
+			if ferr := bw.Flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !chunked {
+		if left > 0 {
+			return fmt.Errorf("body shorter than content-length: %w", io.ErrUnexpectedEOF)
+		}
+		return nil
+	}
+	bw.WriteString("0" + crlf + crlf)
+	return bw.Flush()
+}
@@ -1,21 +1,104 @@
 package response
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
+	"log"
+	"net"
 	"strconv"
+	"strings"
 )
 
 type StatusCode int
 
 const (
+	StatusSwitchingProtocols  StatusCode = 101
 	StatusOK                  StatusCode = 200
+	StatusNoContent           StatusCode = 204
+	StatusMovedPermanently    StatusCode = 301
+	StatusFound               StatusCode = 302
+	StatusSeeOther            StatusCode = 303
+	StatusNotModified         StatusCode = 304
+	StatusTemporaryRedirect   StatusCode = 307
+	StatusPermanentRedirect   StatusCode = 308
 	StatusBadRequest          StatusCode = 400
+	StatusForbidden           StatusCode = 403
+	StatusNotFound            StatusCode = 404
+	StatusMethodNotAllowed    StatusCode = 405
+	StatusProxyAuthRequired   StatusCode = 407
+	StatusRequestTimeout      StatusCode = 408
+	StatusContentTooLarge     StatusCode = 413
+	StatusUpgradeRequired     StatusCode = 426
 	StatusInternalServerError StatusCode = 500
+	StatusBadGateway          StatusCode = 502
+	StatusServiceUnavailable  StatusCode = 503
+	StatusNotImplemented      StatusCode = 501
+	StatusGatewayTimeout      StatusCode = 504
 )
 
+var statusText = map[StatusCode]string{
+	StatusSwitchingProtocols:  "Switching Protocols",
+	StatusOK:                  "OK",
+	StatusNoContent:           "No Content",
+	StatusMovedPermanently:    "Moved Permanently",
+	StatusFound:               "Found",
+	StatusSeeOther:            "See Other",
+	StatusNotModified:         "Not Modified",
+	StatusTemporaryRedirect:   "Temporary Redirect",
+	StatusPermanentRedirect:   "Permanent Redirect",
+	StatusBadRequest:          "Bad Request",
+	StatusForbidden:           "Forbidden",
+	StatusNotFound:            "Not Found",
+	StatusMethodNotAllowed:    "Method Not Allowed",
+	StatusProxyAuthRequired:   "Proxy Authentication Required",
+	StatusRequestTimeout:      "Request Timeout",
+	StatusContentTooLarge:     "Content Too Large",
+	StatusUpgradeRequired:     "Upgrade Required",
+	StatusInternalServerError: "Internal Server Error",
+	StatusNotImplemented:      "Not Implemented",
+	StatusBadGateway:          "Bad Gateway",
+	StatusServiceUnavailable:  "Service Unavailable",
+	StatusGatewayTimeout:      "Gateway Timeout",
+
+	// Codes a proxied upstream may answer with.
+	100: "Continue",
+	201: "Created",
+	202: "Accepted",
+	203: "Non-Authoritative Information",
+	205: "Reset Content",
+	206: "Partial Content",
+	300: "Multiple Choices",
+	401: "Unauthorized",
+	402: "Payment Required",
+	406: "Not Acceptable",
+	409: "Conflict",
+	410: "Gone",
+	411: "Length Required",
+	412: "Precondition Failed",
+	414: "URI Too Long",
+	415: "Unsupported Media Type",
+	416: "Range Not Satisfiable",
+	417: "Expectation Failed",
+	418: "I'm a teapot",
+	421: "Misdirected Request",
+	422: "Unprocessable Content",
+	425: "Too Early",
+	428: "Precondition Required",
+	429: "Too Many Requests",
+	431: "Request Header Fields Too Large",
+	451: "Unavailable For Legal Reasons",
+	505: "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase for a status code, or an empty
+// string if the code is unknown.
+func StatusText(code StatusCode) string {
+	return statusText[code]
+}
+
 type WriterStatus int
 
 const (
@@ -25,9 +108,44 @@ const (
 	done
 )
 
+var (
+	ErrHijacked      = errors.New("connection has been hijacked")
+	ErrNotHijackable = errors.New("connection does not support hijacking")
+)
+
+// Hijacker hands over the underlying connection together with a reader
+// holding any bytes the server has already buffered from it.
+type Hijacker func() (net.Conn, *bufio.ReadWriter, error)
+
+// Stream carries a response over a protocol that frames messages itself
+// (HTTP/2). The Writer passes the status and header fields through and
+// leaves connection-level framing such as chunked encoding to the stream.
+type Stream interface {
+	WriteHeaders(statusCode StatusCode, h headers.Headers) error
+	WriteData(p []byte) (int, error)
+	WriteTrailers(h headers.Headers) error
+}
+
+// Hooks let a wrapping Writer watch a response on its way through.
+// WriteHeaders may modify h before it is passed on.
+type Hooks struct {
+	WriteHeaders func(statusCode StatusCode, h headers.Headers)
+	Write        func(p []byte)
+}
+
 type Writer struct {
-	writer      io.Writer
-	writerState WriterStatus
+	writer       io.Writer
+	writerState  WriterStatus
+	hijacker     Hijacker
+	hijacked     bool
+	stream       Stream
+	parent       *Writer
+	hooks        Hooks
+	statusCode   StatusCode
+	headers      headers.Headers
+	bytesWritten int64
+	wroteTrailer bool
+	errorLog     *log.Logger
 }
 
 func New(w io.Writer) *Writer {
@@ -37,34 +155,107 @@ func New(w io.Writer) *Writer {
 	}
 }
 
+func NewStreamWriter(s Stream) *Writer {
+	return &Writer{
+		stream:      s,
+		writerState: pendingStatusLine,
+	}
+}
+
+func NewHijackable(w io.Writer, hijacker Hijacker) *Writer {
+	writer := New(w)
+	writer.hijacker = hijacker
+	return writer
+}
+
+// Wrap returns a Writer that forwards everything to w, calling hooks
+// first. Middleware hands it to the next handler to see what is written
+// without the handler knowing.
+func Wrap(w *Writer, hooks Hooks) *Writer {
+	return &Writer{
+		parent:      w,
+		hooks:       hooks,
+		writerState: pendingStatusLine,
+	}
+}
+
+// StatusCode returns the status written so far, or 0.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// Headers returns the headers as they were written, or nil.
+func (w *Writer) Headers() headers.Headers {
+	return w.headers
+}
+
+// BytesWritten counts body bytes, excluding chunked framing.
+func (w *Writer) BytesWritten() int64 {
+	return w.bytesWritten
+}
+
+// Hijack takes the connection over from the server, which will neither
+// close nor reuse it afterwards. Anything already written through the
+// Writer (e.g. a 101 response) has been sent by the time it returns.
+func (w *Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	hijacker := w.hijacker
+	if w.parent != nil {
+		hijacker = w.parent.Hijack
+	}
+	if hijacker == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	conn, rw, err := hijacker()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return conn, rw, nil
+}
+
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+// SetErrorLog records where errors met while serving the response should
+// be logged. The server sets its own logger before calling the handler.
+func (w *Writer) SetErrorLog(l *log.Logger) {
+	w.errorLog = l
+}
+
+// ErrorLog returns the logger set on w or on the Writer it wraps, or nil.
+func (w *Writer) ErrorLog() *log.Logger {
+	if w.errorLog == nil && w.parent != nil {
+		return w.parent.ErrorLog()
+	}
+	return w.errorLog
+}
+
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
 	if w.writerState != pendingStatusLine {
 		return errors.New("status line already written")
 	}
-	switch statusCode {
-	case StatusOK:
-		_, err := w.writer.Write([]byte("HTTP/1.1 200 OK"))
-		if err != nil {
-			return err
-		}
-	case StatusBadRequest:
-		_, err := w.writer.Write([]byte("HTTP/1.1 400 Bad Request"))
-		if err != nil {
-			return err
-		}
-	case StatusInternalServerError:
-		_, err := w.writer.Write([]byte("HTTP/1.1 500 Internal Server Error"))
-		if err != nil {
-			return err
-		}
-	default:
-		status := strconv.Itoa(int(statusCode))
-		_, err := w.writer.Write([]byte("HTTP/1.1 " + status + " "))
-		if err != nil {
+	if w.parent != nil {
+		if err := w.parent.WriteStatusLine(statusCode); err != nil {
 			return err
 		}
+		w.statusCode = statusCode
+		w.writerState = pendingHeaders
+		return nil
 	}
-	_, err := w.writer.Write([]byte("\r\n"))
+	w.statusCode = statusCode
+	if w.stream != nil {
+		w.writerState = pendingHeaders
+		return nil
+	}
+	line := "HTTP/1.1 " + strconv.Itoa(int(statusCode)) + " " + StatusText(statusCode) + "\r\n"
+	_, err := io.WriteString(w.writer, line)
 	if err != nil {
 		return err
 	}
@@ -82,40 +273,138 @@ func GetDefaultHeaders(contentLen int) headers.Headers {
 }
 
 func (w *Writer) WriteHeaders(headers headers.Headers) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
 	if w.writerState != pendingHeaders {
 		return errors.New("headers already written or not ready yet")
 	}
-	for key, value := range headers {
-		_, err := w.writer.Write([]byte(key + ": " + value + "\r\n"))
+	if w.hooks.WriteHeaders != nil {
+		w.hooks.WriteHeaders(w.statusCode, headers)
+	}
+	switch {
+	case w.parent != nil:
+		if err := w.parent.WriteHeaders(headers); err != nil {
+			return err
+		}
+	case w.stream != nil:
+		if err := w.stream.WriteHeaders(w.statusCode, headers); err != nil {
+			return err
+		}
+	default:
+		for key, value := range headers {
+			_, err := w.writer.Write([]byte(key + ": " + value + "\r\n"))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := w.writer.Write([]byte("\r\n"))
 		if err != nil {
 			return err
 		}
 	}
-	_, err := w.writer.Write([]byte("\r\n"))
-	if err != nil {
-		return err
-	}
 
+	w.headers = headers
 	w.writerState = pendingBody
 	return nil
 }
 
 func (w *Writer) WriteBody(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
 	if w.writerState != pendingBody {
 		return 0, errors.New("body already written or not ready yet")
 	}
-	n, err := w.writer.Write(p)
+	if w.parent != nil {
+		w.observe(p)
+		n, err := w.parent.WriteBody(p)
+		w.bytesWritten += int64(n)
+		if err != nil {
+			return n, err
+		}
+		w.writerState = done
+		return n, nil
+	}
+	n, err := w.write(p)
 	if err != nil {
 		return 0, err
 	}
+	w.bytesWritten += int64(n)
 	w.writerState = done
 	return n, nil
 }
 
+// WriteBodyFrom copies the body from r until EOF, so large bodies never
+// have to be held in memory. r must yield exactly the content-length
+// announced in the headers.
+func (w *Writer) WriteBodyFrom(r io.Reader) (int64, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
+	if w.writerState != pendingBody {
+		return 0, errors.New("body already written or not ready yet")
+	}
+	if w.parent != nil {
+		if w.hooks.Write != nil {
+			r = io.TeeReader(r, observer(w.hooks.Write))
+		}
+		n, err := w.parent.WriteBodyFrom(r)
+		w.bytesWritten += n
+		if err != nil {
+			return n, err
+		}
+		w.writerState = done
+		return n, nil
+	}
+	var n int64
+	var err error
+	if w.stream != nil {
+		n, err = io.Copy(streamData{w.stream}, r)
+	} else {
+		n, err = io.Copy(w.writer, r)
+	}
+	w.bytesWritten += n
+	if err != nil {
+		return n, err
+	}
+	w.writerState = done
+	return n, nil
+}
+
+type observer func(p []byte)
+
+func (o observer) Write(p []byte) (int, error) {
+	o(p)
+	return len(p), nil
+}
+
+type streamData struct {
+	s Stream
+}
+
+func (sd streamData) Write(p []byte) (int, error) {
+	return sd.s.WriteData(p)
+}
+
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
 	if w.writerState != pendingBody {
 		return 0, errors.New("body already written or not ready yet")
 	}
+	if w.parent != nil {
+		w.observe(p)
+		n, err := w.parent.WriteChunkedBody(p)
+		w.bytesWritten += int64(n)
+		return n, err
+	}
+	if w.stream != nil {
+		n, err := w.stream.WriteData(p)
+		w.bytesWritten += int64(n)
+		return n, err
+	}
 	_, err := io.WriteString(w.writer, fmt.Sprintf("%x\r\n", len(p)))
 	if err != nil {
 		return 0, err
@@ -124,6 +413,7 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	w.bytesWritten += int64(n)
 	_, err = io.WriteString(w.writer, "\r\n")
 	if err != nil {
 		return 0, err
@@ -132,9 +422,24 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
 	if w.writerState != pendingBody {
 		return 0, errors.New("body already written or not ready yet")
 	}
+	if w.parent != nil {
+		n, err := w.parent.WriteChunkedBodyDone()
+		if err != nil {
+			return n, err
+		}
+		w.writerState = done
+		return n, nil
+	}
+	if w.stream != nil {
+		w.writerState = done
+		return 0, nil
+	}
 	n, err := io.WriteString(w.writer, "0\r\n")
 	if err != nil {
 		return 0, err
@@ -144,9 +449,19 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 }
 
 func (w *Writer) WriteTrailers(h headers.Headers) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
 	if w.writerState != done {
 		return errors.New("trailers not ready yet")
 	}
+	if w.parent != nil {
+		return w.parent.WriteTrailers(h)
+	}
+	if w.stream != nil {
+		return w.stream.WriteTrailers(h)
+	}
+	w.wroteTrailer = true
 	for key, value := range h {
 		_, err := w.writer.Write([]byte(key + ": " + value + "\r\n"))
 		if err != nil {
@@ -160,3 +475,51 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 
 	return nil
 }
+
+// Finish terminates a chunked body the handler left open and reports
+// whether the response was framed completely, i.e. whether the connection
+// can carry another response after it. A response to HEAD has no body
+// whatever its headers say, so head makes one that sent none complete.
+func (w *Writer) Finish(head bool) bool {
+	if w.hijacked || w.stream != nil || w.parent != nil {
+		return false
+	}
+	chunked := w.headers != nil && strings.Contains(strings.ToLower(w.headers["transfer-encoding"]), "chunked")
+	if head {
+		return w.writerState == pendingBody || w.writerState == done && !chunked && w.bytesWritten == 0
+	}
+	switch w.writerState {
+	case pendingBody:
+		if chunked {
+			if _, err := w.WriteChunkedBodyDone(); err != nil {
+				return false
+			}
+			return w.WriteTrailers(nil) == nil
+		}
+		if w.statusCode == StatusNoContent || w.statusCode == StatusNotModified {
+			return true
+		}
+		return w.headers["content-length"] == "0"
+	case done:
+		if chunked {
+			return w.wroteTrailer || w.WriteTrailers(nil) == nil
+		}
+		contentLength, err := strconv.ParseInt(w.headers["content-length"], 10, 64)
+		return err == nil && contentLength == w.bytesWritten
+	default:
+		return false
+	}
+}
+
+func (w *Writer) observe(p []byte) {
+	if w.hooks.Write != nil {
+		w.hooks.Write(p)
+	}
+}
+
+func (w *Writer) write(p []byte) (int, error) {
+	if w.stream != nil {
+		return w.stream.WriteData(p)
+	}
+	return w.writer.Write(p)
+}
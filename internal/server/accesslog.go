@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// LogFormat selects how AccessLog writes each entry.
+type LogFormat int
+
+const (
+	// LogCommon is the Common Log Format:
+	//   host ident authuser [date] "request line" status bytes
+	LogCommon LogFormat = iota
+	// LogCombined adds the referer and user agent to LogCommon.
+	LogCombined
+	// LogJSON writes every field as a structured log/slog record.
+	LogJSON
+)
+
+const requestIDHeader = "x-request-id"
+
+// redacted replaces the values of headers named in AccessLogConfig.Redact.
+const redacted = "[REDACTED]"
+
+var defaultRedact = []string{"authorization", "proxy-authorization", "cookie"}
+
+type AccessLogConfig struct {
+	Format LogFormat
+	// Output receives the log lines, os.Stdout by default. For LogJSON
+	// Logger takes precedence when set.
+	Output io.Writer
+	Logger *slog.Logger
+	// SampleRate is the fraction of requests logged, between 0 and 1.
+	// Zero logs everything. Server errors are always logged.
+	SampleRate float64
+	// Headers lists request headers to add to each entry. Text formats
+	// append them as name="value" after the standard fields.
+	Headers []string
+	// Redact names headers whose values must never reach the log, on
+	// top of authorization, proxy-authorization and cookie.
+	Redact []string
+	// LogCredentials names any of those three to log in clear after all.
+	LogCredentials []string
+}
+
+// AccessLog returns middleware that logs a line per request with the
+// client address, request line, status, body bytes, duration, user agent
+// and request ID. The text formats add the duration and request ID as
+// duration= and request_id= after their usual fields. Requests without
+// an X-Request-ID get a generated one, which is also sent back on the
+// response. A handler that panics is logged with the status it wrote, or
+// 500 if it wrote none, before the panic goes on.
+func AccessLog(config AccessLogConfig) Middleware {
+	al := newAccessLogger(config)
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			id := req.Headers[requestIDHeader]
+			if id == "" {
+				id = newRequestID()
+				req.Headers.Set(requestIDHeader, id)
+			}
+			rec := response.Wrap(w, response.Hooks{
+				WriteHeaders: func(_ response.StatusCode, h headers.Headers) {
+					if h[requestIDHeader] == "" {
+						h.Set(requestIDHeader, id)
+					}
+				},
+			})
+			defer func() {
+				entry := accessEntry{
+					req:      req,
+					start:    start,
+					duration: time.Since(start),
+					status:   rec.StatusCode(),
+					bytes:    rec.BytesWritten(),
+					id:       id,
+				}
+				v := recover()
+				// The server answers a panic before anything was written
+				// with a 500.
+				if v != nil && entry.status == 0 {
+					entry.status = response.StatusInternalServerError
+				}
+				if al.sampled(entry.status) {
+					al.log(entry)
+				}
+				if v != nil {
+					panic(v)
+				}
+			}()
+			next(rec, req)
+		}
+	}
+}
+
+type accessEntry struct {
+	req      *request.Request
+	start    time.Time
+	duration time.Duration
+	status   response.StatusCode
+	bytes    int64
+	id       string
+}
+
+type accessLogger struct {
+	format     LogFormat
+	text       *log.Logger
+	json       *slog.Logger
+	sampleRate float64
+	headers    []string
+	redact     map[string]bool
+}
+
+func newAccessLogger(config AccessLogConfig) *accessLogger {
+	out := config.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	al := &accessLogger{
+		format:     config.Format,
+		sampleRate: config.SampleRate,
+		redact:     map[string]bool{},
+	}
+	for _, name := range config.Headers {
+		al.headers = append(al.headers, strings.ToLower(name))
+	}
+	for _, name := range append(defaultRedact, config.Redact...) {
+		al.redact[strings.ToLower(name)] = true
+	}
+	for _, name := range config.LogCredentials {
+		delete(al.redact, strings.ToLower(name))
+	}
+	if al.format == LogJSON {
+		al.json = config.Logger
+		if al.json == nil {
+			al.json = slog.New(slog.NewJSONHandler(out, nil))
+		}
+	} else {
+		// log.Logger serializes writes from concurrent handlers.
+		al.text = log.New(out, "", 0)
+	}
+	return al
+}
+
+func (al *accessLogger) sampled(status response.StatusCode) bool {
+	if al.sampleRate <= 0 || al.sampleRate >= 1 || status >= 500 {
+		return true
+	}
+	return rand.Float64() < al.sampleRate
+}
+
+// header returns the value of a request header as it may be logged.
+func (al *accessLogger) header(req *request.Request, name string) string {
+	v := req.Headers[name]
+	if v != "" && al.redact[name] {
+		return redacted
+	}
+	return v
+}
+
+func (al *accessLogger) log(e accessEntry) {
+	if al.format == LogJSON {
+		al.logJSON(e)
+		return
+	}
+
+	var b strings.Builder
+	host := e.req.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	fmt.Fprintf(&b, "%s - - [%s] %q %s %s",
+		orDash(host),
+		e.start.Format("02/Jan/2006:15:04:05 -0700"),
+		e.req.RequestLine.Method+" "+e.req.RequestLine.RequestTarget+" "+protocol(e.req),
+		orDash(statusString(e.status)),
+		orDash(bytesString(e.bytes)),
+	)
+	if al.format == LogCombined {
+		fmt.Fprintf(&b, " %q %q", orDash(al.header(e.req, "referer")), orDash(al.header(e.req, "user-agent")))
+	}
+	fmt.Fprintf(&b, " duration=%s request_id=%q", e.duration, e.id)
+	for _, name := range al.headers {
+		fmt.Fprintf(&b, " %s=%q", name, al.header(e.req, name))
+	}
+	al.text.Print(b.String())
+}
+
+func (al *accessLogger) logJSON(e accessEntry) {
+	attrs := []slog.Attr{
+		slog.String("remote_addr", e.req.RemoteAddr),
+		slog.String("method", e.req.RequestLine.Method),
+		slog.String("target", e.req.RequestLine.RequestTarget),
+		slog.String("protocol", protocol(e.req)),
+		slog.Int("status", int(e.status)),
+		slog.Int64("bytes", e.bytes),
+		slog.Duration("duration", e.duration),
+		slog.String("user_agent", al.header(e.req, "user-agent")),
+		slog.String("request_id", e.id),
+	}
+	if len(al.headers) > 0 {
+		fields := make([]any, 0, len(al.headers))
+		for _, name := range al.headers {
+			fields = append(fields, slog.String(name, al.header(e.req, name)))
+		}
+		attrs = append(attrs, slog.Group("headers", fields...))
+	}
+	al.json.LogAttrs(context.Background(), slog.LevelInfo, "request", attrs...)
+}
+
+func protocol(req *request.Request) string {
+	return "HTTP/" + req.RequestLine.HttpVersion
+}
+
+func statusString(status response.StatusCode) string {
+	if status == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(status))
+}
+
+func bytesString(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	cryptorand.Read(b)
+	return hex.EncodeToString(b)
+}
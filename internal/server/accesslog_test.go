@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	newReq := func() *request.Request {
+		req := newTestRequest(t, "GET", "/users/7?full=1")
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Headers.Set("user-agent", "curl/8.0")
+		req.Headers.Set("referer", "https://example.com/")
+		req.Headers.Set("authorization", "Bearer secret")
+		req.Headers.Set("cookie", "session=secret")
+		return req
+	}
+	h := reply("user")
+
+	// Test: Common Log Format
+	var out bytes.Buffer
+	res := serve(t, Chain(h, AccessLog(AccessLogConfig{Output: &out})), newReq())
+	assert.Regexp(t, `^192\.0\.2\.10 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /users/7\?full=1 HTTP/1\.1" 200 4 duration=\S+ request_id="[0-9a-f]{16}"\n$`, out.String())
+
+	// Test: A request ID is generated and sent back
+	id := regexp.MustCompile(`x-request-id: ([0-9a-f]{16})\r\n`).FindStringSubmatch(res)
+	require.Len(t, id, 2, res)
+
+	// Test: Combined adds referer and user agent, and listed headers come last
+	out.Reset()
+	serve(t, Chain(h, AccessLog(AccessLogConfig{
+		Format:  LogCombined,
+		Output:  &out,
+		Headers: []string{"X-Request-ID", "Authorization"},
+	})), newReq())
+	assert.Regexp(t, `" 200 4 "https://example\.com/" "curl/8\.0" duration=\S+ request_id="[0-9a-f]{16}" x-request-id="[0-9a-f]{16}" authorization="\[REDACTED\]"\n$`, out.String())
+
+	// Test: JSON carries every field and keeps the client's request ID
+	out.Reset()
+	req := newReq()
+	req.Headers.Set("x-request-id", "abc-123")
+	res = serve(t, Chain(h, AccessLog(AccessLogConfig{
+		Format:  LogJSON,
+		Output:  &out,
+		Headers: []string{"cookie", "referer"},
+	})), req)
+	assert.Contains(t, res, "x-request-id: abc-123\r\n")
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, "request", entry["msg"])
+	assert.Equal(t, "192.0.2.10:51234", entry["remote_addr"])
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/users/7?full=1", entry["target"])
+	assert.Equal(t, "HTTP/1.1", entry["protocol"])
+	assert.Equal(t, 200.0, entry["status"])
+	assert.Equal(t, 4.0, entry["bytes"])
+	assert.Contains(t, entry, "duration")
+	assert.Equal(t, "curl/8.0", entry["user_agent"])
+	assert.Equal(t, "abc-123", entry["request_id"])
+	assert.Equal(t, map[string]any{"cookie": "[REDACTED]", "referer": "https://example.com/"}, entry["headers"])
+
+	// Test: Redact adds to the default list rather than replacing it
+	out.Reset()
+	serve(t, Chain(h, AccessLog(AccessLogConfig{
+		Output:  &out,
+		Headers: []string{"authorization", "user-agent"},
+		Redact:  []string{"User-Agent"},
+	})), newReq())
+	assert.Contains(t, out.String(), `authorization="[REDACTED]" user-agent="[REDACTED]"`)
+
+	// Test: Credentials are only logged when asked for by name
+	out.Reset()
+	serve(t, Chain(h, AccessLog(AccessLogConfig{
+		Output:         &out,
+		Headers:        []string{"authorization"},
+		LogCredentials: []string{"Authorization"},
+	})), newReq())
+	assert.Contains(t, out.String(), `authorization="Bearer secret"`)
+
+	// Test: Nothing written is logged with dashes
+	out.Reset()
+	silent := func(w *response.Writer, req *request.Request) {}
+	serve(t, Chain(silent, AccessLog(AccessLogConfig{Output: &out})), newReq())
+	assert.Contains(t, out.String(), `HTTP/1.1" - - duration=`)
+
+	// Test: A panicking handler is still logged, as the 500 the server
+	// sends, and the panic carries on to the server
+	out.Reset()
+	panicking := func(w *response.Writer, req *request.Request) { panic("boom") }
+	assert.PanicsWithValue(t, "boom", func() {
+		serve(t, Chain(panicking, AccessLog(AccessLogConfig{Output: &out})), newReq())
+	})
+	assert.Contains(t, out.String(), `HTTP/1.1" 500 - duration=`)
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var out bytes.Buffer
+	status := response.StatusOK
+	h := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(status)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	}
+	logged := Chain(h, AccessLog(AccessLogConfig{Output: &out, SampleRate: 0.25}))
+
+	// Test: About the sample rate of requests are logged
+	for range 2000 {
+		serve(t, logged, newTestRequest(t, "GET", "/"))
+	}
+	lines := strings.Count(out.String(), "\n")
+	assert.Greater(t, lines, 350)
+	assert.Less(t, lines, 650)
+
+	// Test: Server errors are always logged
+	out.Reset()
+	status = response.StatusInternalServerError
+	for range 20 {
+		serve(t, logged, newTestRequest(t, "GET", "/"))
+	}
+	assert.Equal(t, 20, strings.Count(out.String(), "\n"))
+}
+
+func TestAccessLogRemoteAddr(t *testing.T) {
+	// Test: The server fills in the client address
+	var out syncBuffer
+	_, addr := startServer(t, Chain(keepAliveHandler, AccessLog(AccessLogConfig{Output: &out})))
+	_, br := sendRequest(t, addr, requestMessage("GET", "/logged"))
+	readResponse(t, br)
+	require.Eventually(t, func() bool { return out.String() != "" }, time.Second, time.Millisecond)
+	assert.Regexp(t, `^(127\.0\.0\.1|::1) - - \[`, out.String())
+	assert.Contains(t, out.String(), `"GET /logged HTTP/1.1" 200 `)
+}
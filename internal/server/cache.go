@@ -0,0 +1,732 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+const (
+	defaultCacheBytes = 64 << 20
+	defaultCacheName  = "httpfromtcp"
+	// maxHeuristicFreshness caps the lifetime guessed from Last-Modified.
+	maxHeuristicFreshness = 24 * time.Hour
+	// maxDeltaSeconds is what larger delta-seconds are read as, per RFC
+	// 9111 section 1.2.2, keeping lifetimes clear of Duration overflow.
+	maxDeltaSeconds = 1 << 31
+)
+
+// heuristicStatuses may be cached without explicit freshness, per RFC
+// 9110 section 15.1. Other statuses need max-age, s-maxage or Expires.
+var heuristicStatuses = map[response.StatusCode]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// httpDateFormats are IMF-fixdate and the two obsolete formats RFC 9110
+// section 5.6.7 still requires recipients to accept.
+var httpDateFormats = []string{httpTimeFormat, "Monday, 02-Jan-06 15:04:05 GMT", "Mon Jan _2 15:04:05 2006"}
+
+// Cache is a shared HTTP cache (RFC 9111) held in memory, meant to sit
+// in front of a ReverseProxy or ForwardProxy:
+//
+//	cache := &server.Cache{MaxBytes: 256 << 20}
+//	router.Get("/api/{path...}", cache.Middleware(api.ServeRequest))
+//
+// It stores GET responses as Cache-Control, Expires and Vary allow, and
+// serves them until they go stale. Stale responses are revalidated with
+// If-None-Match and If-Modified-Since, in the background while
+// stale-while-revalidate permits. Responses carry an Age and a
+// Cache-Status header (RFC 9211) saying what the cache did. Responses
+// that set cookies are never stored, since the next client would get
+// them too. Any other method that succeeds drops what is stored for
+// its URL. The zero value is ready to use.
+type Cache struct {
+	// MaxBytes bounds the size of the stored responses, 64 MiB by
+	// default. The least recently used are evicted first.
+	MaxBytes int64
+	// MaxEntryBytes is the largest response that will be stored, an
+	// eighth of MaxBytes by default.
+	MaxEntryBytes int64
+	// Name identifies the cache in Cache-Status.
+	Name     string
+	ErrorLog *log.Logger
+
+	mu      sync.Mutex
+	entries map[string][]*cacheEntry
+	lru     list.List
+	size    int64
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	key    string
+	status response.StatusCode
+	header headers.Headers
+	body   []byte
+	// vary holds the request values of the headers named in Vary.
+	vary         map[string]string
+	cc           cacheControl
+	requestTime  time.Time
+	responseTime time.Time
+	size         int64
+	elem         *list.Element
+	revalidating bool
+}
+
+// Middleware serves what it can from the cache and sends the rest to
+// next, storing what comes back.
+func (c *Cache) Middleware(next Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		key := cacheKey(req)
+		method := req.RequestLine.Method
+		if method != "GET" && method != "HEAD" {
+			next(w, req)
+			// RFC 9111 section 4.4: a successful unsafe request makes what
+			// is stored for its URL out of date.
+			if code := w.StatusCode(); code >= 200 && code < 400 {
+				c.invalidate(key)
+			}
+			return
+		}
+		reqCC := parseCacheControl(req.Headers["cache-control"])
+		if reqCC.has("no-store") {
+			c.fetch(w, req, next, key, "fwd=bypass", false)
+			return
+		}
+
+		now := c.clock()
+		e := c.lookup(key, req)
+		if e == nil {
+			if reqCC.has("only-if-cached") {
+				extra := headers.NewHeaders()
+				extra.Set("cache-status", c.name()+"; fwd=miss")
+				writeError(w, response.StatusGatewayTimeout, "", extra)
+				return
+			}
+			c.fetch(w, req, next, key, "fwd=uri-miss", method == "GET")
+			return
+		}
+		age, lifetime := e.age(now), e.lifetime()
+		fresh := age < lifetime && !e.cc.has("no-cache") && !reqCC.has("no-cache")
+		if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+			fresh = false
+		}
+		if fresh {
+			c.serve(w, req, e, now, "hit; ttl="+strconv.Itoa(int((lifetime-age)/time.Second)))
+			return
+		}
+		if method == "HEAD" {
+			c.fetch(w, req, next, key, "fwd=stale", false)
+			return
+		}
+		window, swr := e.cc.seconds("stale-while-revalidate")
+		if swr && age < lifetime+window && !e.mustRevalidate() && !reqCC.has("no-cache") {
+			c.serve(w, req, e, now, "hit; ttl="+strconv.Itoa(int((lifetime-age)/time.Second)))
+			if c.startRevalidating(e) {
+				go c.refresh(req, next, e)
+			}
+			return
+		}
+		c.revalidate(w, req, next, e)
+	}
+}
+
+// fetch passes req to next and stores the response on its way to w if
+// store is set and it is storable.
+func (c *Cache) fetch(w *response.Writer, req *request.Request, next Handler, key, status string, store bool) {
+	requestTime := c.clock()
+	var code response.StatusCode
+	var header headers.Headers
+	var body bytes.Buffer
+	rec := response.Wrap(w, response.Hooks{
+		WriteHeaders: func(statusCode response.StatusCode, h headers.Headers) {
+			code, header = statusCode, forwardHeaders(h)
+			store = store && c.storable(req, code, header)
+			h.Override("cache-status", c.name()+"; "+status)
+		},
+		Write: func(p []byte) {
+			if !store {
+				return
+			}
+			if int64(body.Len()+len(p)) > c.maxEntryBytes() {
+				store = false
+				body = bytes.Buffer{}
+				return
+			}
+			body.Write(p)
+		},
+	})
+	next(rec, req)
+	// A body cut short by the handler is not worth keeping.
+	if n, err := strconv.Atoi(header["content-length"]); err == nil && n != body.Len() {
+		store = false
+	}
+	if store {
+		c.store(key, req, code, header, body.Bytes(), requestTime)
+	}
+}
+
+// revalidate asks next whether e is still good, answering w from e if it
+// is. Any other response is streamed on to w as it arrives.
+func (c *Cache) revalidate(w *response.Writer, req *request.Request, next Handler, e *cacheEntry) {
+	requestTime := c.clock()
+	rv := c.conditional(req, next, e, w)
+	switch rv.status {
+	case response.StatusNotModified:
+		updated := c.update(e, rv.header, requestTime)
+		c.serve(w, req, updated, c.clock(), "fwd=stale; fwd-status=304")
+		return
+	case 0:
+		c.remove(e)
+		writeError(w, response.StatusBadGateway, "", nil)
+		return
+	}
+	if rv.complete() {
+		c.store(e.key, req, rv.status, rv.header, rv.body.Bytes(), requestTime)
+	} else {
+		c.remove(e)
+	}
+}
+
+// refresh revalidates e in the background after it was served stale.
+func (c *Cache) refresh(req *request.Request, next Handler, e *cacheEntry) {
+	defer func() {
+		if v := recover(); v != nil {
+			c.logf("cache: revalidating %s: %v", e.key, v)
+		}
+		c.mu.Lock()
+		e.revalidating = false
+		c.mu.Unlock()
+	}()
+	requestTime := c.clock()
+	rv := c.conditional(req, next, e, nil)
+	switch {
+	case rv.status == response.StatusNotModified:
+		c.update(e, rv.header, requestTime)
+	case rv.complete():
+		c.store(e.key, req, rv.status, rv.header, rv.body.Bytes(), requestTime)
+	}
+}
+
+// conditional sends a copy of req to next with e's validators. A
+// response other than 304 goes on to w, unless w is nil.
+func (c *Cache) conditional(req *request.Request, next Handler, e *cacheEntry, w *response.Writer) *revalidation {
+	out := *req
+	out.Headers = headers.NewHeaders()
+	for key, value := range req.Headers {
+		out.Headers[key] = value
+	}
+	out.Headers.Remove("if-none-match")
+	out.Headers.Remove("if-modified-since")
+	if etag := e.header["etag"]; etag != "" {
+		out.Headers.Override("if-none-match", etag)
+	}
+	if modified := e.header["last-modified"]; modified != "" {
+		out.Headers.Override("if-modified-since", modified)
+	}
+	rv := &revalidation{c: c, req: req, w: w}
+	next(response.NewStreamWriter(rv), &out)
+	rv.finish()
+	return rv
+}
+
+// serve answers req from e, with a 304 if the client's own validator
+// matches.
+func (c *Cache) serve(w *response.Writer, req *request.Request, e *cacheEntry, now time.Time, status string) {
+	h := headers.NewHeaders()
+	for key, value := range e.header {
+		h[key] = value
+	}
+	h.Override("age", strconv.Itoa(int(e.age(now)/time.Second)))
+	h.Override("cache-status", c.name()+"; "+status)
+	if etag := e.header["etag"]; etag != "" && etagMatches(req.Headers["if-none-match"], etag) {
+		for _, name := range []string{"content-length", "content-type", "content-encoding"} {
+			h.Remove(name)
+		}
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(h)
+		return
+	}
+	body := e.body
+	if req.RequestLine.Method == "HEAD" {
+		body = nil
+	}
+	writeStored(w, e.status, h, body)
+}
+
+// storable applies RFC 9111 section 3 to a response to req.
+func (c *Cache) storable(req *request.Request, code response.StatusCode, h headers.Headers) bool {
+	cc := parseCacheControl(h["cache-control"])
+	reqCC := parseCacheControl(req.Headers["cache-control"])
+	switch {
+	case req.RequestLine.Method != "GET", code < 200, code == 206, code == response.StatusNotModified:
+		return false
+	case cc.has("no-store"), cc.has("private"), reqCC.has("no-store"):
+		return false
+	case strings.TrimSpace(h["vary"]) == "*", h["set-cookie"] != "":
+		return false
+	case req.Headers["authorization"] != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate"):
+		return false
+	}
+	e := &cacheEntry{status: code, header: h, cc: cc}
+	if _, ok := e.explicitLifetime(); ok {
+		return true
+	}
+	// Without freshness it can only be revalidated, which needs a
+	// validator.
+	return heuristicStatuses[code] && (h["etag"] != "" || h["last-modified"] != "")
+}
+
+func (c *Cache) store(key string, req *request.Request, code response.StatusCode, h headers.Headers, body []byte, requestTime time.Time) {
+	// The stored body is sent whole, so the length replaces any chunking.
+	h.Remove("transfer-encoding")
+	h.Remove("trailer")
+	if code != response.StatusNoContent {
+		h.Override("content-length", strconv.Itoa(len(body)))
+	}
+	if h["date"] == "" {
+		h.Set("date", requestTime.UTC().Format(httpTimeFormat))
+	}
+	e := &cacheEntry{
+		key:          key,
+		status:       code,
+		header:       h,
+		body:         bytes.Clone(body),
+		vary:         map[string]string{},
+		cc:           parseCacheControl(h["cache-control"]),
+		requestTime:  requestTime,
+		responseTime: c.clock(),
+	}
+	for _, name := range strings.Split(h["vary"], ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			e.vary[name] = normalizeVary(req.Headers[name])
+		}
+	}
+	e.size = e.measure()
+	if e.size > c.maxBytes() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string][]*cacheEntry{}
+	}
+	for _, old := range c.entries[key] {
+		if old.sameVariant(e.vary) {
+			c.removeLocked(old)
+			break
+		}
+	}
+	c.entries[key] = append(c.entries[key], e)
+	e.elem = c.lru.PushFront(e)
+	c.size += e.size
+	for c.size > c.maxBytes() {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// update applies the headers of a 304 to e, per RFC 9111 section 4.3.4,
+// and restarts its age.
+func (c *Cache) update(e *cacheEntry, h headers.Headers, requestTime time.Time) *cacheEntry {
+	responseTime := c.clock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	updated := *e
+	updated.header = headers.NewHeaders()
+	for key, value := range e.header {
+		updated.header[key] = value
+	}
+	for key, value := range forwardHeaders(h) {
+		switch key {
+		case "content-length", "content-encoding", "content-range", "cache-status":
+		default:
+			updated.header[key] = value
+		}
+	}
+	if h["date"] == "" {
+		updated.header.Override("date", requestTime.UTC().Format(httpTimeFormat))
+	}
+	updated.cc = parseCacheControl(updated.header["cache-control"])
+	updated.requestTime, updated.responseTime = requestTime, responseTime
+	updated.revalidating = false
+	updated.size = updated.measure()
+
+	if e.elem == nil {
+		// Evicted in the meantime; serve the update without keeping it.
+		return &updated
+	}
+	variants := c.entries[e.key]
+	for i, v := range variants {
+		if v == e {
+			variants[i] = &updated
+		}
+	}
+	updated.elem = c.lru.PushFront(&updated)
+	c.lru.Remove(e.elem)
+	e.elem = nil
+	// The merged headers can make the entry bigger than it was.
+	c.size += updated.size - e.size
+	for c.size > c.maxBytes() {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry))
+	}
+	return &updated
+}
+
+// measure is what e counts against MaxBytes: its key, body and headers.
+func (e *cacheEntry) measure() int64 {
+	size := int64(len(e.body) + len(e.key))
+	for name, value := range e.header {
+		size += int64(len(name) + len(value))
+	}
+	return size
+}
+
+// lookup finds the stored response for key whose Vary headers match req.
+func (c *Cache) lookup(key string, req *request.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries[key] {
+		if e.matches(req) {
+			c.lru.MoveToFront(e.elem)
+			return e
+		}
+	}
+	return nil
+}
+
+func (c *Cache) startRevalidating(e *cacheEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e.revalidating || e.elem == nil {
+		return false
+	}
+	e.revalidating = true
+	return true
+}
+
+func (c *Cache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries[key] {
+		c.removeLocked(e)
+	}
+}
+
+func (c *Cache) remove(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(e)
+}
+
+func (c *Cache) removeLocked(e *cacheEntry) {
+	if e.elem == nil {
+		return
+	}
+	c.lru.Remove(e.elem)
+	e.elem = nil
+	c.size -= e.size
+	variants := c.entries[e.key]
+	for i, v := range variants {
+		if v == e {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.entries, e.key)
+	} else {
+		c.entries[e.key] = variants
+	}
+}
+
+func (c *Cache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func (c *Cache) maxBytes() int64 {
+	if c.MaxBytes > 0 {
+		return c.MaxBytes
+	}
+	return defaultCacheBytes
+}
+
+func (c *Cache) maxEntryBytes() int64 {
+	if c.MaxEntryBytes > 0 {
+		return c.MaxEntryBytes
+	}
+	return c.maxBytes() / 8
+}
+
+func (c *Cache) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return defaultCacheName
+}
+
+func (c *Cache) logf(format string, args ...any) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// age is the current age of e, per RFC 9111 section 4.2.3.
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparent := time.Duration(0)
+	if date, ok := parseHTTPDate(e.header["date"]); ok {
+		apparent = max(0, e.responseTime.Sub(date))
+	}
+	var ageValue time.Duration
+	if seconds, err := strconv.Atoi(e.header["age"]); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	corrected := ageValue + e.responseTime.Sub(e.requestTime)
+	return max(apparent, corrected) + now.Sub(e.responseTime)
+}
+
+// lifetime is how long e stays fresh, per RFC 9111 section 4.2.1.
+func (e *cacheEntry) lifetime() time.Duration {
+	if d, ok := e.explicitLifetime(); ok {
+		return d
+	}
+	// Heuristic freshness: a tenth of the time since it last changed.
+	date, ok := parseHTTPDate(e.header["date"])
+	modified, ok2 := parseHTTPDate(e.header["last-modified"])
+	if !ok || !ok2 || !heuristicStatuses[e.status] || !date.After(modified) {
+		return 0
+	}
+	return min(date.Sub(modified)/10, maxHeuristicFreshness)
+}
+
+func (e *cacheEntry) explicitLifetime() (time.Duration, bool) {
+	if d, ok := e.cc.seconds("s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := e.cc.seconds("max-age"); ok {
+		return d, true
+	}
+	expiresValue, ok := e.header["expires"]
+	if !ok {
+		return 0, false
+	}
+	// An invalid Expires, such as "0", means already expired.
+	expires, ok := parseHTTPDate(expiresValue)
+	date, ok2 := parseHTTPDate(e.header["date"])
+	if !ok || !ok2 {
+		return 0, true
+	}
+	return max(0, expires.Sub(date)), true
+}
+
+func (e *cacheEntry) mustRevalidate() bool {
+	return e.cc.has("must-revalidate") || e.cc.has("proxy-revalidate") || e.cc.has("s-maxage")
+}
+
+func (e *cacheEntry) matches(req *request.Request) bool {
+	for name, value := range e.vary {
+		if normalizeVary(req.Headers[name]) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *cacheEntry) sameVariant(vary map[string]string) bool {
+	if len(vary) != len(e.vary) {
+		return false
+	}
+	for name, value := range vary {
+		if e.vary[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// revalidation is the response.Stream a conditional request is answered
+// through. A 304 is kept for the cache to act on. Anything else is sent
+// on to w as chunks arrive, keeping up to MaxEntryBytes of it to store.
+type revalidation struct {
+	c       *Cache
+	req     *request.Request
+	w       *response.Writer
+	status  response.StatusCode
+	header  headers.Headers
+	body    bytes.Buffer
+	store   bool
+	chunked bool
+}
+
+func (rv *revalidation) WriteHeaders(statusCode response.StatusCode, h headers.Headers) error {
+	rv.status, rv.header = statusCode, forwardHeaders(h)
+	if statusCode == response.StatusNotModified {
+		return nil
+	}
+	rv.store = rv.c.storable(rv.req, statusCode, rv.header)
+	if rv.w == nil {
+		return nil
+	}
+	out := forwardHeaders(h)
+	out.Override("cache-status", rv.c.name()+"; fwd=stale; fwd-status="+strconv.Itoa(int(statusCode)))
+	// The stream has already taken the framing off, so the body is
+	// relayed in chunks as the ReverseProxy does for unknown lengths.
+	if statusCode >= 200 && statusCode != response.StatusNoContent {
+		out.Remove("content-length")
+		out.Override("transfer-encoding", "chunked")
+		rv.chunked = true
+	}
+	if err := rv.w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+	return rv.w.WriteHeaders(out)
+}
+
+func (rv *revalidation) WriteData(p []byte) (int, error) {
+	if rv.status == response.StatusNotModified {
+		return len(p), nil
+	}
+	if rv.store {
+		if int64(rv.body.Len()+len(p)) > rv.c.maxEntryBytes() {
+			rv.store = false
+			rv.body = bytes.Buffer{}
+		} else {
+			rv.body.Write(p)
+		}
+	}
+	if rv.chunked {
+		return rv.w.WriteChunkedBody(p)
+	}
+	return len(p), nil
+}
+
+func (rv *revalidation) WriteTrailers(headers.Headers) error {
+	return nil
+}
+
+func (rv *revalidation) finish() {
+	if rv.chunked {
+		rv.w.WriteChunkedBodyDone()
+		rv.w.WriteTrailers(nil)
+	}
+}
+
+// complete reports whether the response is to be stored, having arrived
+// whole and within MaxEntryBytes.
+func (rv *revalidation) complete() bool {
+	if !rv.store || rv.status == 0 || rv.status == response.StatusNotModified {
+		return false
+	}
+	n, err := strconv.Atoi(rv.header["content-length"])
+	return err != nil || n == rv.body.Len()
+}
+
+// writeStored sends a response held in memory.
+func writeStored(w *response.Writer, code response.StatusCode, h headers.Headers, body []byte) {
+	h.Remove("transfer-encoding")
+	h.Remove("trailer")
+	if code != response.StatusNoContent && code != response.StatusNotModified && len(body) > 0 {
+		h.Override("content-length", strconv.Itoa(len(body)))
+	}
+	w.WriteStatusLine(code)
+	w.WriteHeaders(h)
+	if len(body) > 0 {
+		w.WriteBody(body)
+	}
+}
+
+// cacheKey is the URL of req, which absolute-form targets already are.
+func cacheKey(req *request.Request) string {
+	if req.IsAbsoluteForm() {
+		return req.RequestLine.RequestTarget
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + strings.ToLower(req.Headers["host"]) + req.RequestLine.RequestTarget
+}
+
+// cacheControl holds Cache-Control directives, lower-cased, with their
+// arguments unquoted.
+type cacheControl map[string]string
+
+func parseCacheControl(value string) cacheControl {
+	cc := cacheControl{}
+	for _, part := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		cc[strings.ToLower(name)] = strings.Trim(strings.TrimSpace(arg), `"`)
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	arg, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, false
+	}
+	if err != nil || n > maxDeltaSeconds {
+		n = maxDeltaSeconds
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+func parseHTTPDate(value string) (time.Time, bool) {
+	for _, layout := range httpDateFormats {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// etagMatches implements the weak comparison If-None-Match uses.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeVary makes equivalent header values compare equal.
+func normalizeVary(value string) string {
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cacheOrigin answers each path with the headers configured for it,
+// numbering the bodies so cached ones stand out.
+type cacheOrigin struct {
+	mu   sync.Mutex
+	hits map[string]int
+	last *request.Request
+	// header is sent with every response to a path.
+	header map[string]headers.Headers
+}
+
+func (o *cacheOrigin) count(path string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.hits[path]
+}
+
+func (o *cacheOrigin) serve(w *response.Writer, req *request.Request) {
+	o.mu.Lock()
+	o.hits[req.Path()]++
+	n := o.hits[req.Path()]
+	o.last = req
+	h := headers.NewHeaders()
+	for key, value := range o.header[req.Path()] {
+		h[key] = value
+	}
+	o.mu.Unlock()
+
+	if etag := h["etag"]; etag != "" && req.Headers["if-none-match"] == etag {
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(h)
+		return
+	}
+	body := fmt.Sprintf("%s #%d %s", req.Path(), n, req.Headers["accept-language"])
+	h.Set("content-length", fmt.Sprint(len(body)))
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(h)
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody([]byte(body))
+	}
+}
+
+func newCacheOrigin(header map[string]string) *cacheOrigin {
+	origin := &cacheOrigin{hits: map[string]int{}, header: map[string]headers.Headers{}}
+	for path, raw := range header {
+		h := headers.NewHeaders()
+		for _, field := range strings.Split(raw, "\n") {
+			name, value, _ := strings.Cut(field, ": ")
+			h.Set(name, value)
+		}
+		origin.header[path] = h
+	}
+	return origin
+}
+
+func headerValue(head, name string) string {
+	for _, line := range strings.Split(head, "\r\n") {
+		if value, ok := strings.CutPrefix(line, name+": "); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestCache(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	var clock sync.Mutex
+	c := &Cache{now: func() time.Time {
+		clock.Lock()
+		defer clock.Unlock()
+		return now
+	}}
+	advance := func(d time.Duration) {
+		clock.Lock()
+		now = now.Add(d)
+		clock.Unlock()
+	}
+	date := "date: " + now.Format(httpTimeFormat)
+	origin := newCacheOrigin(map[string]string{
+		"/fresh":   "cache-control: max-age=60\netag: \"v1\"",
+		"/expires": date + "\nexpires: " + now.Add(30*time.Second).Format(httpTimeFormat),
+		"/nostore": "cache-control: no-store, max-age=60",
+		"/private": "cache-control: private, max-age=60",
+		"/cookie":  "cache-control: max-age=60\nset-cookie: id=1",
+		"/vary":    "cache-control: max-age=60\nvary: Accept-Language",
+		"/star":    "cache-control: max-age=60\nvary: *",
+		"/nocache": "cache-control: no-cache\netag: \"n\"",
+		"/plain":   "content-type: text/plain",
+	})
+	_, addr := startServer(t, c.Middleware(origin.serve))
+
+	// Test: Expires sets the lifetime when there is no max-age
+	roundTrip(t, addr, requestMessage("GET", "/expires"))
+	advance(20 * time.Second)
+	_, body := roundTrip(t, addr, requestMessage("GET", "/expires"))
+	assert.Equal(t, "/expires #1 ", body)
+	advance(20 * time.Second)
+	_, body = roundTrip(t, addr, requestMessage("GET", "/expires"))
+	assert.Equal(t, "/expires #2 ", body)
+
+	// Test: The first request goes to the origin, the second is a hit with an Age
+	head, body := roundTrip(t, addr, requestMessage("GET", "/fresh"))
+	assert.Equal(t, "/fresh #1 ", body)
+	assert.Equal(t, "httpfromtcp; fwd=uri-miss", headerValue(head, "cache-status"))
+	advance(10 * time.Second)
+	head, body = roundTrip(t, addr, requestMessage("GET", "/fresh"))
+	assert.Equal(t, "/fresh #1 ", body)
+	assert.Equal(t, "10", headerValue(head, "age"))
+	assert.Equal(t, "httpfromtcp; hit; ttl=50", headerValue(head, "cache-status"))
+	assert.Equal(t, 1, origin.count("/fresh"))
+
+	// Test: A matching If-None-Match from the client is answered with a 304
+	head, _ = roundTrip(t, addr, requestMessage("GET", "/fresh", `If-None-Match: W/"v1"`))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 304 Not Modified\r\n"), head)
+
+	// Test: HEAD is served from a stored GET
+	_, br := sendRequest(t, addr, requestMessage("HEAD", "/fresh"))
+	head = readHead(t, br)
+	assert.Contains(t, headerValue(head, "cache-status"), "hit")
+	_, err := br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, 1, origin.count("/fresh"))
+
+	// Test: A stale response is revalidated with its ETag and kept on a 304
+	advance(time.Minute)
+	head, body = roundTrip(t, addr, requestMessage("GET", "/fresh"))
+	assert.Equal(t, `"v1"`, origin.last.Headers["if-none-match"])
+	assert.Equal(t, "/fresh #1 ", body)
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=304", headerValue(head, "cache-status"))
+	assert.Equal(t, 2, origin.count("/fresh"))
+	head, _ = roundTrip(t, addr, requestMessage("GET", "/fresh"))
+	assert.Contains(t, headerValue(head, "cache-status"), "hit")
+	assert.Equal(t, 2, origin.count("/fresh"))
+
+	// Test: Request no-cache forces revalidation and max-age limits the age accepted
+	roundTrip(t, addr, requestMessage("GET", "/fresh", "Cache-Control: no-cache"))
+	assert.Equal(t, 3, origin.count("/fresh"))
+	advance(5 * time.Second)
+	roundTrip(t, addr, requestMessage("GET", "/fresh", "Cache-Control: max-age=2"))
+	assert.Equal(t, 4, origin.count("/fresh"))
+
+	// Test: no-store, private, Set-Cookie, Vary: * and Authorization keep
+	// responses out of a shared cache
+	for _, path := range []string{"/nostore", "/private", "/cookie", "/star"} {
+		roundTrip(t, addr, requestMessage("GET", path))
+		roundTrip(t, addr, requestMessage("GET", path))
+		assert.Equal(t, 2, origin.count(path), path)
+	}
+	roundTrip(t, addr, requestMessage("GET", "/fresh?auth", "Authorization: Basic eDp5"))
+	roundTrip(t, addr, requestMessage("GET", "/fresh?auth", "Authorization: Basic eDp5"))
+	assert.Equal(t, 6, origin.count("/fresh"))
+
+	// Test: Vary keeps a variant per value of the named header
+	_, body = roundTrip(t, addr, requestMessage("GET", "/vary", "Accept-Language: en"))
+	assert.Equal(t, "/vary #1 en", body)
+	_, body = roundTrip(t, addr, requestMessage("GET", "/vary", "Accept-Language: fr"))
+	assert.Equal(t, "/vary #2 fr", body)
+	_, body = roundTrip(t, addr, requestMessage("GET", "/vary", "Accept-Language: en"))
+	assert.Equal(t, "/vary #1 en", body)
+
+	// Test: no-cache responses are stored but revalidated every time
+	roundTrip(t, addr, requestMessage("GET", "/nocache"))
+	_, body = roundTrip(t, addr, requestMessage("GET", "/nocache"))
+	assert.Equal(t, "/nocache #1 ", body)
+	assert.Equal(t, `"n"`, origin.last.Headers["if-none-match"])
+
+	// Test: A changed response to a revalidation is streamed through and stored
+	origin.mu.Lock()
+	origin.header["/nocache"].Override("etag", `"m"`)
+	origin.mu.Unlock()
+	head, body = roundTrip(t, addr, requestMessage("GET", "/nocache"))
+	assert.Equal(t, "/nocache #3 ", body)
+	assert.Equal(t, "httpfromtcp; fwd=stale; fwd-status=200", headerValue(head, "cache-status"))
+	assert.Equal(t, "chunked", headerValue(head, "transfer-encoding"))
+	_, body = roundTrip(t, addr, requestMessage("GET", "/nocache"))
+	assert.Equal(t, "/nocache #3 ", body)
+	assert.Equal(t, `"m"`, origin.last.Headers["if-none-match"])
+
+	// Test: Without freshness or validators nothing is stored
+	roundTrip(t, addr, requestMessage("GET", "/plain"))
+	roundTrip(t, addr, requestMessage("GET", "/plain"))
+	assert.Equal(t, 2, origin.count("/plain"))
+
+	// Test: only-if-cached gets a 504 on a miss
+	head, _ = roundTrip(t, addr, requestMessage("GET", "/missing", "Cache-Control: only-if-cached"))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 504 Gateway Timeout\r\n"), head)
+	assert.Equal(t, 0, origin.count("/missing"))
+
+	// Test: A successful POST drops what is stored for its URL
+	advance(time.Minute)
+	roundTrip(t, addr, requestMessage("GET", "/vary", "Accept-Language: en"))
+	roundTrip(t, addr, requestMessage("POST", "/vary"))
+	_, body = roundTrip(t, addr, requestMessage("GET", "/vary", "Accept-Language: en"))
+	assert.Equal(t, "/vary #5 en", body)
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	now := time.Now()
+	var clock sync.Mutex
+	c := &Cache{now: func() time.Time {
+		clock.Lock()
+		defer clock.Unlock()
+		return now
+	}}
+	origin := newCacheOrigin(map[string]string{
+		"/swr":  "cache-control: max-age=10, stale-while-revalidate=30",
+		"/must": "cache-control: max-age=10, stale-while-revalidate=30, must-revalidate",
+	})
+	_, addr := startServer(t, c.Middleware(origin.serve))
+	roundTrip(t, addr, requestMessage("GET", "/swr"))
+	roundTrip(t, addr, requestMessage("GET", "/must"))
+	clock.Lock()
+	now = now.Add(20 * time.Second)
+	clock.Unlock()
+
+	// Test: Within the window the stale response is served at once and
+	// refreshed in the background
+	head, body := roundTrip(t, addr, requestMessage("GET", "/swr"))
+	assert.Equal(t, "/swr #1 ", body)
+	assert.Equal(t, "httpfromtcp; hit; ttl=-10", headerValue(head, "cache-status"))
+	require.Eventually(t, func() bool {
+		_, body := roundTrip(t, addr, requestMessage("GET", "/swr"))
+		return body == "/swr #2 "
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, origin.count("/swr"))
+
+	// Test: must-revalidate overrides stale-while-revalidate
+	_, body = roundTrip(t, addr, requestMessage("GET", "/must"))
+	assert.Equal(t, "/must #2 ", body)
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := &Cache{MaxBytes: 200, MaxEntryBytes: 200}
+	origin := newCacheOrigin(map[string]string{
+		"/a": "cache-control: max-age=60",
+		"/b": "cache-control: max-age=60",
+		"/c": "cache-control: max-age=60",
+	})
+	_, addr := startServer(t, c.Middleware(origin.serve))
+
+	// Test: Storing past MaxBytes evicts the least recently used response
+	roundTrip(t, addr, requestMessage("GET", "/a"))
+	roundTrip(t, addr, requestMessage("GET", "/b"))
+	roundTrip(t, addr, requestMessage("GET", "/a"))
+	roundTrip(t, addr, requestMessage("GET", "/c"))
+	c.mu.Lock()
+	size := c.size
+	c.mu.Unlock()
+	assert.LessOrEqual(t, size, int64(200))
+	roundTrip(t, addr, requestMessage("GET", "/a"))
+	roundTrip(t, addr, requestMessage("GET", "/b"))
+	assert.Equal(t, 1, origin.count("/a"))
+	assert.Equal(t, 2, origin.count("/b"))
+
+	// Test: Responses over MaxEntryBytes are passed on but not stored
+	small := &Cache{MaxEntryBytes: 4}
+	origin = newCacheOrigin(map[string]string{"/big": "cache-control: max-age=60"})
+	_, addr = startServer(t, small.Middleware(origin.serve))
+	roundTrip(t, addr, requestMessage("GET", "/big"))
+	_, body := roundTrip(t, addr, requestMessage("GET", "/big"))
+	assert.Equal(t, "/big #2 ", body)
+	assert.Equal(t, 2, origin.count("/big"))
+
+	// Test: Headers merged in from a 304 count toward the size
+	c = &Cache{}
+	origin = newCacheOrigin(map[string]string{"/n": "cache-control: no-cache\netag: \"n\""})
+	_, addr = startServer(t, c.Middleware(origin.serve))
+	roundTrip(t, addr, requestMessage("GET", "/n"))
+	c.mu.Lock()
+	before := c.size
+	c.mu.Unlock()
+	origin.mu.Lock()
+	origin.header["/n"].Set("x-extra", strings.Repeat("x", 100))
+	origin.mu.Unlock()
+	_, body = roundTrip(t, addr, requestMessage("GET", "/n"))
+	assert.Equal(t, "/n #1 ", body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sum int64
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		sum += el.Value.(*cacheEntry).measure()
+	}
+	assert.Equal(t, sum, c.size)
+	assert.Greater(t, c.size, before+100)
+}
+
+func TestCacheControlSeconds(t *testing.T) {
+	// Test: Delta-seconds past 2^31, even past int64, are read as 2^31
+	for _, arg := range []string{"2147483648", "9223372036854775807", "99999999999999999999"} {
+		d, ok := parseCacheControl("max-age=" + arg).seconds("max-age")
+		assert.True(t, ok, arg)
+		assert.Equal(t, time.Duration(1<<31)*time.Second, d, arg)
+	}
+
+	// Test: Anything not a number of seconds is ignored
+	for _, arg := range []string{"-1", "1.5", ""} {
+		_, ok := parseCacheControl("max-age=" + arg).seconds("max-age")
+		assert.False(t, ok, arg)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"runtime/debug"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// ErrAbortHandler can be panicked with to drop the connection (or reset
+// the HTTP/2 stream) without the panic being logged.
+var ErrAbortHandler = errors.New("server: abort handler")
+
+// ErrorHandler is a Handler that can fail instead of writing an error
+// response itself.
+type ErrorHandler func(w *response.Writer, req *request.Request) error
+
+// HandleErrors adapts h to a Handler. An error returned before anything
+// was written becomes the response: a *HandlerError with its own status
+// and message, any other error a 500 with ServerErrorHTML. Once the
+// response has started there is no way to report it, so the connection
+// is aborted instead. Errors are logged to the server's ErrorLog.
+func HandleErrors(h ErrorHandler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		err := h(w, req)
+		if err == nil || w.Hijacked() {
+			return
+		}
+		if w.StatusCode() != 0 {
+			errorLogf(w, "server: %s %s failed after responding: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+			panic(ErrAbortHandler)
+		}
+
+		var he *HandlerError
+		if !errors.As(err, &he) {
+			errorLogf(w, "server: %s %s: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+			writeError(w, response.StatusInternalServerError, ServerErrorHTML, nil)
+			return
+		}
+		status := he.StatusCode
+		if status == 0 {
+			status = response.StatusInternalServerError
+		}
+		message := he.Message
+		if message == "" {
+			message = response.StatusText(status)
+		}
+		w.WriteStatusLine(status)
+		w.WriteHeaders(response.GetDefaultHeaders(len(message)))
+		w.WriteBody([]byte(message))
+	}
+}
+
+// errorLogf logs to the ErrorLog set on w, falling back to the log package.
+func errorLogf(w *response.Writer, format string, args ...any) {
+	if l := w.ErrorLog(); l != nil {
+		l.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// recoverPanic turns a panicking handler into a 500 if nothing was sent
+// yet. Otherwise the client already has part of a response, and it
+// panics with ErrAbortHandler so the connection gets cut short.
+func (s *Server) recoverPanic(w *response.Writer, req *request.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v != ErrAbortHandler {
+		s.stats.panics.Add(1)
+		s.logf("server: panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, v, debug.Stack())
+	}
+	if w.Hijacked() {
+		return
+	}
+	if v != ErrAbortHandler && w.StatusCode() == 0 {
+		writeError(w, response.StatusInternalServerError, ServerErrorHTML, nil)
+		return
+	}
+	panic(ErrAbortHandler)
+}
+
+// runHandler serves one HTTP/1 request and reports whether the connection
+// has to be dropped mid-response.
+func (s *Server) runHandler(w *response.Writer, req *request.Request) (aborted bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			if v != ErrAbortHandler {
+				panic(v)
+			}
+			aborted = true
+		}
+	}()
+	s.serveRequest(w, req)
+	return false
+}
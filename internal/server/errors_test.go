@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleErrors(t *testing.T) {
+	r := NewRouter()
+	r.Get("/ok", HandleErrors(func(w *response.Writer, req *request.Request) error {
+		keepAliveHandler(w, req)
+		return nil
+	}))
+	r.Get("/missing", HandleErrors(func(w *response.Writer, req *request.Request) error {
+		return &HandlerError{StatusCode: response.StatusNotFound, Message: "no such widget"}
+	}))
+	r.Get("/wrapped", HandleErrors(func(w *response.Writer, req *request.Request) error {
+		return fmt.Errorf("loading widget: %w", &HandlerError{StatusCode: response.StatusBadRequest})
+	}))
+	r.Get("/broken", HandleErrors(func(w *response.Writer, req *request.Request) error {
+		return errors.New("database on fire")
+	}))
+	r.Get("/unset", HandleErrors(func(w *response.Writer, req *request.Request) error {
+		return &HandlerError{Message: "no status"}
+	}))
+
+	// Test: A nil error leaves the handler's response alone
+	assert.Equal(t, "hello /ok", body(route(t, r, "GET", "/ok")))
+
+	// Test: A HandlerError picks the status and message
+	res := route(t, r, "GET", "/missing")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), res)
+	assert.Equal(t, "no such widget", body(res))
+
+	// Test: A wrapped HandlerError without a message uses the status text
+	res = route(t, r, "GET", "/wrapped")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 400 Bad Request\r\n"), res)
+	assert.Equal(t, "Bad Request", body(res))
+
+	// Test: A HandlerError without a status is a 500
+	res = route(t, r, "GET", "/unset")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 500 Internal Server Error\r\n"), res)
+	assert.Equal(t, "no status", body(res))
+
+	// Test: Any other error is a 500, logged to the server's ErrorLog
+	var logs syncBuffer
+	_, addr := startServer(t, r.ServeRequest, WithErrorLog(log.New(&logs, "", 0)))
+	_, br := sendRequest(t, addr, requestMessage("GET", "/broken"))
+	head, b := readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 500 Internal Server Error\r\n"), head)
+	assert.Equal(t, ServerErrorHTML, b)
+	assert.Contains(t, logs.String(), "server: GET /broken: database on fire")
+
+	// Test: The error message is readable
+	err := &HandlerError{StatusCode: response.StatusNotFound, Message: "no such widget"}
+	assert.Equal(t, "404 Not Found: no such widget", err.Error())
+}
+
+func TestPanicRecovery(t *testing.T) {
+	r := NewRouter()
+	r.Get("/early", func(w *response.Writer, req *request.Request) {
+		panic("nil map somewhere")
+	})
+	r.Get("/late", func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("content-length", "100")
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("partial"))
+		panic("lost the rest")
+	})
+	r.Get("/abort", func(w *response.Writer, req *request.Request) {
+		panic(ErrAbortHandler)
+	})
+	r.Get("/failed", HandleErrors(func(w *response.Writer, req *request.Request) error {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(100))
+		return errors.New("stream broke")
+	}))
+	r.Get("/{path...}", keepAliveHandler)
+
+	var logs syncBuffer
+	s, addr := startServer(t, r.ServeRequest, WithErrorLog(log.New(&logs, "", 0)))
+
+	// Test: A panic before writing becomes a 500 and the stack is logged
+	_, br := sendRequest(t, addr, requestMessage("GET", "/early"))
+	head, b := readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 500 Internal Server Error\r\n"), head)
+	assert.Equal(t, ServerErrorHTML, b)
+	assert.Contains(t, logs.String(), "panic serving GET /early: nil map somewhere")
+	assert.Contains(t, logs.String(), "errors_test.go")
+
+	// Test: A panic after the headers went out cuts the connection short
+	conn, _ := sendRequest(t, addr, requestMessage("GET", "/late"))
+	rest, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\npartial"), string(rest))
+	assert.Equal(t, uint64(2), s.Stats().Panics)
+
+	// Test: ErrAbortHandler drops the connection without logging
+	conn, _ = sendRequest(t, addr, requestMessage("GET", "/abort"))
+	rest, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.NotContains(t, logs.String(), "/abort")
+	assert.Equal(t, uint64(2), s.Stats().Panics)
+
+	// Test: An error returned after responding aborts the connection
+	conn, _ = sendRequest(t, addr, requestMessage("GET", "/failed"))
+	rest, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\n"), string(rest))
+	assert.Contains(t, logs.String(), "server: GET /failed failed after responding: stream broke")
+
+	// Test: The server keeps serving afterwards
+	_, br = sendRequest(t, addr, requestMessage("GET", "/still-here"))
+	_, b = readResponse(t, br)
+	assert.Equal(t, "hello /still-here", b)
+}
@@ -0,0 +1,369 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+const (
+	indexPage = "index.html"
+	// httpTimeFormat is the IMF-fixdate format of Last-Modified and
+	// If-Modified-Since.
+	httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+)
+
+// FileServer serves the files of FS, or of the directory Root when FS is
+// nil. FS can be an embed.FS to compile assets into the binary. To serve
+// files below a path, route a wildcard to it and set Prefix:
+//
+//	static := &server.FileServer{Root: "public", Prefix: "/static"}
+//	router.Get("/static/{path...}", static.ServeRequest)
+type FileServer struct {
+	FS   fs.FS
+	Root string
+	// Prefix is removed from the request path before looking it up.
+	Prefix string
+	// Listing shows the contents of directories without an index.html
+	// instead of answering 404.
+	Listing bool
+	// Precompressed sends name.gz in place of name, if there is one, to
+	// clients that accept gzip.
+	Precompressed bool
+	// Pages replaces the built-in error pages.
+	Pages StatusPages
+}
+
+func (fsrv *FileServer) ServeRequest(w *response.Writer, req *request.Request) {
+	if !allowFileMethod(w, req, fsrv.Pages) {
+		return
+	}
+	name, ok := strings.CutPrefix(req.Path(), fsrv.Prefix)
+	// The prefix has to end on a segment boundary: "/static" is not a
+	// prefix of "/staticfoo".
+	if !ok || name != "" && name[0] != '/' && !strings.HasSuffix(fsrv.Prefix, "/") {
+		fsrv.Pages.write(w, response.StatusNotFound, nil)
+		return
+	}
+	name, ok = cleanFilePath(name)
+	if !ok {
+		fsrv.Pages.write(w, response.StatusBadRequest, nil)
+		return
+	}
+
+	fsys := fsrv.FS
+	if fsys == nil {
+		root := fsrv.Root
+		if root == "" {
+			root = "."
+		}
+		fsys = os.DirFS(root)
+	}
+	// fs.FS names are unrooted, with "." for the top.
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		name = "."
+	}
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		writeFileError(w, err, fsrv.Pages)
+		return
+	}
+	if !info.IsDir() {
+		fsrv.serveFile(w, req, fsys, name, info)
+		return
+	}
+
+	// Relative links in an index page or listing only resolve against
+	// the directory if its URL ends in a slash.
+	if !strings.HasSuffix(req.Path(), "/") {
+		redirectToDir(w, req)
+		return
+	}
+	index := path.Join(name, indexPage)
+	if info, err := fs.Stat(fsys, index); err == nil && info.Mode().IsRegular() {
+		fsrv.serveFile(w, req, fsys, index, info)
+		return
+	}
+	if !fsrv.Listing {
+		fsrv.Pages.write(w, response.StatusNotFound, nil)
+		return
+	}
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		writeFileError(w, err, fsrv.Pages)
+		return
+	}
+	writeListing(w, req, entries, name != ".")
+}
+
+func (fsrv *FileServer) serveFile(w *response.Writer, req *request.Request, fsys fs.FS, name string, info fs.FileInfo) {
+	if !fsrv.Precompressed {
+		serveFile(w, req, fsys, name, info, fileVariant{pages: fsrv.Pages})
+		return
+	}
+	gz, err := fs.Stat(fsys, name+".gz")
+	if err != nil || !gz.Mode().IsRegular() {
+		serveFile(w, req, fsys, name, info, fileVariant{pages: fsrv.Pages})
+		return
+	}
+	// Caches must keep the two encodings apart.
+	if !acceptsGzip(req) {
+		serveFile(w, req, fsys, name, info, fileVariant{pages: fsrv.Pages, vary: true})
+		return
+	}
+	contentType, err := typeByName(fsys, name)
+	if err != nil {
+		writeFileError(w, err, fsrv.Pages)
+		return
+	}
+	serveFile(w, req, fsys, name+".gz", gz, fileVariant{
+		pages:       fsrv.Pages,
+		vary:        true,
+		contentType: contentType,
+		encoding:    "gzip",
+	})
+}
+
+// ServeFile answers req with the contents of the named file, or 404 if
+// there is no such file.
+func ServeFile(w *response.Writer, req *request.Request, name string) {
+	if !allowFileMethod(w, req, nil) {
+		return
+	}
+	fsys, base := os.DirFS(filepath.Dir(name)), filepath.Base(name)
+	info, err := fs.Stat(fsys, base)
+	if err != nil {
+		writeFileError(w, err, nil)
+		return
+	}
+	if info.IsDir() {
+		writeError(w, response.StatusNotFound, NotFoundHTML, nil)
+		return
+	}
+	serveFile(w, req, fsys, base, info, fileVariant{})
+}
+
+func allowFileMethod(w *response.Writer, req *request.Request, pages StatusPages) bool {
+	switch req.RequestLine.Method {
+	case "GET", "HEAD":
+		return true
+	}
+	h := headers.NewHeaders()
+	h.Set("allow", "GET, HEAD")
+	pages.write(w, response.StatusMethodNotAllowed, h)
+	return false
+}
+
+// cleanFilePath unescapes a request path and makes it rooted and clean.
+// Paths with a ".." segment are refused outright rather than resolved,
+// as no legitimate link contains one.
+func cleanFilePath(p string) (string, bool) {
+	p, err := url.PathUnescape(p)
+	if err != nil || strings.ContainsAny(p, "\x00\\") {
+		return "", false
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if seg == ".." {
+			return "", false
+		}
+	}
+	return path.Clean("/" + p), true
+}
+
+func writeFileError(w *response.Writer, err error, pages StatusPages) {
+	// ENOTDIR means a file was used as a directory, as in /file.txt/x.
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.ENOTDIR) {
+		pages.write(w, response.StatusNotFound, nil)
+		return
+	}
+	pages.write(w, response.StatusInternalServerError, nil)
+}
+
+func redirectToDir(w *response.Writer, req *request.Request) {
+	target := req.Path() + "/"
+	if _, query, ok := strings.Cut(req.RequestLine.RequestTarget, "?"); ok {
+		target += "?" + query
+	}
+	w.WriteStatusLine(response.StatusMovedPermanently)
+	h := headers.NewHeaders()
+	h.Set("location", target)
+	h.Set("content-length", "0")
+	w.WriteHeaders(h)
+}
+
+// fileVariant says how to send a file that isn't sent as is, such as a
+// .gz sibling standing in for the original.
+type fileVariant struct {
+	pages       StatusPages
+	vary        bool
+	contentType string
+	encoding    string
+}
+
+// serveFile streams the file, so even large files cost a buffer's worth
+// of memory.
+func serveFile(w *response.Writer, req *request.Request, fsys fs.FS, name string, info fs.FileInfo, v fileVariant) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		writeFileError(w, err, v.pages)
+		return
+	}
+	defer f.Close()
+
+	h := headers.NewHeaders()
+	if v.vary {
+		h.Set("vary", "accept-encoding")
+	}
+	modified := info.ModTime().UTC()
+	if !modified.IsZero() {
+		h.Set("last-modified", modified.Format(httpTimeFormat))
+	}
+	if notModified(req, modified) {
+		w.WriteStatusLine(response.StatusNotModified)
+		w.WriteHeaders(h)
+		return
+	}
+
+	var body io.Reader = f
+	contentType := v.contentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(name))
+	}
+	if contentType == "" {
+		sniffed, err := sniff(f)
+		if err != nil {
+			v.pages.write(w, response.StatusInternalServerError, nil)
+			return
+		}
+		contentType = detectContentType(sniffed)
+		// Rewind if possible, so the file itself is still the body.
+		if seeker, ok := f.(io.Seeker); ok {
+			_, err = seeker.Seek(0, io.SeekStart)
+		} else {
+			body = io.MultiReader(bytes.NewReader(sniffed), f)
+		}
+		if err != nil {
+			v.pages.write(w, response.StatusInternalServerError, nil)
+			return
+		}
+	}
+
+	w.WriteStatusLine(response.StatusOK)
+	h.Set("content-type", contentType)
+	h.Set("content-length", strconv.FormatInt(info.Size(), 10))
+	if v.encoding != "" {
+		h.Set("content-encoding", v.encoding)
+	}
+	w.WriteHeaders(h)
+	if req.RequestLine.Method == "HEAD" {
+		return
+	}
+	// The limit keeps the body to the announced length if the file grows
+	// while it is being sent.
+	w.WriteBodyFrom(io.LimitReader(body, info.Size()))
+}
+
+func sniff(r io.Reader) ([]byte, error) {
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// typeByName finds the content type of a file from its extension or,
+// failing that, its content.
+func typeByName(fsys fs.FS, name string) (string, error) {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType, nil
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sniffed, err := sniff(f)
+	if err != nil {
+		return "", err
+	}
+	return detectContentType(sniffed), nil
+}
+
+// acceptsGzip reports whether Accept-Encoding allows gzip, either by name
+// or through "*", with a non-zero quality.
+func acceptsGzip(req *request.Request) bool {
+	accepted := false
+	for _, part := range strings.Split(req.Headers["accept-encoding"], ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		// An explicit gzip entry overrides "*".
+		if coding == "gzip" {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+func notModified(req *request.Request, modified time.Time) bool {
+	since, err := time.Parse(httpTimeFormat, req.Headers["if-modified-since"])
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+func writeListing(w *response.Writer, req *request.Request, entries []fs.DirEntry, hasParent bool) {
+	dir := html.EscapeString(req.Path())
+	var b strings.Builder
+	fmt.Fprintf(&b, "<html>\n  <head>\n    <title>Index of %s</title>\n  </head>\n  <body>\n    <h1>Index of %s</h1>\n    <ul>\n", dir, dir)
+	if hasParent {
+		b.WriteString("      <li><a href=\"../\">../</a></li>\n")
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		// "./" keeps a name like "a:b" from reading as a URL scheme.
+		href := "./" + (&url.URL{Path: name}).EscapedPath()
+		fmt.Fprintf(&b, "      <li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	b.WriteString("    </ul>\n  </body>\n</html>")
+
+	w.WriteStatusLine(response.StatusOK)
+	h := headers.NewHeaders()
+	h.Set("content-type", "text/html; charset=utf-8")
+	h.Set("content-length", strconv.Itoa(b.Len()))
+	w.WriteHeaders(h)
+	if req.RequestLine.Method != "HEAD" {
+		w.WriteBody([]byte(b.String()))
+	}
+}
@@ -0,0 +1,421 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"embed"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		full := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(full), 0o755))
+		require.NoError(t, os.WriteFile(full, []byte(content), 0o644))
+	}
+	return root
+}
+
+func TestFileServer(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"index.html":        "<h1>home</h1>",
+		"css/site.css":      "body{}",
+		"docs/readme":       "just some text",
+		"docs/a b.txt":      "spaced",
+		"images/logo":       "\x89PNG\r\n\x1a\nrest",
+		"empty/.keep":       "",
+		"../outside/secret": "nope",
+	})
+	fsrv := &FileServer{Root: root, Prefix: "/static"}
+	r := NewRouter()
+	r.Get("/static/{path...}", fsrv.ServeRequest)
+	r.Handle("HEAD", "/static/{path...}", fsrv.ServeRequest)
+	r.Post("/static/{path...}", fsrv.ServeRequest)
+	get := func(target string) string { return route(t, r, "GET", target) }
+
+	// Test: Type from the extension, with length and Last-Modified
+	res := get("/static/css/site.css")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"), res)
+	assert.Contains(t, res, "content-type: text/css; charset=utf-8\r\n")
+	assert.Contains(t, res, "content-length: 6\r\n")
+	assert.Regexp(t, `last-modified: \w{3}, \d{2} \w{3} \d{4} \d{2}:\d{2}:\d{2} GMT\r\n`, res)
+	assert.Equal(t, "body{}", body(res))
+
+	// Test: Type sniffed from the content when there is no extension
+	assert.Contains(t, get("/static/docs/readme"), "content-type: text/plain; charset=utf-8\r\n")
+	assert.Contains(t, get("/static/images/logo"), "content-type: image/png\r\n")
+
+	// Test: Escaped names are found
+	assert.Equal(t, "spaced", body(get("/static/docs/a%20b.txt")))
+
+	// Test: Directories serve their index.html
+	res = get("/static/")
+	assert.Contains(t, res, "content-type: text/html; charset=utf-8\r\n")
+	assert.Equal(t, "<h1>home</h1>", body(res))
+
+	// Test: Directories without a trailing slash redirect
+	res = get("/static/docs?x=1")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 301 Moved Permanently\r\n"), res)
+	assert.Contains(t, res, "location: /static/docs/?x=1\r\n")
+
+	// Test: Missing files and unlisted directories are 404
+	for _, target := range []string{"/static/missing.css", "/static/docs/", "/static/css/site.css/x"} {
+		res = get(target)
+		assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), target+": "+res)
+	}
+
+	// Test: The prefix only matches whole path segments
+	res = serve(t, fsrv.ServeRequest, newTestRequest(t, "GET", "/staticcss/site.css"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), res)
+	res = serve(t, fsrv.ServeRequest, newTestRequest(t, "GET", "/staticfoo"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), res)
+
+	// Test: Paths trying to leave the root are refused
+	for _, target := range []string{
+		"/static/../outside/secret",
+		"/static/%2e%2e/outside/secret",
+		"/static/docs/..%2f..%2foutside/secret",
+		"/static/docs%5c..%5csecret",
+	} {
+		res = get(target)
+		assert.True(t, strings.HasPrefix(res, "HTTP/1.1 400 Bad Request\r\n"), target+": "+res)
+		assert.NotContains(t, res, "nope")
+	}
+
+	// Test: Unchanged files are 304 for If-Modified-Since
+	req := newTestRequest(t, "GET", "/static/css/site.css")
+	req.Headers.Set("if-modified-since", time.Now().UTC().Add(time.Hour).Format(httpTimeFormat))
+	res = serve(t, r.ServeRequest, req)
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 304 Not Modified\r\n"), res)
+	req = newTestRequest(t, "GET", "/static/css/site.css")
+	req.Headers.Set("if-modified-since", "Mon, 02 Jan 2006 15:04:05 GMT")
+	assert.Equal(t, "body{}", body(serve(t, r.ServeRequest, req)))
+
+	// Test: HEAD sends headers only
+	res = route(t, r, "HEAD", "/static/css/site.css")
+	assert.Contains(t, res, "content-length: 6\r\n")
+	assert.Equal(t, "", body(res))
+
+	// Test: Other methods are not allowed
+	res = route(t, r, "POST", "/static/css/site.css")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 405 Method Not Allowed\r\n"), res)
+	assert.Contains(t, res, "allow: GET, HEAD\r\n")
+}
+
+func TestFileServerListing(t *testing.T) {
+	root := writeTree(t, map[string]string{
+		"docs/b.txt":        "b",
+		"docs/<a>.txt":      "a",
+		"docs/sub/c.txt":    "c",
+		"docs/with:colon":   "d",
+		"docs/sub/deep.txt": "e",
+	})
+	fsrv := &FileServer{Root: root, Listing: true}
+
+	// Test: Directories are listed by name with escaped links
+	res := serve(t, fsrv.ServeRequest, newTestRequest(t, "GET", "/docs/"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"), res)
+	assert.Contains(t, res, "content-type: text/html; charset=utf-8\r\n")
+	listing := body(res)
+	assert.Contains(t, listing, "<title>Index of /docs/</title>")
+	assert.Contains(t, listing, `<li><a href="../">../</a></li>`)
+	assert.Contains(t, listing, `<li><a href="./%3Ca%3E.txt">&lt;a&gt;.txt</a></li>`)
+	assert.Contains(t, listing, `<li><a href="./sub/">sub/</a></li>`)
+	assert.Contains(t, listing, `<li><a href="./with:colon">with:colon</a></li>`)
+	assert.Less(t, strings.Index(listing, "&lt;a&gt;.txt"), strings.Index(listing, "b.txt"))
+
+	// Test: The root has no parent link
+	assert.NotContains(t, body(serve(t, fsrv.ServeRequest, newTestRequest(t, "GET", "/"))), `href="../"`)
+}
+
+func TestFileServerStreaming(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "big.bin"), big, 0o644))
+	_, addr := startServer(t, (&FileServer{Root: root}).ServeRequest)
+
+	// Test: A large file arrives whole over a kept-alive connection
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for range 2 {
+		_, err = io.WriteString(conn, "GET /big.bin HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		head, got := readResponse(t, br)
+		assert.Contains(t, head, "content-type: application/octet-stream\r\n")
+		assert.Equal(t, len(big), len(got))
+		assert.True(t, bytes.Equal(big, []byte(got)))
+	}
+
+	// Test: ServeFile serves one file and 404s when it is missing
+	res := serve(t, func(w *response.Writer, req *request.Request) {
+		ServeFile(w, req, filepath.Join(root, "big.bin"))
+	}, newTestRequest(t, "HEAD", "/anything"))
+	assert.Contains(t, res, "content-length: 1048576\r\n")
+	res = serve(t, func(w *response.Writer, req *request.Request) {
+		ServeFile(w, req, filepath.Join(root, "gone.bin"))
+	}, newTestRequest(t, "GET", "/anything"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), res)
+}
+
+// sendfileListener records what each accepted connection is asked to read
+// from, which is what decides whether the kernel can send it directly.
+type sendfileListener struct {
+	net.Listener
+	sources chan io.Reader
+}
+
+func (l sendfileListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sendfileConn{c.(*net.TCPConn), l.sources}, nil
+}
+
+type sendfileConn struct {
+	*net.TCPConn
+	sources chan io.Reader
+}
+
+func (c *sendfileConn) ReadFrom(r io.Reader) (int64, error) {
+	c.sources <- r
+	return c.TCPConn.ReadFrom(r)
+}
+
+func TestFileServerSendfile(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "big.bin"), big, 0o644))
+	files := &FileServer{Root: root}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	sources := make(chan io.Reader, 4)
+	s := ServeListener(sendfileListener{l, sources}, func(w *response.Writer, req *request.Request) {
+		if req.Headers["x-hooked"] != "" {
+			w = response.Wrap(w, response.Hooks{Write: func(p []byte) {}})
+		}
+		files.ServeRequest(w, req)
+	})
+	t.Cleanup(func() { s.Close() })
+	addr := l.Addr().String()
+	get := func(hooked bool) string {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		raw := "GET /big.bin HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n"
+		if hooked {
+			raw += "X-Hooked: 1\r\n"
+		}
+		_, err = io.WriteString(conn, raw+"\r\n")
+		require.NoError(t, err)
+		_, body := readResponse(t, bufio.NewReader(conn))
+		return body
+	}
+
+	// Test: On plain TCP the file itself reaches the connection, so it can
+	// go out with sendfile
+	assert.True(t, bytes.Equal(big, []byte(get(false))))
+	src := <-sources
+	lr, ok := src.(*io.LimitedReader)
+	require.True(t, ok, "%T", src)
+	assert.IsType(t, &os.File{}, lr.R)
+
+	// Test: A middleware watching the body gets a copy, so the file can't
+	// bypass user space
+	assert.True(t, bytes.Equal(big, []byte(get(true))))
+	src = <-sources
+	_, ok = src.(*io.LimitedReader)
+	assert.False(t, ok, "%T", src)
+}
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"html doctype", "  <!DOCTYPE html><html>", "text/html; charset=utf-8"},
+		{"html tag", "<p>hi</p>", "text/html; charset=utf-8"},
+		{"not html", "<pre>x</pre>", "text/plain; charset=utf-8"},
+		{"xml", "<?xml version=\"1.0\"?>", "text/xml; charset=utf-8"},
+		{"pdf", "%PDF-1.7", "application/pdf"},
+		{"mp4", "\x00\x00\x00\x18ftypmp42", "video/mp4"},
+		{"gzip", "\x1f\x8b\x08\x00", "application/gzip"},
+		{"utf-8 text", "héllo wörld\n", "text/plain; charset=utf-8"},
+		{"binary", "\x00\x01\x02\x03", "application/octet-stream"},
+		{"empty", "", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, detectContentType([]byte(tt.data)))
+		})
+	}
+
+	// Test: A multi-byte rune cut off at the sniff limit is still text
+	text := strings.Repeat("a", sniffLen-1) + "é"
+	assert.Equal(t, "text/plain; charset=utf-8", detectContentType([]byte(text)))
+}
+
+//go:embed testdata/site
+var embeddedSite embed.FS
+
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(s))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.String()
+}
+
+// unseekableFS hides Seek on its files, as some fs.FS implementations do.
+type unseekableFS struct {
+	fs.FS
+}
+
+func (u unseekableFS) Open(name string) (fs.File, error) {
+	f, err := u.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ fs.File }{f}, nil
+}
+
+func TestFileServerFS(t *testing.T) {
+	js := "console.log('hello');"
+	fsys := fstest.MapFS{
+		"index.html":   {Data: []byte("<p>index</p>")},
+		"app.js":       {Data: []byte(js)},
+		"app.js.gz":    {Data: []byte(gzipped(t, js))},
+		"notes":        {Data: []byte("plain notes")},
+		"notes.gz":     {Data: []byte(gzipped(t, "plain notes"))},
+		"data/raw.bin": {Data: []byte("\x00\x01binary")},
+	}
+	pages := StatusPages{response.StatusNotFound: "<h1>custom missing</h1>"}
+	fsrv := &FileServer{FS: fsys, Precompressed: true, Pages: pages}
+	get := func(target, acceptEncoding string) string {
+		req := newTestRequest(t, "GET", target)
+		if acceptEncoding != "" {
+			req.Headers.Set("accept-encoding", acceptEncoding)
+		}
+		return serve(t, fsrv.ServeRequest, req)
+	}
+
+	// Test: Any fs.FS can be served
+	assert.Equal(t, "<p>index</p>", body(get("/", "")))
+
+	// Test: The .gz sibling is sent to clients that accept gzip
+	res := get("/app.js", "deflate, gzip;q=0.8")
+	assert.Contains(t, res, "content-encoding: gzip\r\n")
+	assert.Contains(t, res, "content-type: text/javascript; charset=utf-8\r\n")
+	assert.Contains(t, res, "vary: accept-encoding\r\n")
+	assert.Equal(t, gzipped(t, js), body(res))
+
+	// Test: Other clients get the original, still marked as varying
+	for _, accept := range []string{"", "gzip;q=0", "br", "*;q=0"} {
+		res = get("/app.js", accept)
+		assert.NotContains(t, res, "content-encoding", accept)
+		assert.Contains(t, res, "vary: accept-encoding\r\n", accept)
+		assert.Equal(t, js, body(res), accept)
+	}
+	assert.Contains(t, get("/app.js", "*"), "content-encoding: gzip\r\n")
+
+	// Test: A compressed file without an extension keeps the original's sniffed type
+	res = get("/notes", "gzip")
+	assert.Contains(t, res, "content-type: text/plain; charset=utf-8\r\n")
+	assert.Contains(t, res, "content-encoding: gzip\r\n")
+
+	// Test: Files without a sibling are unaffected
+	res = get("/index.html", "gzip")
+	assert.NotContains(t, res, "content-encoding")
+	assert.NotContains(t, res, "vary")
+
+	// Test: Precompressed serving is opt-in
+	plain := &FileServer{FS: fsys}
+	assert.Equal(t, js, body(serve(t, plain.ServeRequest, newTestRequest(t, "GET", "/app.js"))))
+
+	// Test: Error pages come from Pages
+	res = get("/missing.js", "")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), res)
+	assert.Equal(t, "<h1>custom missing</h1>", body(res))
+	assert.Equal(t, BadRequestHTML, body(get("/%zz", "")))
+
+	// Test: Files that can't seek are sniffed without losing their start
+	unseekable := &FileServer{FS: unseekableFS{fsys}}
+	res = serve(t, unseekable.ServeRequest, newTestRequest(t, "GET", "/data/raw.bin"))
+	assert.Contains(t, res, "content-type: application/octet-stream\r\n")
+	assert.Equal(t, "\x00\x01binary", body(res))
+}
+
+func TestFileServerEmbed(t *testing.T) {
+	site, err := fs.Sub(embeddedSite, "testdata/site")
+	require.NoError(t, err)
+	pages, err := LoadStatusPages(site)
+	require.NoError(t, err)
+	fsrv := &FileServer{FS: site, Precompressed: true, Pages: pages}
+
+	// Test: Assets compiled in with embed.FS are served
+	res := serve(t, fsrv.ServeRequest, newTestRequest(t, "GET", "/"))
+	assert.Contains(t, body(res), "Served from the binary")
+
+	req := newTestRequest(t, "GET", "/css/site.css")
+	req.Headers.Set("accept-encoding", "gzip")
+	res = serve(t, fsrv.ServeRequest, req)
+	assert.Contains(t, res, "content-encoding: gzip\r\n")
+	assert.Contains(t, res, "content-type: text/css; charset=utf-8\r\n")
+	zr, err := gzip.NewReader(strings.NewReader(body(res)))
+	require.NoError(t, err)
+	css, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, "body { margin: 0; }\n", string(css))
+
+	// Test: Embedded error pages replace the built-in ones
+	res = serve(t, fsrv.ServeRequest, newTestRequest(t, "GET", "/nope"))
+	assert.Contains(t, body(res), "Nothing here")
+}
+
+func TestStatusPages(t *testing.T) {
+	pages, err := LoadStatusPages(fstest.MapFS{
+		"200.html":      {Data: []byte("ok page")},
+		"503.html":      {Data: []byte("busy page")},
+		"style.css":     {Data: []byte("ignored")},
+		"1000.html":     {Data: []byte("ignored")},
+		"404.html/x":    {Data: []byte("ignored")},
+		"sub/500.html":  {Data: []byte("ignored")},
+		"readme.html":   {Data: []byte("ignored")},
+		"600.html":      {Data: []byte("ignored")},
+		"nested/a.html": {Data: []byte("ignored")},
+	})
+	require.NoError(t, err)
+
+	// Test: Only files named after a status code are loaded
+	assert.Equal(t, StatusPages{response.StatusOK: "ok page", response.StatusServiceUnavailable: "busy page"}, pages)
+
+	// Test: Handler sends the page with its status
+	res := serve(t, pages.Handler(response.StatusServiceUnavailable), newTestRequest(t, "GET", "/"))
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 503 Service Unavailable\r\n"), res)
+	assert.Contains(t, res, "content-type: text/html\r\n")
+	assert.Equal(t, "busy page", body(res))
+
+	// Test: Codes without a page fall back to the built-in one
+	assert.Equal(t, BadRequestHTML, body(serve(t, pages.Handler(response.StatusBadRequest), newTestRequest(t, "GET", "/"))))
+	assert.Contains(t, body(serve(t, pages.Handler(response.StatusNotModified), newTestRequest(t, "GET", "/"))), "304 Not Modified")
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// ForwardProxy lets clients reach other hosts through the server, the
+// way curl -x or HTTP_PROXY use it. A request whose target is a whole URL
+// is sent on to the host it names, and CONNECT host:port opens a tunnel
+// that bytes are copied through both ways, which is how HTTPS gets
+// through. Other requests are left to the wrapped handler:
+//
+//	proxy := &server.ForwardProxy{Allow: []string{"*.example.com:443"}}
+//	router.Use(proxy.Middleware)
+type ForwardProxy struct {
+	// Allow lists the destinations clients may reach as host:port
+	// patterns. A host of "*" matches any host and "*.example.com" any
+	// subdomain; a port of "*", or no port at all, matches any port. An
+	// empty list allows nothing, so an open proxy has to ask for "*:*",
+	// which is only safe on loopback.
+	Allow []string
+	// Authenticate checks the Basic credentials in Proxy-Authorization.
+	// If nil, none are asked for.
+	Authenticate func(user, password string) bool
+	// Realm is named in the challenge sent with a 407.
+	Realm string
+	// Timeout limits connecting to a destination and waiting for its
+	// response headers, and defaults to 30 seconds.
+	Timeout time.Duration
+	// Client forwards requests. It defaults to the client shared with
+	// ReverseProxy.
+	Client *client.Client
+	// Pages replaces the built-in error pages.
+	Pages    StatusPages
+	ErrorLog *log.Logger
+}
+
+// Middleware serves proxy requests and passes the rest to next, so
+// proxying can sit in front of a router with Router.Use.
+func (p *ForwardProxy) Middleware(next Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.Method == "CONNECT" || req.IsAbsoluteForm() {
+			p.ServeRequest(w, req)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// ServeRequest answers CONNECT and absolute-form requests, and any other
+// request with a 400.
+func (p *ForwardProxy) ServeRequest(w *response.Writer, req *request.Request) {
+	if !p.authorized(req) {
+		h := headers.NewHeaders()
+		h.Set("proxy-authenticate", "Basic realm="+strconv.Quote(p.realm()))
+		p.Pages.write(w, response.StatusProxyAuthRequired, h)
+		return
+	}
+	if req.RequestLine.Method == "CONNECT" {
+		p.tunnel(w, req)
+		return
+	}
+
+	u, err := url.Parse(req.RequestLine.RequestTarget)
+	if err != nil || !req.IsAbsoluteForm() || u.Scheme != "http" && u.Scheme != "https" || u.Hostname() == "" {
+		p.Pages.write(w, response.StatusBadRequest, nil)
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	if !p.allowed(u.Hostname(), port) {
+		p.logf("proxy: %s %s: destination not allowed", req.RequestLine.Method, req.RequestLine.RequestTarget)
+		p.Pages.write(w, response.StatusForbidden, nil)
+		return
+	}
+
+	// From here on it is a reverse proxy to the origin the URL names.
+	origin := &ReverseProxy{
+		Upstream: &url.URL{Scheme: u.Scheme, Host: u.Host},
+		Timeout:  p.Timeout,
+		Client:   p.Client,
+		Pages:    p.Pages,
+		ErrorLog: p.ErrorLog,
+	}
+	out := *req
+	out.RequestLine.RequestTarget = u.RequestURI()
+	origin.ServeRequest(w, &out)
+}
+
+// tunnel connects to the CONNECT target and splices the client onto it.
+func (p *ForwardProxy) tunnel(w *response.Writer, req *request.Request) {
+	addr := req.RequestLine.RequestTarget
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		p.Pages.write(w, response.StatusBadRequest, nil)
+		return
+	}
+	if !p.allowed(host, port) {
+		p.logf("proxy: CONNECT %s: destination not allowed", addr)
+		p.Pages.write(w, response.StatusForbidden, nil)
+		return
+	}
+
+	d := net.Dialer{Timeout: p.timeout(), KeepAlive: 30 * time.Second}
+	upstream, err := d.Dial("tcp", addr)
+	if err != nil {
+		p.logf("proxy: CONNECT %s: %v", addr, err)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			p.Pages.write(w, response.StatusGatewayTimeout, nil)
+			return
+		}
+		p.Pages.write(w, response.StatusBadGateway, nil)
+		return
+	}
+	// Hijack before answering: over HTTP/2 there is no connection to take
+	// and the client is better off with an error than a dead tunnel.
+	conn, rw, err := w.Hijack()
+	if err != nil {
+		upstream.Close()
+		p.logf("proxy: CONNECT %s: %v", addr, err)
+		p.Pages.write(w, response.StatusBadGateway, nil)
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		conn.Close()
+		upstream.Close()
+		return
+	}
+	splice(conn, rw.Reader, upstream)
+}
+
+// splice copies bytes between the client and upstream until both have
+// finished sending. The client's side is read through br, which may
+// already hold bytes sent right after the CONNECT, such as a TLS hello.
+func splice(conn net.Conn, br *bufio.Reader, upstream net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst net.Conn, src io.Reader) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		// Pass a clean end on as a half-close so the other direction can
+		// finish. Anything else brings the whole tunnel down.
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && err == nil && cw.CloseWrite() == nil {
+			return
+		}
+		conn.Close()
+		upstream.Close()
+	}
+	go pipe(upstream, br)
+	go pipe(conn, upstream)
+	wg.Wait()
+	conn.Close()
+	upstream.Close()
+}
+
+// authorized checks the Basic credentials in Proxy-Authorization.
+func (p *ForwardProxy) authorized(req *request.Request) bool {
+	if p.Authenticate == nil {
+		return true
+	}
+	scheme, encoded, ok := strings.Cut(strings.TrimSpace(req.Headers["proxy-authorization"]), " ")
+	if !ok || !strings.EqualFold(scheme, "basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	return ok && p.Authenticate(user, password)
+}
+
+// allowed matches a destination against the Allow patterns.
+func (p *ForwardProxy) allowed(host, port string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.Allow {
+		patternHost, patternPort, err := net.SplitHostPort(pattern)
+		if err != nil {
+			patternHost, patternPort = pattern, "*"
+		}
+		if patternPort != "*" && patternPort != port {
+			continue
+		}
+		patternHost = strings.ToLower(patternHost)
+		switch {
+		case patternHost == "*", patternHost == host:
+			return true
+		case strings.HasPrefix(patternHost, "*.") && strings.HasSuffix(host, patternHost[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ForwardProxy) realm() string {
+	if p.Realm != "" {
+		return p.Realm
+	}
+	return "proxy"
+}
+
+func (p *ForwardProxy) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return defaultProxyTimeout
+}
+
+func (p *ForwardProxy) logf(format string, args ...any) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
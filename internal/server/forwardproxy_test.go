@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardProxy(t *testing.T) {
+	received := make(chan *request.Request, 1)
+	_, upstream := startServer(t, func(w *response.Writer, req *request.Request) {
+		received <- req
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("content-length", "8")
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("upstream"))
+	})
+	p := &ForwardProxy{Allow: []string{"*:*"}, ErrorLog: log.New(io.Discard, "", 0)}
+	_, addr := startServer(t, p.Middleware(reply("local")))
+
+	// Test: Absolute-form requests go to the host in the URL as origin-form
+	_, br := sendRequest(t, addr, "GET http://"+upstream+"/items?x=1 HTTP/1.1\r\nHost: "+upstream+
+		"\r\nProxy-Connection: keep-alive\r\nConnection: close\r\n\r\n")
+	head, body := readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), head)
+	assert.Equal(t, "upstream", body)
+	req := <-received
+	assert.Equal(t, "/items?x=1", req.RequestLine.RequestTarget)
+	assert.Equal(t, upstream, req.Headers["host"])
+	assert.NotContains(t, req.Headers, "proxy-connection")
+
+	// Test: Other requests reach the wrapped handler
+	_, br = sendRequest(t, addr, requestMessage("GET", "/"))
+	_, body = readResponse(t, br)
+	assert.Equal(t, "local", body)
+
+	// Test: A target the proxy can't forward is a 400
+	_, br = sendRequest(t, addr, "GET ftp://example.com/file HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	head, _ = readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 400 Bad Request\r\n"), head)
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Echo until the client half-closes, then say goodbye.
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+				io.WriteString(c, "bye")
+			}()
+		}
+	}()
+	target := l.Addr().String()
+	p := &ForwardProxy{Allow: []string{"*:*"}, ErrorLog: log.New(io.Discard, "", 0)}
+	_, addr := startServer(t, p.Middleware(reply("local")))
+
+	// Test: CONNECT answers 200 and then relays bytes both ways, including
+	// any sent along with the request
+	conn, br := sendRequest(t, addr, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\nearly ")
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", status)
+	blank, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", blank)
+	_, err = io.WriteString(conn, "later")
+	require.NoError(t, err)
+
+	// Test: A half-close travels through and the other side can still answer
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "early laterbye", string(rest))
+
+	// Test: An unreachable target is a 502
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := l2.Addr().String()
+	l2.Close()
+	_, br = sendRequest(t, addr, "CONNECT "+closed+" HTTP/1.1\r\nHost: "+closed+"\r\n\r\n")
+	head, _ := readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 502 Bad Gateway\r\n"), head)
+}
+
+func TestForwardProxyAccess(t *testing.T) {
+	_, upstream := startServer(t, func(w *response.Writer, req *request.Request) {
+		writeError(w, response.StatusOK, "upstream", nil)
+	})
+	_, port, err := net.SplitHostPort(upstream)
+	require.NoError(t, err)
+	upstream = "127.0.0.1:" + port
+	p := &ForwardProxy{
+		Allow:        []string{"127.0.0.1:" + port, "*.example.com:443"},
+		Authenticate: func(user, password string) bool { return user == "dev" && password == "s3cret" },
+		Realm:        "debug",
+		ErrorLog:     log.New(io.Discard, "", 0),
+	}
+	_, addr := startServer(t, p.Middleware(reply("local")))
+	get := func(target string, fields ...string) string {
+		t.Helper()
+		_, br := sendRequest(t, addr, requestMessage("GET", target, fields...))
+		head, _ := readResponse(t, br)
+		return head
+	}
+	good := "Basic " + base64.StdEncoding.EncodeToString([]byte("dev:s3cret"))
+
+	// Test: Missing or wrong credentials get a 407 with a Basic challenge
+	head := get("http://" + upstream + "/")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 407 Proxy Authentication Required\r\n"), head)
+	assert.Contains(t, head, "proxy-authenticate: Basic realm=\"debug\"\r\n")
+	head = get("http://"+upstream+"/", "Proxy-Authorization: Basic "+base64.StdEncoding.EncodeToString([]byte("dev:wrong")))
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 407 "), head)
+
+	// Test: Good credentials reach an allowed destination
+	head = get("http://"+upstream+"/", "Proxy-Authorization: "+good)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), head)
+
+	// Test: Destinations off the allow-list are forbidden, CONNECT included
+	head = get("http://localhost:"+port+"/", "Proxy-Authorization: "+good)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 403 Forbidden\r\n"), head)
+	_, br := sendRequest(t, addr, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: "+good+"\r\n\r\n")
+	head, _ = readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 403 Forbidden\r\n"), head)
+
+	// Test: Without an allow-list every destination is forbidden
+	_, closed := startServer(t, (&ForwardProxy{ErrorLog: log.New(io.Discard, "", 0)}).Middleware(reply("local")))
+	_, br = sendRequest(t, closed, "GET http://"+upstream+"/ HTTP/1.1\r\nHost: "+upstream+"\r\n\r\n")
+	head, _ = readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 403 Forbidden\r\n"), head)
+	_, br = sendRequest(t, closed, "CONNECT "+upstream+" HTTP/1.1\r\nHost: "+upstream+"\r\n\r\n")
+	head, _ = readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 403 Forbidden\r\n"), head)
+
+	// Test: Allow patterns match hosts, subdomains and ports
+	p = &ForwardProxy{Allow: []string{"example.com", "*.internal:8080", "*:443"}}
+	for _, tt := range []struct {
+		host, port string
+		want       bool
+	}{
+		{"example.com", "80", true},
+		{"Example.COM.", "9999", true},
+		{"www.example.com", "80", false},
+		{"api.internal", "8080", true},
+		{"internal", "8080", false},
+		{"api.internal", "80", false},
+		{"anything.org", "443", true},
+	} {
+		assert.Equal(t, tt.want, p.allowed(tt.host, tt.port), "%s:%s", tt.host, tt.port)
+	}
+}
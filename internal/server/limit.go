@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// OverloadMode decides what happens to a connection or request that
+// arrives while its limit is reached.
+type OverloadMode int
+
+const (
+	// OverloadBlock waits for a free slot. For connections this means
+	// not accepting, leaving clients in the listen backlog.
+	OverloadBlock OverloadMode = iota
+	// OverloadReject answers straight away with 503 and Retry-After.
+	OverloadReject
+	// OverloadQueue waits for a slot up to the queue timeout, with at
+	// most queue size waiters, and rejects like OverloadReject after.
+	OverloadQueue
+)
+
+const defaultRetryAfter = time.Second
+
+type overload struct {
+	mode         OverloadMode
+	retryAfter   time.Duration
+	queueSize    int
+	queueTimeout time.Duration
+}
+
+// limiter caps how many of something may run at once. A nil limiter
+// allows everything.
+type limiter struct {
+	slots   chan struct{}
+	waiting atomic.Int64
+}
+
+func newLimiter(n int) *limiter {
+	if n <= 0 {
+		return nil
+	}
+	return &limiter{slots: make(chan struct{}, n)}
+}
+
+// acquire takes a slot according to the overload mode and reports whether
+// it got one. Waiting stops early when done is closed.
+func (l *limiter) acquire(o overload, done <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	switch o.mode {
+	case OverloadReject:
+		return false
+	case OverloadQueue:
+		if o.queueSize > 0 && l.waiting.Add(1) > int64(o.queueSize) {
+			l.waiting.Add(-1)
+			return false
+		}
+		defer l.waiting.Add(-1)
+		var timeout <-chan time.Time
+		if o.queueTimeout > 0 {
+			timer := time.NewTimer(o.queueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case l.slots <- struct{}{}:
+			return true
+		case <-timeout:
+			return false
+		case <-done:
+			return false
+		}
+	default:
+		select {
+		case l.slots <- struct{}{}:
+			return true
+		case <-done:
+			return false
+		}
+	}
+}
+
+func (l *limiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// serveRequest runs the handler once a handler slot is free, or answers
+// 503 if the overload mode gives up waiting for one.
+func (s *Server) serveRequest(w *response.Writer, req *request.Request) {
+	// Deferred first so it sees the 500 written for a panic.
+	defer s.metrics.observe(w, req, time.Now())
+	defer s.recoverPanic(w, req)
+	w.SetErrorLog(s.errorLog)
+	if !s.handlerLimit.acquire(s.overload, s.shutdown) {
+		s.stats.rejectedRequests.Add(1)
+		s.writeUnavailable(w)
+		return
+	}
+	defer s.handlerLimit.release()
+	s.handler(w, req)
+}
+
+func (s *Server) writeUnavailable(w *response.Writer) {
+	retryAfter := s.overload.retryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	h := headers.NewHeaders()
+	h.Set("retry-after", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	writeError(w, response.StatusServiceUnavailable, ServiceUnavailableHTML, h)
+}
+
+// rejectConn turns away a connection over the limit. The request head is
+// read first so closing doesn't reset the connection under the 503.
+func (s *Server) rejectConn(rwc net.Conn) {
+	defer rwc.Close()
+	rwc.SetReadDeadline(time.Now().Add(rejectWriteTimeout))
+	request.HeadersFromReader(bufio.NewReader(rwc))
+	rwc.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	s.writeUnavailable(response.New(rwc))
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"httpfromtcp/internal/metrics"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// sizeBuckets go from 64B to 16MiB in powers of four.
+var sizeBuckets = metrics.ExponentialBuckets(64, 4, 10)
+
+type serverMetrics struct {
+	accepted     *metrics.Counter
+	active       *metrics.Gauge
+	requests     *metrics.CounterVec
+	requestSize  *metrics.HistogramVec
+	responseSize *metrics.HistogramVec
+	duration     *metrics.HistogramVec
+	parseErrors  *metrics.CounterVec
+}
+
+// WithMetrics registers the server's metrics in reg and keeps them up to
+// date. Serve reg.ServeRequest to expose them. Requests are labelled with
+// the route pattern rather than the path, so only requests that went
+// through a Router have a route.
+func WithMetrics(reg *metrics.Registry) Option {
+	m := &serverMetrics{
+		accepted: reg.NewCounter("http_connections_accepted_total",
+			"Connections accepted."),
+		active: reg.NewGauge("http_connections_active",
+			"Connections currently open."),
+		requests: reg.NewCounterVec("http_requests_total",
+			"Requests served.", "method", "route", "status"),
+		requestSize: reg.NewHistogramVec("http_request_size_bytes",
+			"Request body sizes.", sizeBuckets, "method", "route"),
+		responseSize: reg.NewHistogramVec("http_response_size_bytes",
+			"Response body sizes.", sizeBuckets, "method", "route"),
+		duration: reg.NewHistogramVec("http_request_duration_seconds",
+			"Time spent in handlers.", nil, "method", "route"),
+		parseErrors: reg.NewCounterVec("http_request_parse_errors_total",
+			"Requests that could not be parsed, by kind.", "type"),
+	}
+	return func(s *Server) { s.metrics = m }
+}
+
+func (m *serverMetrics) observe(w *response.Writer, req *request.Request, start time.Time) {
+	if m == nil {
+		return
+	}
+	method, route := metricMethod(req.RequestLine.Method), req.Pattern
+	status := strconv.Itoa(int(w.StatusCode()))
+	m.requests.With(method, route, status).Inc()
+	size := int64(len(req.Body))
+	if b, ok := req.BodyReader.(*streamedBody); ok {
+		size = b.n
+	}
+	m.requestSize.With(method, route).Observe(float64(size))
+	m.responseSize.With(method, route).Observe(float64(w.BytesWritten()))
+	m.duration.With(method, route).Observe(time.Since(start).Seconds())
+}
+
+// metricMethod folds methods outside RFC 9110 and PATCH into "OTHER",
+// since the parser accepts any token and each would add a series.
+func metricMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH":
+		return method
+	}
+	return "OTHER"
+}
+
+func (m *serverMetrics) connAccepted() {
+	if m != nil {
+		m.accepted.Inc()
+	}
+}
+
+func (m *serverMetrics) connOpened() {
+	if m != nil {
+		m.active.Inc()
+	}
+}
+
+func (m *serverMetrics) connClosed() {
+	if m != nil {
+		m.active.Dec()
+	}
+}
+
+// parseError counts a request the server couldn't read, before or after
+// the headers.
+func (m *serverMetrics) parseError(err error, inBody bool) {
+	if m == nil {
+		return
+	}
+	kind := "malformed"
+	switch {
+	case isTimeout(err) && inBody:
+		kind = "body_timeout"
+	case isTimeout(err):
+		kind = "header_timeout"
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		kind = "too_large"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		kind = "truncated"
+	}
+	m.parseErrors.With(kind).Inc()
+}
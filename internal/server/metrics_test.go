@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/metrics"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	r := NewRouter()
+	r.Get("/users/{id}", reply("user"))
+	r.Post("/users/{id}", reply("updated"))
+	r.Get("/metrics", reg.ServeRequest)
+	r.Get("/panic", func(w *response.Writer, req *request.Request) { panic("boom") })
+	release := make(chan struct{})
+	r.Get("/hijack", func(w *response.Writer, req *request.Request) {
+		conn, _, err := w.Hijack()
+		if err != nil {
+			return
+		}
+		go func() {
+			<-release
+			conn.Close()
+		}()
+	})
+	s, addr := startServer(t, r.ServeRequest, WithMetrics(reg), WithReadTimeout(200*time.Millisecond),
+		WithErrorLog(log.New(io.Discard, "", 0)))
+
+	scrape := func() string {
+		_, br := sendRequest(t, addr, requestMessage("GET", "/metrics"))
+		_, body := readResponse(t, br)
+		return body
+	}
+
+	// Test: Requests are counted by method, route pattern and status
+	for _, target := range []string{"/users/1", "/users/2", "/missing"} {
+		_, br := sendRequest(t, addr, requestMessage("GET", target))
+		readResponse(t, br)
+	}
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST /users/1 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 300\r\nConnection: close\r\n\r\n"+strings.Repeat("x", 300))
+	require.NoError(t, err)
+	readResponse(t, bufio.NewReader(conn))
+	_, br := sendRequest(t, addr, requestMessage("GET", "/panic"))
+	readResponse(t, br)
+
+	out := scrape()
+	assert.Contains(t, out, `http_requests_total{method="GET",route="/users/{id}",status="200"} 2`+"\n")
+	assert.Contains(t, out, `http_requests_total{method="GET",route="",status="404"} 1`+"\n")
+	assert.Contains(t, out, `http_requests_total{method="POST",route="/users/{id}",status="200"} 1`+"\n")
+	assert.Contains(t, out, `http_requests_total{method="GET",route="/panic",status="500"} 1`+"\n")
+
+	// Test: Body sizes and durations land in histograms
+	assert.Contains(t, out, `http_request_size_bytes_bucket{method="POST",route="/users/{id}",le="256"} 0`+"\n")
+	assert.Contains(t, out, `http_request_size_bytes_bucket{method="POST",route="/users/{id}",le="1024"} 1`+"\n")
+	assert.Contains(t, out, `http_response_size_bytes_sum{method="GET",route="/users/{id}"} 18`+"\n")
+	assert.Contains(t, out, `http_request_duration_seconds_count{method="GET",route="/users/{id}"} 2`+"\n")
+
+	// Test: Connections accepted and currently open
+	assert.Contains(t, out, "http_connections_accepted_total 6\n")
+	assert.Contains(t, out, "http_connections_active 1\n")
+
+	// Test: Parse errors are counted by kind
+	for _, raw := range []string{
+		"NOT A REQUEST\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nshort",
+	} {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		io.WriteString(conn, raw)
+		if strings.Contains(raw, "short") {
+			conn.(*net.TCPConn).CloseWrite()
+		}
+		io.ReadAll(conn)
+		conn.Close()
+	}
+	slow, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	io.WriteString(slow, "GET / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nabc")
+	io.ReadAll(slow)
+	slow.Close()
+
+	out = scrape()
+	assert.Contains(t, out, `http_request_parse_errors_total{type="malformed"} 1`+"\n")
+	assert.Contains(t, out, `http_request_parse_errors_total{type="truncated"} 1`+"\n")
+	assert.Contains(t, out, `http_request_parse_errors_total{type="body_timeout"} 1`+"\n")
+	assert.Equal(t, uint64(1), s.Stats().ReadTimeouts)
+
+	// Test: Unknown methods share one label instead of adding series
+	for _, method := range []string{"BREW", "WHEN"} {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		io.WriteString(conn, method+" /users/1 HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		readResponse(t, bufio.NewReader(conn))
+		conn.Close()
+	}
+	out = scrape()
+	assert.Contains(t, out, `http_requests_total{method="OTHER",route="",status="405"} 2`+"\n")
+	assert.NotContains(t, out, `method="BREW"`)
+
+	// Test: A hijacked connection counts as active until it is closed,
+	// not just until its handler returns
+	active := func() string {
+		for _, line := range strings.Split(scrape(), "\n") {
+			if v, ok := strings.CutPrefix(line, "http_connections_active "); ok {
+				return v
+			}
+		}
+		return ""
+	}
+	require.Eventually(t, func() bool { return active() == "1" }, time.Second, 5*time.Millisecond)
+	sendRequest(t, addr, requestMessage("GET", "/hijack"))
+	require.Eventually(t, func() bool { return active() == "2" }, time.Second, 5*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, "2", active())
+	close(release)
+	require.Eventually(t, func() bool { return active() == "1" }, time.Second, 5*time.Millisecond)
+}
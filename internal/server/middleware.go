@@ -0,0 +1,22 @@
+package server
+
+// Middleware wraps a Handler to run code around it, e.g. to log, check
+// credentials or alter the response via response.Wrap.
+type Middleware func(next Handler) Handler
+
+// Chain wraps handler in middleware. The first middleware is outermost
+// and so sees the request first and the response last.
+func Chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Compose combines several middleware into one, applied in the same order
+// as Chain.
+func Compose(middleware ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		return Chain(next, middleware...)
+	}
+}
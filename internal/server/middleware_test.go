@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRequest(t *testing.T, method, target string) *request.Request {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+// serve runs h on req and returns the raw response it wrote.
+func serve(t *testing.T, h Handler, req *request.Request) string {
+	t.Helper()
+	var buf bytes.Buffer
+	h(response.New(&buf), req)
+	return buf.String()
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				calls = append(calls, name+" in")
+				next(w, req)
+				calls = append(calls, name+" out")
+			}
+		}
+	}
+	h := func(w *response.Writer, req *request.Request) {
+		calls = append(calls, "handler")
+	}
+
+	// Test: First middleware is outermost
+	Chain(h, trace("a"), trace("b"))(nil, nil)
+	assert.Equal(t, []string{"a in", "b in", "handler", "b out", "a out"}, calls)
+
+	// Test: Compose keeps the same order
+	calls = nil
+	Chain(h, Compose(trace("a"), trace("b")), trace("c"))(nil, nil)
+	assert.Equal(t, []string{"a in", "b in", "c in", "handler", "c out", "b out", "a out"}, calls)
+
+	// Test: Middleware can short-circuit
+	calls = nil
+	deny := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			calls = append(calls, "deny")
+		}
+	}
+	Chain(h, trace("a"), deny, trace("b"))(nil, nil)
+	assert.Equal(t, []string{"a in", "deny", "a out"}, calls)
+}
+
+func TestWrappedWriterObservesResponse(t *testing.T) {
+	var status response.StatusCode
+	var seen bytes.Buffer
+	var recorded *response.Writer
+	observe := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			recorded = response.Wrap(w, response.Hooks{
+				WriteHeaders: func(statusCode response.StatusCode, h headers.Headers) {
+					status = statusCode
+					h.Set("x-observed", "yes")
+				},
+				Write: func(p []byte) { seen.Write(p) },
+			})
+			next(recorded, req)
+		}
+	}
+
+	r := NewRouter()
+	r.Use(observe)
+	r.Get("/fixed", func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(5))
+		w.WriteBody([]byte("hello"))
+	})
+	r.Get("/chunked", func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("transfer-encoding", "chunked")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("abc"))
+		w.WriteChunkedBody([]byte("defg"))
+		w.WriteChunkedBodyDone()
+		w.WriteTrailers(headers.NewHeaders())
+	})
+
+	// Test: Status, headers and body bytes are visible to the middleware
+	var buf bytes.Buffer
+	r.ServeRequest(response.New(&buf), newTestRequest(t, "GET", "/fixed"))
+	assert.Equal(t, response.StatusOK, status)
+	assert.Equal(t, response.StatusOK, recorded.StatusCode())
+	assert.Equal(t, "5", recorded.Headers()["content-length"])
+	assert.Equal(t, int64(5), recorded.BytesWritten())
+	assert.Equal(t, "hello", seen.String())
+
+	// Test: Headers changed by a hook reach the client
+	assert.Contains(t, buf.String(), "x-observed: yes\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello"))
+
+	// Test: Chunked bodies are counted without their framing
+	seen.Reset()
+	buf.Reset()
+	r.ServeRequest(response.New(&buf), newTestRequest(t, "GET", "/chunked"))
+	assert.Equal(t, int64(7), recorded.BytesWritten())
+	assert.Equal(t, "abcdefg", seen.String())
+	assert.True(t, strings.HasSuffix(buf.String(), "3\r\nabc\r\n4\r\ndefg\r\n0\r\n\r\n"), buf.String())
+
+	// Test: Middleware also sees responses the router writes itself
+	buf.Reset()
+	r.ServeRequest(response.New(&buf), newTestRequest(t, "GET", "/missing"))
+	assert.Equal(t, response.StatusNotFound, recorded.StatusCode())
+	assert.Equal(t, int64(len(NotFoundHTML)), recorded.BytesWritten())
+
+	// Test: Wrapped writers cannot hijack a connection that doesn't allow it
+	_, _, err := response.Wrap(response.New(&buf), response.Hooks{}).Hijack()
+	assert.ErrorIs(t, err, response.ErrNotHijackable)
+}
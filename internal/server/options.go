@@ -0,0 +1,83 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"httpfromtcp/internal/request"
+)
+
+// Option configures a Server when it is created by Serve.
+type Option func(*Server)
+
+// WithReadHeaderTimeout limits how long a client may take to send the
+// request line and headers. It defaults to the read timeout.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) { s.readHeaderTimeout = d }
+}
+
+// WithReadTimeout limits how long a client may take to send a whole
+// request, body included.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Server) { s.readTimeout = d }
+}
+
+// WithWriteTimeout limits how long a response may take to write, counted
+// from the end of the request.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) { s.writeTimeout = d }
+}
+
+// WithIdleTimeout limits how long a keep-alive connection may wait for
+// its next request. It defaults to the read timeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) { s.idleTimeout = d }
+}
+
+// WithMaxConns caps the number of open connections. Zero means no limit.
+func WithMaxConns(n int) Option {
+	return func(s *Server) { s.connLimit = newLimiter(n) }
+}
+
+// WithMaxHandlers caps the number of handlers running at once across
+// all connections. Zero means no limit.
+func WithMaxHandlers(n int) Option {
+	return func(s *Server) { s.handlerLimit = newLimiter(n) }
+}
+
+// WithOverload picks what happens when a limit is reached. The default
+// is OverloadBlock.
+func WithOverload(mode OverloadMode) Option {
+	return func(s *Server) { s.overload.mode = mode }
+}
+
+// WithQueue switches to OverloadQueue, letting at most size waiters
+// (zero for any number) wait up to timeout for a slot.
+func WithQueue(size int, timeout time.Duration) Option {
+	return func(s *Server) {
+		s.overload.mode = OverloadQueue
+		s.overload.queueSize = size
+		s.overload.queueTimeout = timeout
+	}
+}
+
+// WithRetryAfter sets the Retry-After sent with 503 responses when
+// overloaded. It defaults to one second.
+func WithRetryAfter(d time.Duration) Option {
+	return func(s *Server) { s.overload.retryAfter = d }
+}
+
+// WithErrorLog sends errors the server can't hand to anyone else, such as
+// failed accepts, to l instead of the standard logger.
+func WithErrorLog(l *log.Logger) Option {
+	return func(s *Server) { s.errorLog = l }
+}
+
+// WithStreamedBodies leaves the body of each HTTP/1 request that match
+// selects unread, for the handler to read from Request.BodyReader as it
+// arrives, instead of reading it into Request.Body first. match sees the
+// request line and headers only. Whatever the handler leaves unread is
+// discarded afterwards, up to a limit past which the connection closes.
+func WithStreamedBodies(match func(req *request.Request) bool) Option {
+	return func(s *Server) { s.streamBody = match }
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strconv"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// StatusPages maps status codes to the HTML sent with them, so the pages
+// can come from asset files instead of the built-in constants.
+type StatusPages map[response.StatusCode]string
+
+var defaultPages = StatusPages{
+	response.StatusOK:                  SuccessHTML,
+	response.StatusBadRequest:          BadRequestHTML,
+	response.StatusNotFound:            NotFoundHTML,
+	response.StatusMethodNotAllowed:    MethodNotAllowedHTML,
+	response.StatusRequestTimeout:      RequestTimeoutHTML,
+	response.StatusInternalServerError: ServerErrorHTML,
+	response.StatusServiceUnavailable:  ServiceUnavailableHTML,
+}
+
+var pageName = regexp.MustCompile(`^([1-5][0-9][0-9])\.html$`)
+
+// LoadStatusPages reads the files at the top of fsys named after a status
+// code, such as 404.html.
+func LoadStatusPages(fsys fs.FS) (StatusPages, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	pages := StatusPages{}
+	for _, e := range entries {
+		m := pageName.FindStringSubmatch(e.Name())
+		if m == nil || e.IsDir() {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, fmt.Errorf("server: loading %s: %w", e.Name(), err)
+		}
+		code, _ := strconv.Atoi(m[1])
+		pages[response.StatusCode(code)] = string(data)
+	}
+	return pages, nil
+}
+
+// Handler answers every request with the page for code.
+func (p StatusPages) Handler(code response.StatusCode) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		p.write(w, code, nil)
+	}
+}
+
+// write sends the page for code, falling back to the built-in one.
+func (p StatusPages) write(w *response.Writer, code response.StatusCode, extra headers.Headers) {
+	page, ok := p[code]
+	if !ok {
+		page, ok = defaultPages[code]
+	}
+	if !ok {
+		page = fmt.Sprintf("<html>\n  <head>\n    <title>%d %s</title>\n  </head>\n</html>", code, response.StatusText(code))
+	}
+	writeError(w, code, page, extra)
+}
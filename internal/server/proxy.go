@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+const defaultProxyTimeout = 30 * time.Second
+
+// hopHeaders describe a single connection rather than the message, so a
+// proxy must not pass them on. Any header named in Connection is dropped
+// along with them.
+var hopHeaders = []string{
+	"connection",
+	"keep-alive",
+	"proxy-connection",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+var defaultProxyClient = &client.Client{
+	DialTimeout:         defaultProxyTimeout,
+	MaxIdleConnsPerHost: 32,
+}
+
+// ReverseProxy forwards requests to Upstream and streams its responses
+// back, status and headers included. A request body the server left
+// unread, as WithStreamedBodies arranges, is streamed upstream as it
+// arrives; otherwise it is sent from Request.Body once read in full. To
+// proxy everything below a path, route a wildcard to it and set Prefix:
+//
+//	api := &server.ReverseProxy{Upstream: upstream, Prefix: "/api"}
+//	router.Handle("GET", "/api/{path...}", api.ServeRequest)
+//	srv, err := server.Serve(8080, router.ServeRequest,
+//		server.WithStreamedBodies(func(req *request.Request) bool {
+//			return strings.HasPrefix(req.Path(), "/api/")
+//		}))
+type ReverseProxy struct {
+	// Upstream is where requests are sent. Its path, if any, goes in
+	// front of the request path.
+	Upstream *url.URL
+	// Pool spreads requests over several upstreams in place of Upstream.
+	Pool *Pool
+	// Prefix is removed from the request path before forwarding.
+	Prefix string
+	// PreserveHost sends the client's Host header upstream instead of
+	// the upstream's own host.
+	PreserveHost bool
+	// Timeout limits how long to wait for the upstream to connect and
+	// send its response headers, and defaults to 30 seconds. While a
+	// streamed request body is sent, it restarts with each read from the
+	// client. The response body may take as long as it needs.
+	Timeout time.Duration
+	// Client sends requests upstream. It defaults to a shared client that
+	// keeps upstream connections alive.
+	Client *client.Client
+	// Pages replaces the built-in error pages.
+	Pages    StatusPages
+	ErrorLog *log.Logger
+}
+
+func (p *ReverseProxy) ServeRequest(w *response.Writer, req *request.Request) {
+	name, ok := strings.CutPrefix(req.Path(), p.Prefix)
+	// As with a FileServer, the prefix has to end on a segment boundary:
+	// "/api" is not a prefix of "/apifoo".
+	if !ok || name != "" && name[0] != '/' && !strings.HasSuffix(p.Prefix, "/") {
+		p.Pages.write(w, response.StatusNotFound, nil)
+		return
+	}
+	upstream := p.Upstream
+	if p.Pool != nil {
+		b := p.Pool.pick(req)
+		if b == nil {
+			p.logf("proxy: %s %s: no backend available", req.RequestLine.Method, req.RequestLine.RequestTarget)
+			p.Pages.write(w, response.StatusServiceUnavailable, nil)
+			return
+		}
+		upstream = b.url
+		// The status says how the backend did: either its own, or the 502
+		// or 504 written when it couldn't be reached.
+		defer func() { p.Pool.release(b, gatewayError(w.StatusCode())) }()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out, err := p.outgoing(req, upstream, name)
+	if err != nil {
+		p.logf("proxy: %s %s: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+		p.Pages.write(w, response.StatusBadRequest, nil)
+		return
+	}
+
+	// The timer only covers the wait for headers; cancelling ctx later
+	// would cut off the body.
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(p.timeout(), func() {
+		timedOut.Store(true)
+		cancel()
+	})
+	if out.BodyReader != nil {
+		out.BodyReader = &progressReader{r: out.BodyReader, timer: timer, d: p.timeout()}
+	}
+	res, err := p.client().Do(ctx, out)
+	if !timer.Stop() && err == nil {
+		res.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		p.logf("proxy: %s %s: %v", req.RequestLine.Method, out.RequestLine.RequestTarget, err)
+		var netErr net.Error
+		if timedOut.Load() || errors.As(err, &netErr) && netErr.Timeout() {
+			p.Pages.write(w, response.StatusGatewayTimeout, nil)
+			return
+		}
+		p.Pages.write(w, response.StatusBadGateway, nil)
+		return
+	}
+	defer res.Body.Close()
+	p.copyResponse(w, req, res)
+}
+
+// outgoing builds the upstream request for req, whose path below Prefix
+// is name.
+func (p *ReverseProxy) outgoing(req *request.Request, upstream *url.URL, name string) (*request.Request, error) {
+	// name is still escaped, and goes upstream as the client wrote it.
+	escaped := joinURLPath(upstream.EscapedPath(), name)
+	unescaped, err := url.PathUnescape(escaped)
+	if err != nil {
+		return nil, err
+	}
+	target := *upstream
+	target.Path, target.RawPath = unescaped, escaped
+	if _, query, ok := strings.Cut(req.RequestLine.RequestTarget, "?"); ok {
+		if target.RawQuery != "" {
+			target.RawQuery += "&"
+		}
+		target.RawQuery += query
+	}
+
+	h := forwardHeaders(req.Headers)
+	// The client adds a length that matches the body it sends. A streamed
+	// body keeps the client's length, or goes chunked without one.
+	if req.BodyReader == nil {
+		h.Remove("content-length")
+	}
+	if !p.PreserveHost || h["host"] == "" {
+		h.Override("host", target.Host)
+	}
+	ip := clientIP(req)
+	if ip != "" {
+		h.Set("x-forwarded-for", ip)
+	}
+	h.Override("forwarded", forwardedFor(req, ip))
+	return &request.Request{
+		RequestLine: request.RequestLine{Method: req.RequestLine.Method, RequestTarget: target.String(), HttpVersion: "1.1"},
+		Headers:     h,
+		Body:        req.Body,
+		BodyReader:  req.BodyReader,
+	}, nil
+}
+
+// progressReader restarts the proxy timeout each time the client sends
+// more of a streamed body, so a long upload isn't taken for a stalled
+// upstream.
+type progressReader struct {
+	r     io.Reader
+	timer *time.Timer
+	d     time.Duration
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.timer.Reset(p.d)
+	}
+	return n, err
+}
+
+func (p *ReverseProxy) copyResponse(w *response.Writer, req *request.Request, res *client.Response) {
+	h := forwardHeaders(res.Headers)
+	code := res.StatusCode
+
+	bodyless := req.RequestLine.Method == "HEAD" || code == response.StatusNoContent ||
+		code == response.StatusNotModified || code < 200
+	switch {
+	case bodyless:
+		w.WriteStatusLine(code)
+		w.WriteHeaders(h)
+		return
+	case res.ContentLength >= 0:
+		h.Override("content-length", strconv.FormatInt(res.ContentLength, 10))
+		w.WriteStatusLine(code)
+		w.WriteHeaders(h)
+		if _, err := w.WriteBodyFrom(res.Body); err != nil {
+			p.abort(req, err)
+		}
+		return
+	}
+
+	// Without a length the body is relayed chunk by chunk as it arrives,
+	// with any trailers the upstream announced.
+	h.Remove("content-length")
+	h.Override("transfer-encoding", "chunked")
+	if announced := res.Headers["trailer"]; announced != "" {
+		h.Override("trailer", announced)
+	}
+	w.WriteStatusLine(code)
+	w.WriteHeaders(h)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteChunkedBody(buf[:n]); werr != nil {
+				p.abort(req, werr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			p.abort(req, err)
+		}
+	}
+	w.WriteChunkedBodyDone()
+	w.WriteTrailers(forwardHeaders(res.Trailers))
+}
+
+// abort drops the client connection when a body fails halfway, since
+// finishing it normally would pass a truncated body off as complete.
+func (p *ReverseProxy) abort(req *request.Request, err error) {
+	p.logf("proxy: %s %s: body cut short: %v", req.RequestLine.Method, req.RequestLine.RequestTarget, err)
+	panic(ErrAbortHandler)
+}
+
+func (p *ReverseProxy) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return defaultProxyTimeout
+}
+
+func (p *ReverseProxy) client() *client.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return defaultProxyClient
+}
+
+func (p *ReverseProxy) logf(format string, args ...any) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func gatewayError(code response.StatusCode) bool {
+	return code == response.StatusBadGateway || code == response.StatusServiceUnavailable ||
+		code == response.StatusGatewayTimeout
+}
+
+// forwardHeaders returns a copy of h without hop-by-hop headers.
+func forwardHeaders(h headers.Headers) headers.Headers {
+	drop := map[string]bool{}
+	for _, name := range hopHeaders {
+		drop[name] = true
+	}
+	for _, name := range strings.Split(h["connection"], ",") {
+		drop[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	out := headers.NewHeaders()
+	for key, value := range h {
+		if !drop[key] {
+			out[key] = value
+		}
+	}
+	return out
+}
+
+// forwardedFor extends the Forwarded header (RFC 7239) with this hop.
+func forwardedFor(req *request.Request, ip string) string {
+	var elem []string
+	if ip != "" {
+		if strings.Contains(ip, ":") {
+			ip = "[" + ip + "]"
+		}
+		elem = append(elem, "for="+quoteForwarded(ip))
+	}
+	if host := req.Headers["host"]; host != "" {
+		elem = append(elem, "host="+quoteForwarded(host))
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	elem = append(elem, "proto="+proto)
+
+	value := strings.Join(elem, ";")
+	if prior := req.Headers["forwarded"]; prior != "" {
+		value = prior + ", " + value
+	}
+	return value
+}
+
+// quoteForwarded quotes a Forwarded value unless it is a plain token.
+func quoteForwarded(s string) string {
+	for i := 0; i < len(s); i++ {
+		if !strings.ContainsRune(headerTokenChars, rune(s[i])) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+const headerTokenChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!#$%&'*+-.^_`|~"
+
+// joinURLPath appends a request path to the upstream's base path.
+func joinURLPath(base, name string) string {
+	switch {
+	case name == "":
+		if base == "" {
+			return "/"
+		}
+		return base
+	case base == "":
+		return name
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(name, "/")
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startProxy(t *testing.T, upstream string, configure func(p *ReverseProxy)) string {
+	t.Helper()
+	u, err := url.Parse(upstream)
+	require.NoError(t, err)
+	p := &ReverseProxy{Upstream: u, ErrorLog: log.New(io.Discard, "", 0)}
+	if configure != nil {
+		configure(p)
+	}
+	_, addr := startServer(t, p.ServeRequest)
+	return addr
+}
+
+func TestReverseProxy(t *testing.T) {
+	received := make(chan *request.Request, 1)
+	_, upstream := startServer(t, func(w *response.Writer, req *request.Request) {
+		received <- req
+		w.WriteStatusLine(201)
+		h := headers.NewHeaders()
+		h.Set("content-length", "7")
+		h.Set("x-upstream", "yes")
+		h.Set("keep-alive", "timeout=5")
+		w.WriteHeaders(h)
+		w.WriteBody([]byte("created"))
+	})
+	addr := startProxy(t, "http://"+upstream+"/base", func(p *ReverseProxy) { p.Prefix = "/api" })
+
+	// Test: Method, path, query, headers and body reach the upstream, minus
+	// hop-by-hop headers
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "PUT /api/items/a%2Fb?x=1 HTTP/1.1\r\nHost: example.com\r\n"+
+		"Content-Length: 5\r\nX-Custom: kept\r\nX-Hop: dropped\r\nConnection: keep-alive, x-hop\r\n"+
+		"Proxy-Authorization: secret\r\nX-Forwarded-For: 203.0.113.9\r\n\r\nhello")
+	require.NoError(t, err)
+	head, body := readResponse(t, bufio.NewReader(conn))
+
+	req := <-received
+	assert.Equal(t, "PUT", req.RequestLine.Method)
+	assert.Equal(t, "/base/items/a%2Fb?x=1", req.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(req.Body))
+	assert.Equal(t, "kept", req.Headers["x-custom"])
+	assert.Equal(t, upstream, req.Headers["host"])
+	for _, name := range []string{"x-hop", "proxy-authorization", "connection"} {
+		assert.NotContains(t, req.Headers, name)
+	}
+
+	// Test: The client address is added to X-Forwarded-For and Forwarded
+	assert.Regexp(t, `^203\.0\.113\.9, (127\.0\.0\.1|::1)$`, req.Headers["x-forwarded-for"])
+	assert.Regexp(t, `^for=("\[::1\]"|127\.0\.0\.1);host=example\.com;proto=http$`, req.Headers["forwarded"])
+
+	// Test: The upstream status and end-to-end headers come back
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 201 Created\r\n"), head)
+	assert.Contains(t, head, "x-upstream: yes\r\n")
+	assert.NotContains(t, head, "keep-alive")
+	assert.Equal(t, "created", body)
+
+	// Test: The prefix only matches whole path segments
+	_, br := sendRequest(t, addr, requestMessage("GET", "/apifoo"))
+	head, _ = readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 404 Not Found\r\n"), head)
+	assert.Empty(t, received)
+	_, br = sendRequest(t, addr, requestMessage("GET", "/api"))
+	readResponse(t, br)
+	assert.Equal(t, "/base", (<-received).RequestLine.RequestTarget)
+
+	// Test: PreserveHost passes the client's Host on
+	addr = startProxy(t, "http://"+upstream, func(p *ReverseProxy) { p.PreserveHost = true })
+	_, br = sendRequest(t, addr, requestMessage("GET", "/"))
+	readResponse(t, br)
+	assert.Equal(t, "localhost", (<-received).Headers["host"])
+}
+
+func TestReverseProxyStreaming(t *testing.T) {
+	release := make(chan struct{})
+	_, upstream := startServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("transfer-encoding", "chunked")
+		h.Set("trailer", "x-checksum")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("first"))
+		<-release
+		w.WriteChunkedBody([]byte("second"))
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("x-checksum", "abc")
+		w.WriteTrailers(trailers)
+	})
+	addr := startProxy(t, "http://"+upstream, nil)
+
+	// Test: Chunks are relayed as they arrive, not once the body is done
+	_, br := sendRequest(t, addr, requestMessage("GET", "/"))
+	var head strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	assert.Contains(t, head.String(), "transfer-encoding: chunked\r\n")
+	assert.Contains(t, head.String(), "trailer: x-checksum\r\n")
+	line, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "5\r\n", line)
+	line, err = br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "first\r\n", line)
+	close(release)
+
+	// Test: Trailers follow the last chunk
+	rest, err := io.ReadAll(br)
+	require.NoError(t, err)
+	assert.Equal(t, "6\r\nsecond\r\n0\r\nx-checksum: abc\r\n\r\n", string(rest))
+}
+
+func TestReverseProxyRequestStreaming(t *testing.T) {
+	firstPart := make(chan string, 1)
+	_, upstream := startServer(t, func(w *response.Writer, req *request.Request) {
+		var body string
+		if req.RequestLine.Method == "PUT" {
+			buf := make([]byte, 5)
+			_, err := io.ReadFull(req.BodyReader, buf)
+			require.NoError(t, err)
+			firstPart <- string(buf)
+			rest, err := io.ReadAll(req.BodyReader)
+			require.NoError(t, err)
+			body = string(buf) + string(rest) + " " + req.Headers["content-length"] + req.Headers["transfer-encoding"]
+		}
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("content-length", strconv.Itoa(len(body)))
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}, WithStreamedBodies(func(*request.Request) bool { return true }))
+	u, err := url.Parse("http://" + upstream)
+	require.NoError(t, err)
+	p := &ReverseProxy{Upstream: u, ErrorLog: log.New(io.Discard, "", 0)}
+	_, addr := startServer(t, p.ServeRequest, WithStreamedBodies(func(req *request.Request) bool {
+		return req.RequestLine.Method == "PUT"
+	}))
+
+	for _, tc := range []struct {
+		name, framing, first, rest, want string
+	}{
+		{"length", "Content-Length: 11\r\n", "hello", " world", "hello world 11"},
+		{"chunked", "Transfer-Encoding: chunked\r\n", "5\r\nhello\r\n", "6\r\n world\r\n0\r\n\r\n", "hello world chunked"},
+	} {
+		// Test: The upstream gets the start of the body before the client
+		// has sent the rest
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err, tc.name)
+		_, err = io.WriteString(conn, "PUT /upload HTTP/1.1\r\nHost: example.com\r\n"+tc.framing+"\r\n"+tc.first)
+		require.NoError(t, err, tc.name)
+		select {
+		case got := <-firstPart:
+			assert.Equal(t, "hello", got, tc.name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: upstream did not see the body before it was complete", tc.name)
+		}
+		_, err = io.WriteString(conn, tc.rest)
+		require.NoError(t, err, tc.name)
+		br := bufio.NewReader(conn)
+		head, body := readResponse(t, br)
+		assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), tc.name)
+		assert.Equal(t, tc.want, body, tc.name)
+
+		// Test: The connection carries on with the next request
+		_, err = io.WriteString(conn, "GET /next HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+		require.NoError(t, err, tc.name)
+		head, _ = readResponse(t, br)
+		assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), tc.name)
+		conn.Close()
+	}
+}
+
+func TestReverseProxyErrors(t *testing.T) {
+	// Test: An unreachable upstream is a 502
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := l.Addr().String()
+	l.Close()
+	addr := startProxy(t, "http://"+closed, nil)
+	_, br := sendRequest(t, addr, requestMessage("GET", "/"))
+	head, _ := readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 502 Bad Gateway\r\n"), head)
+
+	// Test: An upstream that never answers is a 504 after the timeout
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close()
+	go func() {
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	addr = startProxy(t, "http://"+silent.Addr().String(), func(p *ReverseProxy) { p.Timeout = 100 * time.Millisecond })
+	start := time.Now()
+	_, br = sendRequest(t, addr, requestMessage("GET", "/"))
+	head, _ = readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 504 Gateway Timeout\r\n"), head)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// Test: An upstream dying mid-body cuts the client off rather than
+	// ending the body early
+	broken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer broken.Close()
+	go func() {
+		c, err := broken.Accept()
+		if err != nil {
+			return
+		}
+		bufio.NewReader(c).ReadString('\n')
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n")
+		c.Close()
+	}()
+	addr = startProxy(t, "http://"+broken.Addr().String(), nil)
+	_, br = sendRequest(t, addr, requestMessage("GET", "/"))
+	rest, _ := io.ReadAll(br)
+	assert.Contains(t, string(rest), "5\r\nhello\r\n")
+	assert.NotContains(t, string(rest), "0\r\n\r\n")
+}
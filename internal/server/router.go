@@ -0,0 +1,294 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// Router dispatches requests on method and path. Patterns are made of
+// slash-separated segments, each of which is either literal text, a named
+// parameter ("{id}") matching exactly one segment, or, as the last
+// segment, a wildcard ("{path...}") matching the rest of the path.
+//
+// When several patterns match a path, literal segments win over
+// parameters and parameters win over wildcards, compared from left to
+// right. A path that matches a pattern but none of its methods gets a 405
+// with an Allow header, and OPTIONS is answered automatically unless a
+// handler is registered for it.
+type Router struct {
+	root       *routeNode
+	methods    []string
+	middleware []Middleware
+	NotFound   Handler
+}
+
+type routeNode struct {
+	pattern  string
+	static   map[string]*routeNode
+	param    *routeNode
+	wildcard *routeNode
+	// name is the parameter name for param and wildcard nodes.
+	name     string
+	handlers map[string]Handler
+}
+
+func NewRouter() *Router {
+	return &Router{root: &routeNode{}}
+}
+
+// Handle registers handler for method and pattern. It panics if the
+// pattern is malformed or already registered for the method, the same way
+// a duplicate case would fail to compile in a switch.
+func (r *Router) Handle(method, pattern string, handler Handler) {
+	if method == "" || handler == nil {
+		panic("router: method and handler are required")
+	}
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("router: %s: %v", pattern, err))
+	}
+
+	n := r.root
+	for _, seg := range segments {
+		switch {
+		case strings.HasSuffix(seg, "...}"):
+			name := seg[1 : len(seg)-4]
+			if n.wildcard == nil {
+				n.wildcard = &routeNode{name: name}
+			} else if n.wildcard.name != name {
+				panic(fmt.Sprintf("router: %s: wildcard {%s...} conflicts with {%s...}", pattern, name, n.wildcard.name))
+			}
+			n = n.wildcard
+		case strings.HasPrefix(seg, "{"):
+			name := seg[1 : len(seg)-1]
+			if n.param == nil {
+				n.param = &routeNode{name: name}
+			} else if n.param.name != name {
+				panic(fmt.Sprintf("router: %s: parameter {%s} conflicts with {%s}", pattern, name, n.param.name))
+			}
+			n = n.param
+		default:
+			if n.static == nil {
+				n.static = make(map[string]*routeNode)
+			}
+			child, ok := n.static[seg]
+			if !ok {
+				child = &routeNode{}
+				n.static[seg] = child
+			}
+			n = child
+		}
+	}
+
+	if n.handlers == nil {
+		n.handlers = make(map[string]Handler)
+	}
+	if _, ok := n.handlers[method]; ok {
+		panic(fmt.Sprintf("router: %s %s registered twice", method, pattern))
+	}
+	n.handlers[method] = handler
+	n.pattern = pattern
+	if !slices.Contains(r.methods, method) {
+		r.methods = append(r.methods, method)
+	}
+}
+
+func (r *Router) Get(pattern string, handler Handler) {
+	r.Handle("GET", pattern, handler)
+}
+
+func (r *Router) Post(pattern string, handler Handler) {
+	r.Handle("POST", pattern, handler)
+}
+
+func (r *Router) Put(pattern string, handler Handler) {
+	r.Handle("PUT", pattern, handler)
+}
+
+func (r *Router) Delete(pattern string, handler Handler) {
+	r.Handle("DELETE", pattern, handler)
+}
+
+// Use adds middleware around every request the router serves, including
+// the ones it answers itself with 404, 405 or OPTIONS.
+func (r *Router) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// ServeRequest routes req to the matching handler. It has the Handler
+// signature so a Router can be passed straight to Serve.
+func (r *Router) ServeRequest(w *response.Writer, req *request.Request) {
+	Chain(r.dispatch, r.middleware...)(w, req)
+}
+
+func (r *Router) dispatch(w *response.Writer, req *request.Request) {
+	method := req.RequestLine.Method
+	if method == "OPTIONS" && req.RequestLine.RequestTarget == "*" {
+		writeOptions(w, r.allow(r.methods))
+		return
+	}
+
+	segments, ok := splitPath(req.Path())
+	if !ok {
+		writeError(w, response.StatusBadRequest, BadRequestHTML, nil)
+		return
+	}
+
+	var matches []routeMatch
+	r.root.match(segments, map[string]string{}, &matches)
+
+	var methods []string
+	for _, m := range matches {
+		if h, ok := m.node.handlers[method]; ok {
+			req.Params = m.params
+			req.Pattern = m.node.pattern
+			h(w, req)
+			return
+		}
+		for registered := range m.node.handlers {
+			if !slices.Contains(methods, registered) {
+				methods = append(methods, registered)
+			}
+		}
+	}
+
+	switch {
+	case len(matches) == 0:
+		if r.NotFound != nil {
+			r.NotFound(w, req)
+			return
+		}
+		writeError(w, response.StatusNotFound, NotFoundHTML, nil)
+	case method == "OPTIONS":
+		writeOptions(w, r.allow(methods))
+	default:
+		h := headers.NewHeaders()
+		h.Set("allow", r.allow(methods))
+		writeError(w, response.StatusMethodNotAllowed, MethodNotAllowedHTML, h)
+	}
+}
+
+func (r *Router) allow(methods []string) string {
+	allowed := slices.Clone(methods)
+	if !slices.Contains(allowed, "OPTIONS") {
+		allowed = append(allowed, "OPTIONS")
+	}
+	slices.Sort(allowed)
+	return strings.Join(allowed, ", ")
+}
+
+type routeMatch struct {
+	node   *routeNode
+	params map[string]string
+}
+
+// match appends every node matching segments to matches, most specific
+// first, each with its own copy of the captured parameters.
+func (n *routeNode) match(segments []string, params map[string]string, matches *[]routeMatch) {
+	if len(segments) == 0 {
+		if n.handlers != nil {
+			*matches = append(*matches, routeMatch{node: n, params: params})
+		}
+		return
+	}
+
+	seg := segments[0]
+	if child, ok := n.static[seg]; ok {
+		child.match(segments[1:], params, matches)
+	}
+	// A parameter needs something to capture: "/users/" is not /users/{id}.
+	if n.param != nil && seg != "" {
+		p := cloneParams(params)
+		p[n.param.name] = seg
+		n.param.match(segments[1:], p, matches)
+	}
+	if n.wildcard != nil && n.wildcard.handlers != nil {
+		p := cloneParams(params)
+		p[n.wildcard.name] = strings.Join(segments, "/")
+		*matches = append(*matches, routeMatch{node: n.wildcard, params: p})
+	}
+}
+
+func cloneParams(params map[string]string) map[string]string {
+	p := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		p[k] = v
+	}
+	return p
+}
+
+func parsePattern(pattern string) ([]string, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("pattern must begin with /")
+	}
+	segments := strings.Split(pattern[1:], "/")
+	names := map[string]bool{}
+	for i, seg := range segments {
+		if !strings.HasPrefix(seg, "{") {
+			if strings.ContainsAny(seg, "{}") {
+				return nil, fmt.Errorf("segment %q mixes text and a parameter", seg)
+			}
+			continue
+		}
+		if !strings.HasSuffix(seg, "}") {
+			return nil, fmt.Errorf("unterminated parameter in %q", seg)
+		}
+		name := seg[1 : len(seg)-1]
+		if wildcard := strings.HasSuffix(name, "..."); wildcard {
+			if i != len(segments)-1 {
+				return nil, fmt.Errorf("wildcard %q must be the last segment", seg)
+			}
+			name = strings.TrimSuffix(name, "...")
+		}
+		if name == "" || strings.ContainsAny(name, "{}.") {
+			return nil, fmt.Errorf("invalid parameter name in %q", seg)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate parameter %q", name)
+		}
+		names[name] = true
+	}
+	return segments, nil
+}
+
+// splitPath breaks an origin-form path into unescaped segments. Escaped
+// slashes stay inside their segment.
+func splitPath(path string) ([]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	segments := strings.Split(path[1:], "/")
+	for i, seg := range segments {
+		unescaped, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, false
+		}
+		segments[i] = unescaped
+	}
+	return segments, true
+}
+
+func writeOptions(w *response.Writer, allow string) {
+	w.WriteStatusLine(response.StatusNoContent)
+	h := headers.NewHeaders()
+	h.Set("allow", allow)
+	h.Set("connection", "close")
+	w.WriteHeaders(h)
+}
+
+func writeError(w *response.Writer, statusCode response.StatusCode, body string, extra headers.Headers) {
+	w.WriteStatusLine(statusCode)
+	h := response.GetDefaultHeaders(len(body))
+	h.SetContentType("text/html")
+	for k, v := range extra {
+		h.Override(k, v)
+	}
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(body))
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func route(t *testing.T, r *Router, method, target string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	r.ServeRequest(response.New(&buf), newTestRequest(t, method, target))
+	return buf.String()
+}
+
+func reply(name string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		body := name
+		for _, key := range []string{"id", "action", "path"} {
+			if v, ok := req.Params[key]; ok {
+				body += " " + key + "=" + v
+			}
+		}
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+	}
+}
+
+func body(raw string) string {
+	_, b, _ := strings.Cut(raw, "\r\n\r\n")
+	return b
+}
+
+func TestRouterMatching(t *testing.T) {
+	r := NewRouter()
+	r.Get("/", reply("index"))
+	r.Get("/users", reply("list"))
+	r.Get("/users/me", reply("me"))
+	r.Get("/users/{id}", reply("user"))
+	r.Post("/users/{id}/{action}", reply("action"))
+	r.Get("/users/{id}/{action}", reply("get-action"))
+	r.Get("/static/{path...}", reply("static"))
+	r.Get("/static/robots.txt", reply("robots"))
+
+	tests := []struct {
+		method, target, want string
+	}{
+		// Test: Root path
+		{"GET", "/", "index"},
+		// Test: Literal path
+		{"GET", "/users", "list"},
+		// Test: Literal segment takes precedence over a parameter
+		{"GET", "/users/me", "me"},
+		// Test: Named parameter
+		{"GET", "/users/42", "user id=42"},
+		// Test: Query string is ignored for matching
+		{"GET", "/users/42?verbose=1", "user id=42"},
+		// Test: Parameters are unescaped
+		{"GET", "/users/a%20b", "user id=a b"},
+		// Test: Method selects among handlers on the same pattern
+		{"POST", "/users/7/ban", "action id=7 action=ban"},
+		{"GET", "/users/7/ban", "get-action id=7 action=ban"},
+		// Test: Wildcard captures the rest of the path
+		{"GET", "/static/css/site.css", "static path=css/site.css"},
+		// Test: Wildcard matches an empty remainder after the slash
+		{"GET", "/static/", "static path="},
+		// Test: Literal takes precedence over a wildcard
+		{"GET", "/static/robots.txt", "robots"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			res := route(t, r, tt.method, tt.target)
+			assert.True(t, strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n"), res)
+			assert.Equal(t, tt.want, body(res))
+		})
+	}
+
+	// Test: A parameter doesn't match an empty segment
+	for _, target := range []string{"/users/", "/users//ban"} {
+		res := route(t, r, "GET", target)
+		assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), target+": "+res)
+	}
+}
+
+func TestRouterBacktracking(t *testing.T) {
+	// Test: A literal branch that dead-ends falls back to the parameter
+	r := NewRouter()
+	r.Get("/files/new", reply("new"))
+	r.Get("/files/{id}/raw", reply("raw"))
+	assert.Equal(t, "raw id=new", body(route(t, r, "GET", "/files/new/raw")))
+
+	// Test: A parameter branch that dead-ends falls back to the wildcard
+	r.Get("/files/{path...}", reply("any"))
+	assert.Equal(t, "any path=x/y/z", body(route(t, r, "GET", "/files/x/y/z")))
+}
+
+func TestRouterErrors(t *testing.T) {
+	r := NewRouter()
+	r.Get("/users/{id}", reply("user"))
+	r.Put("/users/{id}", reply("update"))
+	r.Post("/users", reply("create"))
+
+	// Test: Unknown path is a 404
+	res := route(t, r, "GET", "/nope")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), res)
+	assert.Equal(t, NotFoundHTML, body(res))
+
+	// Test: Parameter does not match more than one segment
+	res = route(t, r, "GET", "/users/1/2")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), res)
+
+	// Test: Known path with the wrong method is a 405 with Allow
+	res = route(t, r, "DELETE", "/users/1")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 405 Method Not Allowed\r\n"), res)
+	assert.Contains(t, res, "allow: GET, OPTIONS, PUT\r\n")
+
+	// Test: Custom not-found handler
+	r.NotFound = reply("custom")
+	assert.Equal(t, "custom", body(route(t, r, "GET", "/nope")))
+
+	// Test: Malformed escape is a 400
+	res = route(t, r, "GET", "/users/%zz")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 400 Bad Request\r\n"), res)
+}
+
+func TestRouterOptions(t *testing.T) {
+	r := NewRouter()
+	r.Get("/users/{id}", reply("user"))
+	r.Delete("/users/{id}", reply("delete"))
+	r.Post("/users", reply("create"))
+	r.Handle("OPTIONS", "/custom", reply("options"))
+
+	// Test: Automatic OPTIONS for a path
+	res := route(t, r, "OPTIONS", "/users/3")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 204 No Content\r\n"), res)
+	assert.Contains(t, res, "allow: DELETE, GET, OPTIONS\r\n")
+
+	// Test: Server-wide OPTIONS *
+	res = route(t, r, "OPTIONS", "*")
+	assert.Contains(t, res, "allow: DELETE, GET, OPTIONS, POST\r\n")
+
+	// Test: Registered OPTIONS handler wins
+	assert.Equal(t, "options", body(route(t, r, "OPTIONS", "/custom")))
+
+	// Test: Unknown path is still a 404
+	res = route(t, r, "OPTIONS", "/nope")
+	assert.True(t, strings.HasPrefix(res, "HTTP/1.1 404 Not Found\r\n"), res)
+}
+
+func TestRouterInvalidPatterns(t *testing.T) {
+	h := reply("x")
+	tests := []struct {
+		name    string
+		pattern string
+	}{
+		{"missing leading slash", "users"},
+		{"unterminated parameter", "/users/{id"},
+		{"text mixed with parameter", "/users/id{id}"},
+		{"wildcard not last", "/files/{path...}/raw"},
+		{"empty parameter name", "/users/{}"},
+		{"duplicate parameter", "/{id}/{id}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Panics(t, func() { NewRouter().Get(tt.pattern, h) })
+		})
+	}
+
+	// Test: Duplicate registration and conflicting parameter names panic
+	r := NewRouter()
+	r.Get("/users/{id}", h)
+	assert.Panics(t, func() { r.Get("/users/{id}", h) })
+	assert.Panics(t, func() { r.Get("/users/{name}/posts", h) })
+	assert.NotPanics(t, func() { r.Post("/users/{id}", h) })
+}
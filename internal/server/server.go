@@ -1,13 +1,25 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/http2"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"io"
 	"log"
 	"net"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 const (
@@ -31,6 +43,46 @@ const (
   </body>
 </html>`
 
+	NotFoundHTML = `<html>
+  <head>
+    <title>404 Not Found</title>
+  </head>
+  <body>
+    <h1>Not Found</h1>
+    <p>Whatever you were looking for, it isn't here.</p>
+  </body>
+</html>`
+
+	MethodNotAllowedHTML = `<html>
+  <head>
+    <title>405 Method Not Allowed</title>
+  </head>
+  <body>
+    <h1>Method Not Allowed</h1>
+    <p>Right place, wrong verb.</p>
+  </body>
+</html>`
+
+	RequestTimeoutHTML = `<html>
+  <head>
+    <title>408 Request Timeout</title>
+  </head>
+  <body>
+    <h1>Request Timeout</h1>
+    <p>We waited. You never finished.</p>
+  </body>
+</html>`
+
+	ServiceUnavailableHTML = `<html>
+  <head>
+    <title>503 Service Unavailable</title>
+  </head>
+  <body>
+    <h1>Service Unavailable</h1>
+    <p>Too much going on right now. Try again in a bit.</p>
+  </body>
+</html>`
+
 	ServerErrorHTML = `<html>
   <head>
     <title>500 Internal Server Error</title>
@@ -47,58 +99,619 @@ type HandlerError struct {
 	Message    string
 }
 
+func (e *HandlerError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, response.StatusText(e.StatusCode), e.Message)
+}
+
 type Handler func(w *response.Writer, req *request.Request)
 type Server struct {
-	listener net.Listener
-	closed   atomic.Bool
-	handler  Handler
+	listener     net.Listener
+	closed       atomic.Bool
+	handler      Handler
+	mu           sync.Mutex
+	conns        map[*conn]struct{}
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	// done is closed when the accept loop ends, after acceptErr is set.
+	done      chan struct{}
+	acceptErr error
+	stats     stats
+	metrics   *serverMetrics
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+
+	connLimit    *limiter
+	handlerLimit *limiter
+	overload     overload
+	errorLog     *log.Logger
+	certs        *certStore
+	streamBody   func(req *request.Request) bool
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
-	portString := ":" + strconv.Itoa(port)
-	l, err := net.Listen("tcp", portString)
+const (
+	// shutdownPollInterval is how often Shutdown checks whether every
+	// connection has gone idle.
+	shutdownPollInterval = 10 * time.Millisecond
+	rejectWriteTimeout   = time.Second
+	minAcceptDelay       = 5 * time.Millisecond
+	maxAcceptDelay       = time.Second
+)
+
+// Serve listens on every interface at port, 0 picking a free one.
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	return ServeAddr("tcp", ":"+strconv.Itoa(port), handler, opts...)
+}
+
+// ServeAddr listens on address in the given network, e.g.
+// ("tcp", "127.0.0.1:8080") or ("unix", "/run/app.sock").
+func ServeAddr(network, address string, handler Handler, opts ...Option) (*Server, error) {
+	l, err := net.Listen(network, address)
 	if err != nil {
 		return nil, err
 	}
+	return ServeListener(l, handler, opts...), nil
+}
 
-	server := &Server{listener: l, handler: handler}
+// ServeListener serves connections accepted from l, which the server
+// closes when it is closed or shut down.
+func ServeListener(l net.Listener, handler Handler, opts ...Option) *Server {
+	server := &Server{
+		listener: l,
+		handler:  handler,
+		conns:    map[*conn]struct{}{},
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
 	go server.listen()
 
-	return server, nil
+	return server
+}
+
+// Addr returns the address the server is listening on, with the port
+// filled in if it was chosen by the system.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Done is closed once the server stops accepting connections, whether
+// it was closed, shut down or stopped by an accept error.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
 }
 
+// Err returns the accept error that stopped the server, or nil while it
+// is serving and after Close or Shutdown.
+func (s *Server) Err() error {
+	select {
+	case <-s.done:
+		return s.acceptErr
+	default:
+		return nil
+	}
+}
+
+// Close stops the listener and closes every connection immediately.
 func (s *Server) Close() error {
+	err := s.stopListening()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.rwc.Close()
+	}
+	return err
+}
+
+// Shutdown stops accepting connections, closes idle ones and waits for
+// the active ones to finish their current request. If ctx ends first the
+// rest are closed anyway; Shutdown then returns how many were cut off
+// along with the context's error.
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	err := s.stopListening()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return 0, err
+		}
+		select {
+		case <-ctx.Done():
+			return s.closeActiveConns(), ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) stopListening() error {
 	s.closed.Store(true)
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
 	return s.listener.Close()
 }
 
+func (s *Server) shuttingDown() bool {
+	return s.closed.Load()
+}
+
+// closeIdleConns closes connections waiting for a request and reports
+// whether no active ones remain.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	quiescent := true
+	for c := range s.conns {
+		if c.active {
+			quiescent = false
+			continue
+		}
+		c.rwc.Close()
+		delete(s.conns, c)
+	}
+	return quiescent
+}
+
+func (s *Server) closeActiveConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for c := range s.conns {
+		if c.active {
+			n++
+		}
+		c.rwc.Close()
+		delete(s.conns, c)
+	}
+	return n
+}
+
+func (s *Server) trackConn(c *conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
+
+func (s *Server) setActive(c *conn, active bool) {
+	s.mu.Lock()
+	c.active = active
+	s.mu.Unlock()
+}
+
 func (s *Server) listen() {
+	defer close(s.done)
+	// Blocking waits for a free slot before accepting so excess clients
+	// queue in the kernel's backlog instead of in memory.
+	blocking := s.overload.mode == OverloadBlock
+	var delay time.Duration
 	for {
+		if blocking && !s.connLimit.acquire(s.overload, s.shutdown) {
+			return
+		}
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if blocking {
+				s.connLimit.release()
+			}
 			if s.closed.Load() {
 				return
 			}
-			log.Fatalf("Error accepting connection: %v", err)
+			s.stats.acceptErrors.Add(1)
+			if !isTemporary(err) {
+				s.logf("server: accept failed, no longer serving: %v", err)
+				s.acceptErr = err
+				return
+			}
+			// Back off so running out of file descriptors doesn't turn
+			// into a busy loop, and give in-flight connections a chance
+			// to finish and free some.
+			delay = min(max(2*delay, minAcceptDelay), maxAcceptDelay)
+			s.logf("server: accept error: %v; retrying in %v", err, delay)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-s.shutdown:
+				timer.Stop()
+				return
+			}
+			continue
+		}
+		delay = 0
+		s.stats.accepted.Add(1)
+		s.metrics.connAccepted()
+		if blocking {
+			go s.handle(conn)
+		} else {
+			go s.admit(conn)
+		}
+	}
+}
+
+// isTemporary reports whether an accept error may go away by itself, such
+// as running out of file descriptors or a client aborting mid-handshake.
+func isTemporary(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EAGAIN, syscall.EINTR,
+	} {
+		if errors.Is(err, errno) {
+			return true
 		}
-		go s.handle(conn)
 	}
+	var temp interface{ Temporary() bool }
+	if errors.As(err, &temp) && temp.Temporary() {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.errorLog != nil {
+		s.errorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
 }
 
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
+func (s *Server) admit(rwc net.Conn) {
+	if !s.connLimit.acquire(s.overload, s.shutdown) {
+		s.stats.rejectedConns.Add(1)
+		s.rejectConn(rwc)
+		return
+	}
+	s.handle(rwc)
+}
+
+// handle serves a connection that holds a connection slot.
+func (s *Server) handle(rwc net.Conn) {
+	c := &conn{
+		srv:  s,
+		rwc:  rwc,
+		bufr: bufio.NewReader(rwc),
+	}
+	s.trackConn(c, true)
+	s.metrics.connOpened()
+	defer func() {
+		s.trackConn(c, false)
+		// A hijacked connection keeps its slot, and counts as active,
+		// until it is closed.
+		if !c.hijacked {
+			s.metrics.connClosed()
+			s.connLimit.release()
+			rwc.Close()
+		}
+	}()
 
-	req, err := request.RequestFromReader(conn)
+	start := time.Now()
+	var tlsState *tls.ConnectionState
+	if tc, ok := rwc.(*tls.Conn); ok {
+		if !s.handshake(tc, start) {
+			return
+		}
+		state := tc.ConnectionState()
+		tlsState = &state
+		if state.NegotiatedProtocol == "h2" {
+			s.setActive(c, true)
+			s.serveHTTP2(c, nil)
+			return
+		}
+	}
+	for first := true; ; first = false {
+		// Wait for the next request while idle so Shutdown can close the
+		// connection without interrupting anything. The first request gets
+		// the header timeout from the moment the connection was accepted.
+		if first {
+			setReadDeadline(rwc, start, s.headerTimeout())
+		} else {
+			setReadDeadline(rwc, time.Now(), s.idleTimeoutOrDefault())
+		}
+		if _, err := c.bufr.Peek(1); err != nil {
+			if isTimeout(err) {
+				if first {
+					s.countHeaderTimeout()
+				} else {
+					s.stats.idleTimeouts.Add(1)
+				}
+			}
+			return
+		}
+		s.setActive(c, true)
+		if !first {
+			start = time.Now()
+			setReadDeadline(rwc, start, s.headerTimeout())
+		}
+
+		if first && c.hasHTTP2Preface() {
+			s.serveHTTP2(c, nil)
+			return
+		}
+
+		req, err := request.HeadersFromReader(c.bufr)
+		if err != nil {
+			s.metrics.parseError(err, false)
+			if isTimeout(err) {
+				s.countHeaderTimeout()
+				s.reject(rwc, response.StatusRequestTimeout)
+				return
+			}
+			s.reject(rwc, rejectStatus(err))
+			return
+		}
+		req.RemoteAddr = rwc.RemoteAddr().String()
+		req.SetTLS(tlsState)
+		// h2c is cleartext only; over TLS, HTTP/2 is chosen by ALPN.
+		h2c := tlsState == nil && http2.IsH2CUpgrade(req)
+
+		// A streamed body is read by the handler, still within the read
+		// timeout.
+		setReadDeadline(rwc, start, s.readTimeout)
+		var streamed *streamedBody
+		if !h2c && s.streamBody != nil && s.streamBody(req) {
+			req.StreamBody(c.bufr)
+			streamed = &streamedBody{r: req.BodyReader}
+			req.BodyReader = streamed
+		} else if err := req.ReadBody(c.bufr); err != nil {
+			s.metrics.parseError(err, true)
+			if isTimeout(err) {
+				s.stats.readTimeouts.Add(1)
+				s.reject(rwc, response.StatusRequestTimeout)
+				return
+			}
+			s.reject(rwc, rejectStatus(err))
+			return
+		}
+
+		if h2c {
+			// HTTP/2 sets its own read deadlines; a write deadline left
+			// from an earlier request would cut the connection off.
+			rwc.SetWriteDeadline(time.Time{})
+			w := response.New(rwc)
+			w.WriteStatusLine(response.StatusSwitchingProtocols)
+			h := headers.NewHeaders()
+			h.Set("connection", "Upgrade")
+			h.Set("upgrade", "h2c")
+			w.WriteHeaders(h)
+			s.serveHTTP2(c, req)
+			return
+		}
+
+		if s.writeTimeout > 0 {
+			rwc.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		}
+		w := response.NewHijackable(c, c.hijack)
+		if aborted := s.runHandler(w, req); aborted || c.hijacked {
+			return
+		}
+		if c.writeTimedOut {
+			s.stats.writeTimeouts.Add(1)
+			return
+		}
+		if streamed != nil && !streamed.discard() {
+			w.Finish(req.RequestLine.Method == "HEAD")
+			return
+		}
+		if !keepAlive(w, req) || s.shuttingDown() {
+			return
+		}
+		s.setActive(c, false)
+	}
+}
+
+// handshake runs the TLS handshake within the header timeout, which is
+// the first thing a client sends.
+func (s *Server) handshake(tc *tls.Conn, start time.Time) bool {
+	if d := s.headerTimeout(); d > 0 {
+		tc.SetDeadline(start.Add(d))
+	}
+	err := tc.Handshake()
+	tc.SetDeadline(time.Time{})
 	if err != nil {
-		w := response.New(conn)
-		w.WriteStatusLine(response.StatusBadRequest)
-		headers := headers.NewHeaders()
-		headers.SetContentType("text/html")
-		w.WriteHeaders(headers)
-		w.WriteBody([]byte(BadRequestHTML))
+		s.stats.tlsHandshakeErrors.Add(1)
+		s.logf("server: TLS handshake error from %s: %v", tc.RemoteAddr(), err)
+		return false
+	}
+	return true
+}
+
+func (s *Server) headerTimeout() time.Duration {
+	if s.readHeaderTimeout > 0 {
+		return s.readHeaderTimeout
+	}
+	return s.readTimeout
+}
+
+func (s *Server) idleTimeoutOrDefault() time.Duration {
+	if s.idleTimeout > 0 {
+		return s.idleTimeout
+	}
+	return s.readTimeout
+}
+
+// countHeaderTimeout attributes a timeout while reading headers to
+// whichever setting produced the deadline.
+func (s *Server) countHeaderTimeout() {
+	if s.readHeaderTimeout > 0 {
+		s.stats.readHeaderTimeouts.Add(1)
+	} else {
+		s.stats.readTimeouts.Add(1)
+	}
+}
+
+// reject answers a request the server could not read and gives up on the
+// connection. The client may have stopped reading, so the write gets a
+// short deadline of its own.
+func (s *Server) reject(rwc net.Conn, statusCode response.StatusCode) {
+	rwc.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	StatusPages(nil).write(response.New(rwc), statusCode, nil)
+}
+
+// rejectStatus picks the answer to a request that failed to parse.
+func rejectStatus(err error) response.StatusCode {
+	if errors.Is(err, request.ErrUnsupportedTransferCoding) {
+		return response.StatusNotImplemented
+	}
+	return response.StatusBadRequest
+}
+
+func setReadDeadline(rwc net.Conn, from time.Time, d time.Duration) {
+	if d <= 0 {
+		rwc.SetReadDeadline(time.Time{})
 		return
 	}
+	rwc.SetReadDeadline(from.Add(d))
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// keepAlive finishes the response and reports whether another request
+// may follow it on the same connection.
+func keepAlive(w *response.Writer, req *request.Request) bool {
+	complete := w.Finish(req.RequestLine.Method == "HEAD")
+	if headerContainsToken(req.Headers["connection"], "close") {
+		return false
+	}
+	return complete && !headerContainsToken(w.Headers()["connection"], "close")
+}
+
+// maxDiscard is how much of a streamed body the handler left unread the
+// server will read past to keep the connection.
+const maxDiscard = 256 << 10
+
+// streamedBody is a request body left for the handler to read. It counts
+// what was read and whether the body was read to the end.
+type streamedBody struct {
+	r    io.Reader
+	n    int64
+	done bool
+	err  error
+}
+
+func (b *streamedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if err == io.EOF {
+		b.done = true
+	}
+	b.err = err
+	return n, err
+}
+
+// discard reads what the handler left of the body, reporting whether the
+// next request can be read after it.
+func (b *streamedBody) discard() bool {
+	if b.err == nil {
+		io.CopyN(io.Discard, b, maxDiscard)
+	}
+	return b.done
+}
+
+func (s *Server) serveHTTP2(c *conn, upgrade *request.Request) {
+	h2 := &http2.Server{
+		Handler:           s.serveRequest,
+		ReadHeaderTimeout: s.headerTimeout(),
+		IdleTimeout:       s.idleTimeoutOrDefault(),
+		Shutdown:          s.shutdown,
+	}
+	h2.ServeConn(c.rwc, c.bufr, upgrade)
+}
+
+type conn struct {
+	srv           *Server
+	rwc           net.Conn
+	bufr          *bufio.Reader
+	hijacked      bool
+	writeTimedOut bool
+	// active is guarded by srv.mu and false while waiting for a request.
+	active bool
+}
+
+// Write passes responses through to the connection, noting whether the
+// write deadline cut one short.
+func (c *conn) Write(p []byte) (int, error) {
+	n, err := c.rwc.Write(p)
+	if isTimeout(err) {
+		c.writeTimedOut = true
+	}
+	return n, err
+}
+
+// ReadFrom lets io.Copy hand file bodies to the connection, which for
+// plain TCP sends them with sendfile(2) rather than through user space.
+// TLS connections have no ReadFrom and copy through a buffer as before.
+func (c *conn) ReadFrom(r io.Reader) (int64, error) {
+	rf, ok := c.rwc.(io.ReaderFrom)
+	if !ok {
+		// Hide ReadFrom so io.Copy doesn't call back into it.
+		return io.Copy(struct{ io.Writer }{c}, r)
+	}
+	n, err := rf.ReadFrom(r)
+	if isTimeout(err) {
+		c.writeTimedOut = true
+	}
+	return n, err
+}
+
+func (c *conn) hasHTTP2Preface() bool {
+	prefix, err := c.bufr.Peek(3)
+	if err != nil || string(prefix) != http2.ClientPreface[:3] {
+		return false
+	}
+	preface, err := c.bufr.Peek(len(http2.ClientPreface))
+	return err == nil && string(preface) == http2.ClientPreface
+}
+
+func (c *conn) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c.hijacked = true
+	c.rwc.SetDeadline(time.Time{})
+	c.srv.trackConn(c, false)
+	hc := &hijackedConn{Conn: c.rwc, release: func() {
+		c.srv.metrics.connClosed()
+		c.srv.connLimit.release()
+	}}
+	return hc, bufio.NewReadWriter(c.bufr, bufio.NewWriter(hc)), nil
+}
+
+// hijackedConn gives the connection slot back when it is closed, so
+// WithMaxConns and the active connections gauge still count connections
+// a handler has taken over.
+type hijackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *hijackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// CloseWrite half-closes the connection where the transport can.
+func (c *hijackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
 
-	w := response.New(conn)
-	s.handler(w, req)
+func headerContainsToken(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
 }
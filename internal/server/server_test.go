@@ -0,0 +1,797 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/http2"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHijack(t *testing.T) {
+	hijacked := make(chan string, 1)
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		conn, rw, err := w.Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, _, err = w.Hijack()
+		assert.ErrorIs(t, err, response.ErrHijacked)
+		assert.ErrorIs(t, w.WriteStatusLine(response.StatusOK), response.ErrHijacked)
+
+		// Bytes pipelined behind the request must not be lost.
+		line, err := rw.ReadString('\n')
+		require.NoError(t, err)
+		hijacked <- line
+
+		rw.WriteString("pong\n")
+		rw.Flush()
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "GET /tunnel HTTP/1.1\r\nHost: localhost\r\n\r\nping\n")
+	require.NoError(t, err)
+
+	assert.Equal(t, "ping\n", <-hijacked)
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "pong\n", reply)
+}
+
+func TestHTTP2Detection(t *testing.T) {
+	s, err := Serve(0, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		w.WriteBody(nil)
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Prior knowledge preface is answered with a SETTINGS frame
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	head := make([]byte, 9)
+	_, err = io.ReadFull(conn, head)
+	require.NoError(t, err)
+	assert.Equal(t, byte(http2.FrameSettings), head[3])
+
+	// Test: Upgrade: h2c switches protocols before the first frame
+	conn2, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	_, err = io.WriteString(conn2, "GET / HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\n"+
+		"HTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn2)
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+	}
+	_, err = io.ReadFull(br, head)
+	require.NoError(t, err)
+	assert.Equal(t, byte(http2.FrameSettings), head[3])
+}
+
+func startServer(t *testing.T, handler Handler, opts ...Option) (*Server, string) {
+	t.Helper()
+	s, err := Serve(0, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s, s.Addr().String()
+}
+
+// readResponse reads one response off br, relying on content-length or
+// chunked framing, and returns its head and body.
+// readHead reads a response up to the end of its headers.
+func readHead(t *testing.T, br *bufio.Reader) string {
+	t.Helper()
+	var head strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			return head.String()
+		}
+	}
+}
+
+func readResponse(t *testing.T, br *bufio.Reader) (string, string) {
+	t.Helper()
+	head := readHead(t, br)
+	contentLength, chunked := -1, false
+	for _, line := range strings.Split(strings.ToLower(head), "\r\n") {
+		if v, ok := strings.CutPrefix(line, "content-length: "); ok {
+			var err error
+			contentLength, err = strconv.Atoi(strings.TrimSpace(v))
+			require.NoError(t, err)
+		}
+		if strings.HasPrefix(line, "transfer-encoding: chunked") {
+			chunked = true
+		}
+	}
+	var body strings.Builder
+	switch {
+	case chunked:
+		for {
+			line, err := br.ReadString('\n')
+			require.NoError(t, err)
+			size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+			require.NoError(t, err)
+			if size == 0 {
+				// Skip trailers up to the blank line.
+				for line != "\r\n" {
+					line, err = br.ReadString('\n')
+					require.NoError(t, err)
+				}
+				break
+			}
+			chunk := make([]byte, size+2)
+			_, err = io.ReadFull(br, chunk)
+			require.NoError(t, err)
+			body.Write(chunk[:size])
+		}
+	case contentLength >= 0:
+		b := make([]byte, contentLength)
+		_, err := io.ReadFull(br, b)
+		require.NoError(t, err)
+		body.Write(b)
+	}
+	return head, body.String()
+}
+
+func keepAliveHandler(w *response.Writer, req *request.Request) {
+	body := "hello " + req.RequestLine.RequestTarget
+	switch req.Path() {
+	case "/chunked":
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("transfer-encoding", "chunked")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte(body))
+		// The server terminates the body the handler left open.
+	case "/unframed":
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(headers.NewHeaders())
+		w.WriteBody([]byte(body))
+	default:
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("content-length", strconv.Itoa(len(body)))
+		w.WriteHeaders(h)
+		if req.RequestLine.Method != "HEAD" {
+			w.WriteBody([]byte(body))
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	_, addr := startServer(t, keepAliveHandler)
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	// Test: Several requests share a connection, including pipelined ones
+	_, err = io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\nGET /two HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	_, body := readResponse(t, br)
+	assert.Equal(t, "hello /one", body)
+	_, body = readResponse(t, br)
+	assert.Equal(t, "hello /two", body)
+
+	// Test: A HEAD response with a Content-Length and no body keeps the
+	// connection open
+	_, err = io.WriteString(conn, "HEAD /head HTTP/1.1\r\nHost: localhost\r\n\r\nGET /after HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	var head strings.Builder
+	for !strings.HasSuffix(head.String(), "\r\n\r\n") {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+	}
+	assert.Contains(t, head.String(), "content-length: 11\r\n")
+	_, body = readResponse(t, br)
+	assert.Equal(t, "hello /after", body)
+
+	// Test: A chunked body left open by the handler is terminated
+	_, err = io.WriteString(conn, "GET /chunked HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	_, body = readResponse(t, br)
+	assert.Equal(t, "hello /chunked", body)
+
+	// Test: Connection: close from the client ends the connection
+	_, err = io.WriteString(conn, "GET /last HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	_, body = readResponse(t, br)
+	assert.Equal(t, "hello /last", body)
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: A response without framing is delimited by closing
+	conn2, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn2.Close()
+	_, err = io.WriteString(conn2, "GET /unframed HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	rest, err := io.ReadAll(conn2)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\nhello /unframed"))
+
+	// Test: Default headers ask for the connection to be closed
+	_, addr2 := startServer(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(2))
+		w.WriteBody([]byte("ok"))
+	})
+	conn3, err := net.Dial("tcp", addr2)
+	require.NoError(t, err)
+	defer conn3.Close()
+	_, err = io.WriteString(conn3, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	rest, err = io.ReadAll(conn3)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\nok"))
+}
+
+func TestRequestFraming(t *testing.T) {
+	_, addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		body := req.RequestLine.RequestTarget + " " + string(req.Body)
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("content-length", strconv.Itoa(len(body)))
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	})
+
+	// Test: A chunked body is read in full, so a pipelined request after
+	// it is the next request and not the body's bytes
+	_, br := sendRequest(t, addr, "POST /upload HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n"+
+		"1b\r\nGET /smuggled HTTP/1.1\r\nX: \r\n0\r\n\r\n"+
+		"GET /next HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	_, body := readResponse(t, br)
+	assert.Equal(t, "/upload GET /smuggled HTTP/1.1\r\nX: ", body)
+	head, body := readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), head)
+	assert.Equal(t, "/next ", body)
+	_, err := br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Ambiguous framing is a 400 and the connection is closed
+	for _, fields := range []string{
+		"Transfer-Encoding: chunked\r\nContent-Length: 3\r\n",
+		"Content-Length: 3\r\nContent-Length: 4\r\n",
+	} {
+		_, br = sendRequest(t, addr, "POST /upload HTTP/1.1\r\nHost: localhost\r\n"+fields+"\r\nabc\r\n\r\nGET /next HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		head, _ = readResponse(t, br)
+		assert.True(t, strings.HasPrefix(head, "HTTP/1.1 400 Bad Request\r\n"), head)
+		_, err = br.ReadByte()
+		assert.ErrorIs(t, err, io.EOF, fields)
+	}
+
+	// Test: Transfer codings other than chunked are not implemented
+	_, br = sendRequest(t, addr, "POST /upload HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip\r\n\r\n")
+	head, _ = readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 501 Not Implemented\r\n"), head)
+}
+
+func TestStreamedBodies(t *testing.T) {
+	_, addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		body := req.RequestLine.RequestTarget
+		if req.RequestLine.RequestTarget == "/read" {
+			data, err := io.ReadAll(req.BodyReader)
+			require.NoError(t, err)
+			body += " " + string(data)
+		}
+		w.WriteStatusLine(response.StatusOK)
+		h := headers.NewHeaders()
+		h.Set("content-length", strconv.Itoa(len(body)))
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+	}, WithStreamedBodies(func(req *request.Request) bool { return req.RequestLine.Method == "POST" }))
+
+	// Test: The handler reads the body itself, and what it leaves unread is
+	// skipped so the next request on the connection is still found
+	_, br := sendRequest(t, addr, "POST /read HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"+
+		"POST /skip HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc"+
+		requestMessage("GET", "/next"))
+	for _, want := range []string{"/read abc", "/skip", "/next"} {
+		_, body := readResponse(t, br)
+		assert.Equal(t, want, body)
+	}
+
+	// Test: A large unread remainder closes the connection instead
+	conn, br := sendRequest(t, addr, "POST /skip HTTP/1.1\r\nHost: localhost\r\nContent-Length: "+strconv.Itoa(maxDiscard+10)+"\r\n\r\n")
+	_, body := readResponse(t, br)
+	assert.Equal(t, "/skip", body)
+	_, err := conn.Write(make([]byte, maxDiscard))
+	require.NoError(t, err)
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s, addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		keepAliveHandler(w, req)
+	})
+
+	// An idle keep-alive connection that has already served a request.
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	idleReader := bufio.NewReader(idle)
+	_, err = io.WriteString(idle, "GET /fast HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	readResponse(t, idleReader)
+
+	// A connection whose handler is still running.
+	active, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer active.Close()
+	_, err = io.WriteString(active, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+
+	type result struct {
+		cut int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		cut, err := s.Shutdown(context.Background())
+		done <- result{cut, err}
+	}()
+
+	// Test: Idle connections are closed right away
+	_, err = idleReader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: New connections are refused
+	require.Eventually(t, func() bool {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+		}
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+
+	// Test: Shutdown waits for the active handler
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned while a handler was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	_, body := readResponse(t, bufio.NewReader(active))
+	assert.Equal(t, "hello /slow", body)
+	r := <-done
+	assert.NoError(t, r.err)
+	assert.Equal(t, 0, r.cut)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	s, addr := startServer(t, func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+
+	// Test: Connections still active at the deadline are cut off and counted
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	cut, err := s.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, cut)
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err)
+}
+
+func TestTimeouts(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.Path() == "/slow" {
+			time.Sleep(150 * time.Millisecond)
+		}
+		keepAliveHandler(w, req)
+	}
+	s, addr := startServer(t, handler,
+		WithReadHeaderTimeout(100*time.Millisecond),
+		WithReadTimeout(200*time.Millisecond),
+		WithWriteTimeout(100*time.Millisecond),
+		WithIdleTimeout(100*time.Millisecond),
+	)
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+
+	// Test: Headers trickled in slower than the header timeout get a 408
+	conn, br := dial()
+	for _, part := range []string{"GET / HTTP/1.1\r\n", "Host: local", "host\r\n", "X-Slow: 1\r\n"} {
+		io.WriteString(conn, part)
+		time.Sleep(40 * time.Millisecond)
+	}
+	head, _ := readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 408 Request Timeout\r\n"), head)
+	assert.Equal(t, uint64(1), s.Stats().ReadHeaderTimeouts)
+
+	// Test: A connection that never sends anything is closed quietly
+	_, br = dial()
+	_, err := br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, uint64(2), s.Stats().ReadHeaderTimeouts)
+
+	// Test: A body that stalls gets a 408 once the read timeout passes
+	conn, br = dial()
+	io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc")
+	head, _ = readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 408 Request Timeout\r\n"), head)
+	assert.Equal(t, uint64(1), s.Stats().ReadTimeouts)
+
+	// Test: An idle keep-alive connection is closed after the idle timeout
+	conn, br = dial()
+	io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	_, body := readResponse(t, br)
+	assert.Equal(t, "hello /one", body)
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, uint64(1), s.Stats().IdleTimeouts)
+
+	// Test: A handler that writes after the write timeout loses the connection
+	conn, br = dial()
+	io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	_, err = br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, uint64(1), s.Stats().WriteTimeouts)
+}
+
+func TestServeOptions(t *testing.T) {
+	// Test: Options given to Serve configure the server
+	s, err := Serve(0, keepAliveHandler,
+		WithReadHeaderTimeout(time.Second),
+		WithReadTimeout(2*time.Second),
+		WithWriteTimeout(3*time.Second),
+		WithIdleTimeout(4*time.Second),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, time.Second, s.readHeaderTimeout)
+	assert.Equal(t, 2*time.Second, s.readTimeout)
+	assert.Equal(t, 3*time.Second, s.writeTimeout)
+	assert.Equal(t, 4*time.Second, s.idleTimeout)
+
+	// Test: Idle and header timeouts fall back to the read timeout
+	s2, err := Serve(0, keepAliveHandler, WithReadTimeout(time.Second))
+	require.NoError(t, err)
+	defer s2.Close()
+	assert.Equal(t, time.Second, s2.headerTimeout())
+	assert.Equal(t, time.Second, s2.idleTimeoutOrDefault())
+}
+
+// gatedHandler blocks requests for /wait until release is closed and
+// reports each one on started.
+func gatedHandler(started chan<- string, release <-chan struct{}) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		started <- req.Path()
+		if req.Path() == "/wait" {
+			<-release
+		}
+		keepAliveHandler(w, req)
+	}
+}
+
+// sendRequest writes message, a raw HTTP/1.1 request, to a new
+// connection to addr.
+func sendRequest(t *testing.T, addr, message string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, message)
+	require.NoError(t, err)
+	return conn, bufio.NewReader(conn)
+}
+
+// roundTrip sends message on a new connection and reads the response.
+func roundTrip(t *testing.T, addr, message string) (string, string) {
+	t.Helper()
+	_, br := sendRequest(t, addr, message)
+	return readResponse(t, br)
+}
+
+// requestMessage is a bodyless request that closes the connection after
+// it, with any extra header lines in fields.
+func requestMessage(method, target string, fields ...string) string {
+	message := method + " " + target + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n"
+	for _, field := range fields {
+		message += field + "\r\n"
+	}
+	return message + "\r\n"
+}
+
+func TestConnLimit(t *testing.T) {
+	// Test: Reject mode answers connections over the limit with 503
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	s, addr := startServer(t, gatedHandler(started, release),
+		WithMaxConns(1), WithOverload(OverloadReject), WithRetryAfter(1500*time.Millisecond))
+	_, br1 := sendRequest(t, addr, requestMessage("GET", "/wait"))
+	<-started
+	_, br2 := sendRequest(t, addr, requestMessage("GET", "/"))
+	head, body := readResponse(t, br2)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 503 Service Unavailable\r\n"), head)
+	assert.Contains(t, head, "retry-after: 2\r\n")
+	assert.Equal(t, ServiceUnavailableHTML, body)
+	assert.Equal(t, uint64(1), s.Stats().RejectedConns)
+	close(release)
+	_, body = readResponse(t, br1)
+	assert.Equal(t, "hello /wait", body)
+
+	// Test: Block mode holds new connections back until a slot frees up
+	started = make(chan string, 10)
+	release = make(chan struct{})
+	s, addr = startServer(t, gatedHandler(started, release), WithMaxConns(1))
+	_, br1 = sendRequest(t, addr, requestMessage("GET", "/wait"))
+	assert.Equal(t, "/wait", <-started)
+	_, br2 = sendRequest(t, addr, requestMessage("GET", "/next"))
+	select {
+	case path := <-started:
+		t.Fatalf("%s was served over the connection limit", path)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	_, body = readResponse(t, br1)
+	assert.Equal(t, "hello /wait", body)
+	_, body = readResponse(t, br2)
+	assert.Equal(t, "hello /next", body)
+	assert.Equal(t, uint64(0), s.Stats().RejectedConns)
+
+	// Test: A hijacked connection holds its slot until it is closed
+	hijacked := make(chan net.Conn, 1)
+	s, addr = startServer(t, func(w *response.Writer, req *request.Request) {
+		if req.Path() != "/hijack" {
+			keepAliveHandler(w, req)
+			return
+		}
+		conn, _, err := w.Hijack()
+		require.NoError(t, err)
+		hijacked <- conn
+	}, WithMaxConns(1), WithOverload(OverloadReject))
+	sendRequest(t, addr, requestMessage("GET", "/hijack"))
+	conn := <-hijacked
+	_, br2 = sendRequest(t, addr, requestMessage("GET", "/"))
+	head, _ = readResponse(t, br2)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 503 Service Unavailable\r\n"), head)
+	conn.Close()
+	_, br2 = sendRequest(t, addr, requestMessage("GET", "/"))
+	head, _ = readResponse(t, br2)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), head)
+	assert.Equal(t, uint64(1), s.Stats().RejectedConns)
+}
+
+func TestHandlerLimit(t *testing.T) {
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	s, addr := startServer(t, gatedHandler(started, release),
+		WithMaxHandlers(1), WithQueue(1, time.Second))
+
+	_, brA := sendRequest(t, addr, requestMessage("GET", "/wait"))
+	<-started
+
+	// Test: A request over the limit waits in the queue
+	_, brB := sendRequest(t, addr, requestMessage("GET", "/queued"))
+	require.Eventually(t, func() bool { return s.handlerLimit.waiting.Load() == 1 }, time.Second, time.Millisecond)
+
+	// Test: A request beyond the queue size is rejected at once
+	_, brC := sendRequest(t, addr, requestMessage("GET", "/overflow"))
+	head, _ := readResponse(t, brC)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 503 Service Unavailable\r\n"), head)
+	assert.Contains(t, head, "retry-after: 1\r\n")
+	assert.Equal(t, uint64(1), s.Stats().RejectedRequests)
+
+	// Test: The queued request runs once the slot is released
+	close(release)
+	_, body := readResponse(t, brA)
+	assert.Equal(t, "hello /wait", body)
+	_, body = readResponse(t, brB)
+	assert.Equal(t, "hello /queued", body)
+
+	// Test: Queued requests give up after the queue timeout
+	started = make(chan string, 10)
+	release = make(chan struct{})
+	defer close(release)
+	s, addr = startServer(t, gatedHandler(started, release),
+		WithMaxHandlers(1), WithQueue(0, 50*time.Millisecond))
+	sendRequest(t, addr, requestMessage("GET", "/wait"))
+	<-started
+	_, brB = sendRequest(t, addr, requestMessage("GET", "/late"))
+	head, _ = readResponse(t, brB)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 503 Service Unavailable\r\n"), head)
+	assert.Equal(t, uint64(1), s.Stats().RejectedRequests)
+}
+
+func TestServeAddrAndListener(t *testing.T) {
+	get := func(network, addr string) string {
+		conn, err := net.Dial(network, addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, "GET /where HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		require.NoError(t, err)
+		_, body := readResponse(t, bufio.NewReader(conn))
+		return body
+	}
+
+	// Test: A TCP address with port 0 reports the chosen port
+	s, err := ServeAddr("tcp", "127.0.0.1:0", keepAliveHandler)
+	require.NoError(t, err)
+	defer s.Close()
+	tcpAddr, ok := s.Addr().(*net.TCPAddr)
+	require.True(t, ok)
+	assert.NotZero(t, tcpAddr.Port)
+	assert.Equal(t, "hello /where", get("tcp", s.Addr().String()))
+
+	// Test: The address in use is reported as an error
+	_, err = ServeAddr("tcp", s.Addr().String(), keepAliveHandler)
+	assert.Error(t, err)
+
+	// Test: Unix domain sockets
+	path := filepath.Join(t.TempDir(), "server.sock")
+	us, err := ServeAddr("unix", path, keepAliveHandler)
+	require.NoError(t, err)
+	defer us.Close()
+	assert.Equal(t, path, us.Addr().String())
+	assert.Equal(t, "hello /where", get("unix", path))
+
+	// Test: An existing listener is served and closed with the server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ls := ServeListener(l, keepAliveHandler)
+	assert.Equal(t, l.Addr(), ls.Addr())
+	assert.Equal(t, "hello /where", get("tcp", l.Addr().String()))
+	require.NoError(t, ls.Close())
+	_, err = l.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+// flakyListener fails the first accepts with errs before accepting for real.
+type flakyListener struct {
+	net.Listener
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAcceptErrors(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}
+
+	// Test: Temporary errors are retried with growing delays
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var logs syncBuffer
+	s := ServeListener(&flakyListener{Listener: l, errs: []error{emfile, emfile, emfile}}, keepAliveHandler,
+		WithErrorLog(log.New(&logs, "", 0)))
+	defer s.Close()
+
+	_, br := sendRequest(t, s.Addr().String(), requestMessage("GET", "/after"))
+	_, body := readResponse(t, br)
+	assert.Equal(t, "hello /after", body)
+	stats := s.Stats()
+	assert.Equal(t, uint64(3), stats.AcceptErrors)
+	assert.Equal(t, uint64(1), stats.Accepted)
+	assert.Contains(t, logs.String(), "too many open files")
+	for _, delay := range []string{"5ms", "10ms", "20ms"} {
+		assert.Contains(t, logs.String(), "retrying in "+delay+"\n")
+	}
+
+	// Test: Other errors stop the accept loop without exiting the process
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var logs2 syncBuffer
+	s2 := ServeListener(&flakyListener{Listener: l2, errs: []error{errors.New("listener broke")}}, keepAliveHandler,
+		WithErrorLog(log.New(&logs2, "", 0)))
+	defer s2.Close()
+	require.Eventually(t, func() bool {
+		return strings.Contains(logs2.String(), "no longer serving: listener broke")
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(1), s2.Stats().AcceptErrors)
+	select {
+	case <-s2.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done not closed after a fatal accept error")
+	}
+	assert.EqualError(t, s2.Err(), "listener broke")
+
+	// Test: Closing the server ends it without an error
+	assert.NoError(t, s.Err())
+	s.Close()
+	<-s.Done()
+	assert.NoError(t, s.Err())
+
+	// Test: Classification of accept errors
+	assert.True(t, isTemporary(emfile))
+	assert.True(t, isTemporary(syscall.ECONNABORTED))
+	assert.False(t, isTemporary(net.ErrClosed))
+	assert.False(t, isTemporary(errors.New("boom")))
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// sniffLen is how much of a file detectContentType looks at.
+const sniffLen = 512
+
+type signature struct {
+	offset      int
+	magic       []byte
+	contentType string
+}
+
+var signatures = []signature{
+	{0, []byte("%PDF-"), "application/pdf"},
+	{0, []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	{0, []byte("\xff\xd8\xff"), "image/jpeg"},
+	{0, []byte("GIF87a"), "image/gif"},
+	{0, []byte("GIF89a"), "image/gif"},
+	{8, []byte("WEBP"), "image/webp"},
+	{4, []byte("ftyp"), "video/mp4"},
+	{0, []byte("\x1a\x45\xdf\xa3"), "video/webm"},
+	{0, []byte("OggS"), "application/ogg"},
+	{0, []byte("ID3"), "audio/mpeg"},
+	{0, []byte("wOFF"), "font/woff"},
+	{0, []byte("wOF2"), "font/woff2"},
+	{0, []byte("\x1f\x8b\x08"), "application/gzip"},
+	{0, []byte("PK\x03\x04"), "application/zip"},
+	{0, []byte("\x00asm"), "application/wasm"},
+}
+
+// htmlTags must be followed by a space or '>' to count, so "<pre" is not
+// taken for "<p".
+var htmlTags = []string{
+	"<!doctype html", "<html", "<head", "<body", "<script", "<title", "<div", "<p", "<h1", "<table",
+}
+
+// detectContentType guesses the type of data from its first bytes, for
+// files whose extension says nothing. It recognizes common binary
+// formats and HTML, and falls back to plain text for anything that is
+// valid UTF-8 without control characters.
+func detectContentType(data []byte) string {
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	for _, sig := range signatures {
+		if len(data) >= sig.offset+len(sig.magic) && bytes.Equal(data[sig.offset:sig.offset+len(sig.magic)], sig.magic) {
+			return sig.contentType
+		}
+	}
+
+	text := bytes.TrimLeft(data, "\t\n\x0c\r ")
+	text = bytes.TrimPrefix(text, []byte("\xef\xbb\xbf"))
+	for _, tag := range htmlTags {
+		if len(text) > len(tag) && bytes.EqualFold(text[:len(tag)], []byte(tag)) &&
+			(text[len(tag)] == ' ' || text[len(tag)] == '>') {
+			return "text/html; charset=utf-8"
+		}
+	}
+	if bytes.HasPrefix(text, []byte("<!--")) {
+		return "text/html; charset=utf-8"
+	}
+	if bytes.HasPrefix(text, []byte("<?xml")) {
+		return "text/xml; charset=utf-8"
+	}
+	if isText(data) {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+func isText(data []byte) bool {
+	for i := 0; i < len(data); {
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size == 1 {
+			// A multi-byte rune cut off by the sniff limit is still text.
+			return len(data) == sniffLen && len(data)-i < utf8.UTFMax && !utf8.FullRune(data[i:])
+		}
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\x0c' && r != '\x1b' {
+			return false
+		}
+		i += size
+	}
+	return true
+}
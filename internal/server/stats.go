@@ -0,0 +1,45 @@
+package server
+
+import "sync/atomic"
+
+// Stats is a snapshot of the server's counters.
+type Stats struct {
+	Accepted           uint64
+	AcceptErrors       uint64
+	ReadHeaderTimeouts uint64
+	ReadTimeouts       uint64
+	WriteTimeouts      uint64
+	IdleTimeouts       uint64
+	RejectedConns      uint64
+	RejectedRequests   uint64
+	Panics             uint64
+	TLSHandshakeErrors uint64
+}
+
+type stats struct {
+	accepted           atomic.Uint64
+	acceptErrors       atomic.Uint64
+	readHeaderTimeouts atomic.Uint64
+	readTimeouts       atomic.Uint64
+	writeTimeouts      atomic.Uint64
+	idleTimeouts       atomic.Uint64
+	rejectedConns      atomic.Uint64
+	rejectedRequests   atomic.Uint64
+	panics             atomic.Uint64
+	tlsHandshakeErrors atomic.Uint64
+}
+
+func (s *Server) Stats() Stats {
+	return Stats{
+		Accepted:           s.stats.accepted.Load(),
+		AcceptErrors:       s.stats.acceptErrors.Load(),
+		ReadHeaderTimeouts: s.stats.readHeaderTimeouts.Load(),
+		ReadTimeouts:       s.stats.readTimeouts.Load(),
+		WriteTimeouts:      s.stats.writeTimeouts.Load(),
+		IdleTimeouts:       s.stats.idleTimeouts.Load(),
+		RejectedConns:      s.stats.rejectedConns.Load(),
+		RejectedRequests:   s.stats.rejectedRequests.Load(),
+		Panics:             s.stats.panics.Load(),
+		TLSHandshakeErrors: s.stats.tlsHandshakeErrors.Load(),
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyPair names the PEM files holding a certificate chain and its key.
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+type TLSConfig struct {
+	// Certificates are picked by the server name the client asks for
+	// (SNI). The first one is used when no other matches.
+	Certificates []KeyPair
+	// MinVersion defaults to TLS 1.2.
+	MinVersion uint16
+	// CipherSuites limits the TLS 1.2 suites; TLS 1.3 suites are fixed.
+	CipherSuites []uint16
+	// ReloadInterval is how often the files are checked for changes.
+	// Zero means certificates are only reloaded by ReloadCertificates.
+	ReloadInterval time.Duration
+	// ClientAuth decides whether clients must present a certificate
+	// signed by one of ClientCAs. Verified identities are available to
+	// handlers as request.Request.Peer.
+	ClientAuth ClientAuth
+	ClientCAs  *x509.CertPool
+}
+
+// ClientAuth is the policy for client certificates.
+type ClientAuth int
+
+const (
+	// ClientAuthNone doesn't ask for a client certificate.
+	ClientAuthNone ClientAuth = iota
+	// ClientAuthOptional verifies a certificate if the client sends one
+	// but lets clients without one through.
+	ClientAuthOptional
+	// ClientAuthRequired fails the handshake unless the client sends a
+	// certificate that verifies.
+	ClientAuthRequired
+)
+
+var (
+	ErrNoCertificates = errors.New("server: TLS needs at least one certificate")
+	ErrNoClientCAs    = errors.New("server: client authentication needs a CA pool")
+)
+
+// ServeTLS listens on address like ServeAddr and serves HTTPS, offering
+// h2 and http/1.1 through ALPN.
+func ServeTLS(network, address string, config TLSConfig, handler Handler, opts ...Option) (*Server, error) {
+	clientAuth := tls.NoClientCert
+	switch config.ClientAuth {
+	case ClientAuthOptional:
+		clientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequired:
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	if clientAuth != tls.NoClientCert && config.ClientCAs == nil {
+		return nil, ErrNoClientCAs
+	}
+	certs, err := loadCertStore(config.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion := config.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.getCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   config.CipherSuites,
+		NextProtos:     []string{"h2", "http/1.1"},
+		ClientAuth:     clientAuth,
+		ClientCAs:      config.ClientCAs,
+	}
+
+	opts = append(opts, func(s *Server) { s.certs = certs })
+	s := ServeListener(tls.NewListener(l, tlsConfig), handler, opts...)
+	if config.ReloadInterval > 0 {
+		go certs.watch(config.ReloadInterval, s.shutdown, s.logf)
+	}
+	return s, nil
+}
+
+// ReloadCertificates rereads the certificate files of a TLS server. If
+// any of them fails to load the current certificates stay in use.
+func (s *Server) ReloadCertificates() error {
+	if s.certs == nil {
+		return errors.New("server: not serving TLS")
+	}
+	return s.certs.load()
+}
+
+// certStore holds the loaded certificates, indexed by the names they are
+// valid for, and swaps them when the files change.
+type certStore struct {
+	pairs []KeyPair
+
+	mu     sync.RWMutex
+	certs  []*tls.Certificate
+	byName map[string]*tls.Certificate
+	stamps []fileStamp
+}
+
+type fileStamp struct {
+	certMod, keyMod time.Time
+}
+
+func loadCertStore(pairs []KeyPair) (*certStore, error) {
+	if len(pairs) == 0 {
+		return nil, ErrNoCertificates
+	}
+	cs := &certStore{pairs: pairs}
+	if err := cs.load(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (cs *certStore) load() error {
+	stamps, err := cs.stat()
+	if err != nil {
+		return err
+	}
+	certs := make([]*tls.Certificate, 0, len(cs.pairs))
+	byName := map[string]*tls.Certificate{}
+	for _, p := range cs.pairs {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return fmt.Errorf("server: loading %s: %w", p.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("server: parsing %s: %w", p.CertFile, err)
+			}
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// Earlier certificates win when names overlap.
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+		certs = append(certs, &cert)
+	}
+
+	cs.mu.Lock()
+	cs.certs = certs
+	cs.byName = byName
+	cs.stamps = stamps
+	cs.mu.Unlock()
+	return nil
+}
+
+func (cs *certStore) stat() ([]fileStamp, error) {
+	stamps := make([]fileStamp, len(cs.pairs))
+	for i, p := range cs.pairs {
+		certInfo, err := os.Stat(p.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		keyInfo, err := os.Stat(p.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = fileStamp{certInfo.ModTime(), keyInfo.ModTime()}
+	}
+	return stamps, nil
+}
+
+func (cs *certStore) changed() bool {
+	stamps, err := cs.stat()
+	if err != nil {
+		// Files mid-replacement; look again next time.
+		return false
+	}
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for i := range stamps {
+		if !stamps[i].certMod.Equal(cs.stamps[i].certMod) || !stamps[i].keyMod.Equal(cs.stamps[i].keyMod) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the certificates whenever their files change until done
+// is closed. A failed reload (say, the key was written but not yet the
+// certificate) is retried on the next tick.
+func (cs *certStore) watch(interval time.Duration, done <-chan struct{}, logf func(string, ...any)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if !cs.changed() {
+			continue
+		}
+		if err := cs.load(); err != nil {
+			logf("server: reloading certificates: %v", err)
+		}
+	}
+}
+
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := cs.byName[name]; ok {
+		return cert, nil
+	}
+	if _, rest, ok := strings.Cut(name, "."); ok {
+		if cert, ok := cs.byName["*."+rest]; ok {
+			return cert, nil
+		}
+	}
+	return cs.certs[0], nil
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/http2"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var serial int64
+
+// newTestCert creates a certificate for names signed by parent, or
+// self-signed when parent is nil.
+func newTestCert(t *testing.T, parent *testCert, isCA bool, cn string, names ...string) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+// writeFiles stores the certificate and key as PEM files in dir.
+func (c *testCert) writeFiles(t *testing.T, dir, name string) KeyPair {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	pair := KeyPair{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	require.NoError(t, os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600))
+	require.NoError(t, os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return pair
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+func startTLSServer(t *testing.T, config TLSConfig, handler Handler, opts ...Option) *Server {
+	t.Helper()
+	opts = append(opts, WithErrorLog(log.New(io.Discard, "", 0)))
+	s, err := ServeTLS("tcp", "127.0.0.1:0", config, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// peerCert connects with serverName and returns the certificate served.
+func peerCert(t *testing.T, s *Server, serverName string) *x509.Certificate {
+	t.Helper()
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, true, "Test CA")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	a := newTestCert(t, ca, false, "a", "a.test")
+	b := newTestCert(t, ca, false, "b", "*.b.test")
+	s := startTLSServer(t, TLSConfig{Certificates: []KeyPair{
+		a.writeFiles(t, dir, "a"),
+		b.writeFiles(t, dir, "b"),
+	}}, keepAliveHandler)
+
+	// Test: HTTP/1.1 over TLS with a verified certificate
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{ServerName: "a.test", RootCAs: pool, NextProtos: []string{"http/1.1"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "http/1.1", conn.ConnectionState().NegotiatedProtocol)
+	_, err = io.WriteString(conn, "GET /secure HTTP/1.1\r\nHost: a.test\r\n\r\n")
+	require.NoError(t, err)
+	br := bufio.NewReader(conn)
+	_, body := readResponse(t, br)
+	assert.Equal(t, "hello /secure", body)
+
+	// Test: Upgrade: h2c is ignored over TLS and the request is served as HTTP/1.1
+	_, err = io.WriteString(conn, "GET /upgrade HTTP/1.1\r\nHost: a.test\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	require.NoError(t, err)
+	head, body := readResponse(t, br)
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 200 OK\r\n"), head)
+	assert.Equal(t, "hello /upgrade", body)
+
+	// Test: Certificates are selected by SNI, including wildcards
+	assert.Equal(t, a.cert.SerialNumber, peerCert(t, s, "a.test").SerialNumber)
+	assert.Equal(t, b.cert.SerialNumber, peerCert(t, s, "api.b.test").SerialNumber)
+	assert.Equal(t, b.cert.SerialNumber, peerCert(t, s, "API.B.TEST").SerialNumber)
+
+	// Test: Unknown names and clients without SNI get the first certificate
+	assert.Equal(t, a.cert.SerialNumber, peerCert(t, s, "other.test").SerialNumber)
+	assert.Equal(t, a.cert.SerialNumber, peerCert(t, s, "").SerialNumber)
+
+	// Test: ALPN selects h2 when offered
+	h2conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{ServerName: "a.test", RootCAs: pool, NextProtos: []string{"h2", "http/1.1"}})
+	require.NoError(t, err)
+	defer h2conn.Close()
+	assert.Equal(t, "h2", h2conn.ConnectionState().NegotiatedProtocol)
+	_, err = io.WriteString(h2conn, http2.ClientPreface)
+	require.NoError(t, err)
+	frame := make([]byte, 9)
+	_, err = io.ReadFull(h2conn, frame)
+	require.NoError(t, err)
+	assert.Equal(t, byte(http2.FrameSettings), frame[3])
+
+	// Test: Failed handshakes are counted
+	raw, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{ServerName: "a.test"})
+	if err == nil {
+		raw.Close()
+	}
+	assert.Error(t, err)
+	require.Eventually(t, func() bool { return s.Stats().TLSHandshakeErrors == 1 }, time.Second, time.Millisecond)
+}
+
+func TestServeTLSVersionsAndSuites(t *testing.T) {
+	dir := t.TempDir()
+	pair := newTestCert(t, nil, false, "localhost", "localhost").writeFiles(t, dir, "local")
+
+	// Test: Clients below the minimum version are refused
+	s := startTLSServer(t, TLSConfig{Certificates: []KeyPair{pair}, MinVersion: tls.VersionTLS13}, keepAliveHandler)
+	_, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	assert.Error(t, err)
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), conn.ConnectionState().Version)
+	conn.Close()
+
+	// Test: TLS 1.2 uses only the configured cipher suites
+	suite := tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256
+	s = startTLSServer(t, TLSConfig{Certificates: []KeyPair{pair}, CipherSuites: []uint16{suite}}, keepAliveHandler)
+	conn, err = tls.Dial("tcp", s.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+	assert.Equal(t, suite, conn.ConnectionState().CipherSuite)
+	conn.Close()
+	_, err = tls.Dial("tcp", s.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	assert.Error(t, err)
+
+	// Test: A server can't start without certificates or with bad files
+	_, err = ServeTLS("tcp", "127.0.0.1:0", TLSConfig{}, keepAliveHandler)
+	assert.ErrorIs(t, err, ErrNoCertificates)
+	_, err = ServeTLS("tcp", "127.0.0.1:0", TLSConfig{Certificates: []KeyPair{{CertFile: pair.KeyFile, KeyFile: pair.KeyFile}}}, keepAliveHandler)
+	assert.Error(t, err)
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, nil, false, "first", "reload.test")
+	pair := first.writeFiles(t, dir, "site")
+	s := startTLSServer(t, TLSConfig{Certificates: []KeyPair{pair}, ReloadInterval: 10 * time.Millisecond}, keepAliveHandler)
+	assert.Equal(t, first.cert.SerialNumber, peerCert(t, s, "reload.test").SerialNumber)
+
+	// Test: Replacing the files swaps the certificate for new connections
+	second := newTestCert(t, nil, false, "second", "reload.test")
+	second.writeFiles(t, dir, "site")
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(pair.CertFile, later, later))
+	require.NoError(t, os.Chtimes(pair.KeyFile, later, later))
+	require.Eventually(t, func() bool {
+		return peerCert(t, s, "reload.test").SerialNumber.Cmp(second.cert.SerialNumber) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Test: A broken file keeps the current certificate in use
+	require.NoError(t, os.WriteFile(pair.CertFile, []byte("not a certificate"), 0o600))
+	assert.Error(t, s.ReloadCertificates())
+	assert.Equal(t, second.cert.SerialNumber, peerCert(t, s, "reload.test").SerialNumber)
+
+	// Test: Manual reload picks up a fixed file
+	third := newTestCert(t, nil, false, "third", "reload.test")
+	third.writeFiles(t, dir, "site")
+	require.NoError(t, s.ReloadCertificates())
+	assert.Equal(t, third.cert.SerialNumber, peerCert(t, s, "reload.test").SerialNumber)
+
+	// Test: Plain servers have nothing to reload
+	plain, _ := startServer(t, keepAliveHandler)
+	assert.Error(t, plain.ReloadCertificates())
+}
+
+func identityHandler(w *response.Writer, req *request.Request) {
+	body := "anonymous"
+	if req.Peer != nil {
+		body = fmt.Sprintf("cn=%s dns=%s chain=%d", req.Peer.Subject.CommonName,
+			strings.Join(req.Peer.DNSNames, ","), len(req.Peer.Chain))
+	}
+	if req.TLS == nil {
+		body += " plaintext"
+	}
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+}
+
+// identity makes a request presenting certs and returns the body, or the
+// error if the server refused the connection.
+func identity(t *testing.T, s *Server, pool *x509.CertPool, certs ...tls.Certificate) (string, error) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{
+		ServerName: "localhost",
+		RootCAs:    pool,
+		// Present the certificate even when the server wouldn't accept
+		// its issuer, which Certificates alone doesn't do.
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if len(certs) == 0 {
+				return &tls.Certificate{}, nil
+			}
+			return &certs[0], nil
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// With TLS 1.3 the client learns its certificate was refused only
+	// when it next reads.
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+		return "", err
+	}
+	br := bufio.NewReader(conn)
+	if _, err := br.Peek(1); err != nil {
+		return "", err
+	}
+	_, body := readResponse(t, br)
+	return body, nil
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, nil, true, "Test CA")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	pair := newTestCert(t, ca, false, "localhost", "localhost").writeFiles(t, dir, "server")
+	client := newTestCert(t, ca, false, "billing", "billing.internal", "billing.svc").tlsCertificate()
+	stranger := newTestCert(t, nil, false, "mallory", "billing.internal").tlsCertificate()
+
+	// Test: Required mode exposes the verified identity
+	s := startTLSServer(t, TLSConfig{Certificates: []KeyPair{pair}, ClientAuth: ClientAuthRequired, ClientCAs: pool}, identityHandler)
+	body, err := identity(t, s, pool, client)
+	require.NoError(t, err)
+	assert.Equal(t, "cn=billing dns=billing.internal,billing.svc chain=2", body)
+
+	// Test: Required mode refuses clients without a certificate or with an untrusted one
+	_, err = identity(t, s, pool)
+	assert.Error(t, err)
+	_, err = identity(t, s, pool, stranger)
+	assert.Error(t, err)
+	require.Eventually(t, func() bool { return s.Stats().TLSHandshakeErrors == 2 }, time.Second, time.Millisecond)
+
+	// Test: Optional mode lets anonymous clients through but still verifies
+	s = startTLSServer(t, TLSConfig{Certificates: []KeyPair{pair}, ClientAuth: ClientAuthOptional, ClientCAs: pool}, identityHandler)
+	body, err = identity(t, s, pool)
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", body)
+	body, err = identity(t, s, pool, client)
+	require.NoError(t, err)
+	assert.Equal(t, "cn=billing dns=billing.internal,billing.svc chain=2", body)
+	_, err = identity(t, s, pool, stranger)
+	assert.Error(t, err)
+
+	// Test: No client authentication ignores certificates
+	s = startTLSServer(t, TLSConfig{Certificates: []KeyPair{pair}}, identityHandler)
+	body, err = identity(t, s, pool, client)
+	require.NoError(t, err)
+	assert.Equal(t, "anonymous", body)
+
+	// Test: Plain connections carry no TLS state
+	_, addr := startServer(t, identityHandler)
+	_, br := sendRequest(t, addr, requestMessage("GET", "/"))
+	_, body = readResponse(t, br)
+	assert.Equal(t, "anonymous plaintext", body)
+
+	// Test: Client authentication needs a CA pool
+	_, err = ServeTLS("tcp", "127.0.0.1:0", TLSConfig{Certificates: []KeyPair{pair}, ClientAuth: ClientAuthRequired}, identityHandler)
+	assert.ErrorIs(t, err, ErrNoClientCAs)
+}
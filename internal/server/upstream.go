@@ -0,0 +1,393 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/client"
+	"httpfromtcp/internal/request"
+)
+
+// Balance is how a Pool spreads requests over its backends.
+type Balance int
+
+const (
+	// RoundRobin sends requests to each backend in turn.
+	RoundRobin Balance = iota
+	// LeastConnections sends each request to the backend with the fewest
+	// requests in flight.
+	LeastConnections
+	// ConsistentHash sends requests with the same key to the same backend.
+	// When a backend goes away only its own keys move elsewhere.
+	ConsistentHash
+)
+
+const (
+	defaultHealthPath         = "/"
+	defaultHealthTimeout      = 2 * time.Second
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+	defaultFailTimeout        = 10 * time.Second
+	// hashReplicas is how many points each backend has on the hash ring,
+	// which evens out the share of keys each one gets.
+	hashReplicas = 100
+	// fullWeight is the weight of a backend that isn't slow-starting.
+	fullWeight = 100
+)
+
+var ErrNoBackends = errors.New("server: pool has no backends")
+
+// HealthCheck configures requests a Pool sends to each backend in the
+// background. A backend answering 2xx or 3xx passes.
+type HealthCheck struct {
+	// Path is requested on each backend, "/" by default.
+	Path string
+	// Interval between checks. Zero disables active checks.
+	Interval time.Duration
+	// Timeout for each check, 2 seconds by default.
+	Timeout time.Duration
+	// HealthyThreshold is how many checks in a row a failed backend must
+	// pass to get traffic again, 2 by default.
+	HealthyThreshold int
+	// UnhealthyThreshold is how many checks in a row a backend must fail
+	// to lose its traffic, 3 by default.
+	UnhealthyThreshold int
+}
+
+type PoolConfig struct {
+	Backends []*url.URL
+	Balance  Balance
+	// HashHeader is the request header ConsistentHash keys on. Requests
+	// without it, or any requests if it is empty, are keyed on the client
+	// IP.
+	HashHeader  string
+	HealthCheck HealthCheck
+	// MaxFails failed requests in a row take a backend out of rotation
+	// for FailTimeout (10 seconds by default). A request fails if the
+	// backend can't be reached, times out or answers 502, 503 or 504.
+	// Zero disables this.
+	MaxFails    int
+	FailTimeout time.Duration
+	// SlowStart ramps the share of requests a backend gets up from
+	// nothing over this long once it comes back, so a cold backend isn't
+	// flooded. ConsistentHash ignores it.
+	SlowStart time.Duration
+	// Client sends health checks, like ReverseProxy.Client.
+	Client *client.Client
+}
+
+// BackendStatus describes a backend at one moment.
+type BackendStatus struct {
+	URL *url.URL
+	// Healthy is false while the backend fails active checks.
+	Healthy bool
+	// Ejected is true while the backend is out after failed requests.
+	Ejected bool
+	// Active is the number of requests in flight.
+	Active int
+}
+
+// Pool is a set of interchangeable upstreams for a ReverseProxy.
+type Pool struct {
+	config PoolConfig
+
+	mu       sync.Mutex
+	backends []*backend
+	ring     []ringPoint
+	next     int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type backend struct {
+	url *url.URL
+	// healthy, successes and failures track active checks.
+	healthy   bool
+	successes int
+	failures  int
+	// fails counts failed requests in a row.
+	fails        int
+	ejectedUntil time.Time
+	// recovered is when the backend last passed its health checks again.
+	recovered time.Time
+	active    int
+	// current is the smooth weighted round-robin counter.
+	current int
+}
+
+type ringPoint struct {
+	hash    uint64
+	backend *backend
+}
+
+// NewPool creates a pool and starts its health checks, which run until
+// Close.
+func NewPool(config PoolConfig) (*Pool, error) {
+	if len(config.Backends) == 0 {
+		return nil, ErrNoBackends
+	}
+	hc := &config.HealthCheck
+	if hc.Path == "" {
+		hc.Path = defaultHealthPath
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = defaultHealthTimeout
+	}
+	if hc.HealthyThreshold <= 0 {
+		hc.HealthyThreshold = defaultHealthyThreshold
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		hc.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if config.FailTimeout <= 0 {
+		config.FailTimeout = defaultFailTimeout
+	}
+	if config.Client == nil {
+		config.Client = defaultProxyClient
+	}
+	config.HashHeader = strings.ToLower(config.HashHeader)
+
+	p := &Pool{config: config, stop: make(chan struct{})}
+	for _, u := range config.Backends {
+		b := &backend{url: u, healthy: true}
+		p.backends = append(p.backends, b)
+		for i := range hashReplicas {
+			p.ring = append(p.ring, ringPoint{hashKey(u.String() + "#" + strconv.Itoa(i)), b})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+
+	if hc.Interval > 0 {
+		go p.checkLoop()
+	}
+	return p, nil
+}
+
+// Close stops the health checks.
+func (p *Pool) Close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+func (p *Pool) Backends() []BackendStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	statuses := make([]BackendStatus, len(p.backends))
+	for i, b := range p.backends {
+		statuses[i] = BackendStatus{
+			URL:     b.url,
+			Healthy: b.healthy,
+			Ejected: now.Before(b.ejectedUntil),
+			Active:  b.active,
+		}
+	}
+	return statuses
+}
+
+// pick chooses the backend for req and counts it as in flight until
+// release, or returns nil if none is available.
+func (p *Pool) pick(req *request.Request) *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var b *backend
+	switch p.config.Balance {
+	case LeastConnections:
+		b = p.pickLeast(now)
+	case ConsistentHash:
+		b = p.pickHash(req, now)
+	default:
+		b = p.pickRoundRobin(now)
+	}
+	if b != nil {
+		b.active++
+	}
+	return b
+}
+
+// pickRoundRobin is nginx's smooth weighted round-robin: with equal
+// weights it takes each backend in turn, and a slow-starting one is
+// spread out evenly between the others rather than getting a burst.
+func (p *Pool) pickRoundRobin(now time.Time) *backend {
+	var best *backend
+	total := 0
+	for _, b := range p.backends {
+		if !p.available(b, now) {
+			continue
+		}
+		w := p.weight(b, now)
+		b.current += w
+		total += w
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+func (p *Pool) pickLeast(now time.Time) *backend {
+	// Starting the scan one further each time shares ties out.
+	p.next++
+	var best *backend
+	bestWeight := 0
+	for i := range p.backends {
+		b := p.backends[(p.next+i)%len(p.backends)]
+		if !p.available(b, now) {
+			continue
+		}
+		// Compare (active+1)/weight without dividing.
+		w := p.weight(b, now)
+		if best == nil || (b.active+1)*bestWeight < (best.active+1)*w {
+			best, bestWeight = b, w
+		}
+	}
+	return best
+}
+
+func (p *Pool) pickHash(req *request.Request, now time.Time) *backend {
+	key := req.Headers[p.config.HashHeader]
+	if p.config.HashHeader == "" || key == "" {
+		key = clientIP(req)
+	}
+	h := hashKey(key)
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	for i := range p.ring {
+		point := p.ring[(start+i)%len(p.ring)]
+		if p.available(point.backend, now) {
+			return point.backend
+		}
+	}
+	return nil
+}
+
+// release ends a request picked for b, which failed if the backend was
+// at fault.
+func (p *Pool) release(b *backend, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.active--
+	if p.config.MaxFails <= 0 {
+		return
+	}
+	if !failed {
+		b.fails = 0
+		return
+	}
+	b.fails++
+	if b.fails >= p.config.MaxFails {
+		b.fails = 0
+		b.ejectedUntil = time.Now().Add(p.config.FailTimeout)
+	}
+}
+
+func (p *Pool) available(b *backend, now time.Time) bool {
+	return b.healthy && !now.Before(b.ejectedUntil)
+}
+
+// weight is fullWeight, or less while the backend is slow-starting after
+// passing its health checks again or coming back from ejection.
+func (p *Pool) weight(b *backend, now time.Time) int {
+	since := b.recovered
+	if b.ejectedUntil.After(since) {
+		since = b.ejectedUntil
+	}
+	if p.config.SlowStart <= 0 || since.IsZero() {
+		return fullWeight
+	}
+	elapsed := now.Sub(since)
+	if elapsed >= p.config.SlowStart {
+		return fullWeight
+	}
+	return max(1, int(fullWeight*elapsed/p.config.SlowStart))
+}
+
+func (p *Pool) checkLoop() {
+	ticker := time.NewTicker(p.config.HealthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range p.backends {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.recordCheck(b, p.check(b))
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) check(b *backend) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.HealthCheck.Timeout)
+	defer cancel()
+	target := *b.url
+	target.Path = joinURLPath(b.url.Path, p.config.HealthCheck.Path)
+	target.RawPath = ""
+	res, err := p.config.Client.Get(ctx, target.String())
+	if err != nil {
+		return false
+	}
+	// Reading a little of the body lets a small one keep the connection.
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+	return res.StatusCode >= 200 && res.StatusCode < 400
+}
+
+func (p *Pool) recordCheck(b *backend, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hc := p.config.HealthCheck
+	if ok {
+		b.failures = 0
+		b.successes++
+		if !b.healthy && b.successes >= hc.HealthyThreshold {
+			b.healthy = true
+			b.recovered = time.Now()
+		}
+		return
+	}
+	b.successes = 0
+	b.failures++
+	if b.healthy && b.failures >= hc.UnhealthyThreshold {
+		b.healthy = false
+	}
+}
+
+func clientIP(req *request.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	// FNV barely spreads keys that differ in the last byte, like the
+	// replicas of one backend, so finish with the splitmix64 mixer.
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBackend answers with its name, or with status if it is set.
+type testBackend struct {
+	name   string
+	url    *url.URL
+	status atomic.Int32
+	health atomic.Int32
+	hits   atomic.Int32
+	gate   chan struct{}
+}
+
+func (b *testBackend) serve(w *response.Writer, req *request.Request) {
+	if req.Path() == "/health" {
+		code := response.StatusOK
+		if c := b.health.Load(); c != 0 {
+			code = response.StatusCode(c)
+		}
+		writeError(w, code, "", nil)
+		return
+	}
+	b.hits.Add(1)
+	if b.gate != nil && req.Path() == "/slow" {
+		<-b.gate
+	}
+	code := response.StatusOK
+	if c := b.status.Load(); c != 0 {
+		code = response.StatusCode(c)
+	}
+	w.WriteStatusLine(code)
+	h := headers.NewHeaders()
+	h.Set("content-length", strconv.Itoa(len(b.name)))
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(b.name))
+}
+
+// poolProxy starts each backend and returns a proxy that spreads
+// requests over them.
+func poolProxy(t *testing.T, config PoolConfig, backends ...*testBackend) *ReverseProxy {
+	t.Helper()
+	for _, b := range backends {
+		_, addr := startServer(t, b.serve)
+		b.url = &url.URL{Scheme: "http", Host: addr}
+		config.Backends = append(config.Backends, b.url)
+	}
+	pool, err := NewPool(config)
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+	return &ReverseProxy{Pool: pool, ErrorLog: log.New(io.Discard, "", 0)}
+}
+
+func TestPoolBalance(t *testing.T) {
+	// Test: Round-robin takes each backend in turn
+	p := poolProxy(t, PoolConfig{}, &testBackend{name: "a"}, &testBackend{name: "b"}, &testBackend{name: "c"})
+	_, addr := startServer(t, p.ServeRequest)
+	var got []string
+	for range 6 {
+		_, body := roundTrip(t, addr, requestMessage("GET", "/"))
+		got = append(got, body)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, got)
+
+	// Test: Least-connections avoids a backend busy with a slow request
+	busy := []*testBackend{{name: "busy", gate: make(chan struct{})}, {name: "free", gate: make(chan struct{})}}
+	p = poolProxy(t, PoolConfig{Balance: LeastConnections}, busy...)
+	pool := p.Pool
+	_, addr = startServer(t, p.ServeRequest)
+	done := make(chan string)
+	go func() {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			done <- ""
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		body, _ := io.ReadAll(conn)
+		done <- string(body)
+	}()
+	require.Eventually(t, func() bool {
+		for _, s := range pool.Backends() {
+			if s.Active == 1 {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 5*time.Millisecond)
+	slow := "busy"
+	if pool.Backends()[1].Active == 1 {
+		slow = "free"
+	}
+	for range 3 {
+		_, body := roundTrip(t, addr, requestMessage("GET", "/"))
+		assert.NotEqual(t, slow, body)
+	}
+	close(busy[0].gate)
+	close(busy[1].gate)
+	assert.Contains(t, <-done, slow)
+}
+
+func TestPoolConsistentHash(t *testing.T) {
+	backends := []*testBackend{{name: "a"}, {name: "b"}, {name: "c"}}
+	p := poolProxy(t, PoolConfig{
+		Balance:     ConsistentHash,
+		HashHeader:  "X-User",
+		MaxFails:    1,
+		FailTimeout: time.Minute,
+	}, backends...)
+	pool := p.Pool
+	_, addr := startServer(t, p.ServeRequest)
+
+	// Test: Requests with the same key go to the same backend
+	owners := map[string]string{}
+	for i := range 30 {
+		key := "user-" + strconv.Itoa(i)
+		_, first := roundTrip(t, addr, requestMessage("GET", "/", "X-User: "+key))
+		_, second := roundTrip(t, addr, requestMessage("GET", "/", "X-User: "+key))
+		assert.Equal(t, first, second)
+		owners[key] = first
+	}
+	seen := map[string]bool{}
+	for _, owner := range owners {
+		seen[owner] = true
+	}
+	assert.Len(t, seen, 3)
+
+	// Test: Without the header the client IP is the key
+	_, first := roundTrip(t, addr, requestMessage("GET", "/"))
+	for range 3 {
+		_, body := roundTrip(t, addr, requestMessage("GET", "/"))
+		assert.Equal(t, first, body)
+	}
+
+	// Test: Losing a backend only moves its own keys
+	backends[0].status.Store(int32(response.StatusServiceUnavailable))
+	for key, owner := range owners {
+		if owner == "a" {
+			roundTrip(t, addr, requestMessage("GET", "/", "X-User: "+key))
+			break
+		}
+	}
+	assert.True(t, pool.Backends()[0].Ejected)
+	for key, owner := range owners {
+		_, body := roundTrip(t, addr, requestMessage("GET", "/", "X-User: "+key))
+		if owner == "a" {
+			assert.NotEqual(t, "a", body)
+		} else {
+			assert.Equal(t, owner, body, key)
+		}
+	}
+}
+
+func TestPoolHealthChecks(t *testing.T) {
+	backends := []*testBackend{{name: "a"}, {name: "b"}}
+	p := poolProxy(t, PoolConfig{
+		HealthCheck: HealthCheck{
+			Path:               "/health",
+			Interval:           10 * time.Millisecond,
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 2,
+		},
+	}, backends...)
+	pool := p.Pool
+	_, addr := startServer(t, p.ServeRequest)
+
+	// Test: A backend failing its checks stops getting requests
+	backends[1].health.Store(int32(response.StatusInternalServerError))
+	require.Eventually(t, func() bool { return !pool.Backends()[1].Healthy }, time.Second, 5*time.Millisecond)
+	for range 4 {
+		_, body := roundTrip(t, addr, requestMessage("GET", "/"))
+		assert.Equal(t, "a", body)
+	}
+
+	// Test: It gets them again once it passes
+	backends[1].health.Store(0)
+	require.Eventually(t, func() bool { return pool.Backends()[1].Healthy }, time.Second, 5*time.Millisecond)
+	seen := map[string]bool{}
+	for range 4 {
+		_, body := roundTrip(t, addr, requestMessage("GET", "/"))
+		seen[body] = true
+	}
+	assert.True(t, seen["b"])
+
+	// Test: With every backend down the proxy answers 503
+	backends[0].health.Store(int32(response.StatusInternalServerError))
+	backends[1].health.Store(int32(response.StatusInternalServerError))
+	require.Eventually(t, func() bool {
+		s := pool.Backends()
+		return !s[0].Healthy && !s[1].Healthy
+	}, time.Second, 5*time.Millisecond)
+	head, _ := roundTrip(t, addr, requestMessage("GET", "/"))
+	assert.Contains(t, head, "HTTP/1.1 503 Service Unavailable\r\n")
+}
+
+func TestPoolEjection(t *testing.T) {
+	backends := []*testBackend{{name: "a"}, {name: "b"}}
+	p := poolProxy(t, PoolConfig{
+		MaxFails:    2,
+		FailTimeout: 50 * time.Millisecond,
+		SlowStart:   time.Minute,
+	}, backends...)
+	pool := p.Pool
+	_, addr := startServer(t, p.ServeRequest)
+
+	// Test: Failed requests in a row eject a backend for a while
+	backends[1].status.Store(int32(response.StatusBadGateway))
+	for range 4 {
+		roundTrip(t, addr, requestMessage("GET", "/"))
+	}
+	assert.True(t, pool.Backends()[1].Ejected)
+	backends[1].status.Store(0)
+	before := backends[1].hits.Load()
+	for range 4 {
+		_, body := roundTrip(t, addr, requestMessage("GET", "/"))
+		assert.Equal(t, "a", body)
+	}
+	assert.Equal(t, before, backends[1].hits.Load())
+
+	// Test: Once back, a slow-starting backend gets a small share at first
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, pool.Backends()[1].Ejected)
+	before = backends[1].hits.Load()
+	for range 40 {
+		roundTrip(t, addr, requestMessage("GET", "/"))
+	}
+	assert.LessOrEqual(t, backends[1].hits.Load()-before, int32(2))
+
+	// Test: A pool needs backends
+	_, err := NewPool(PoolConfig{})
+	assert.ErrorIs(t, err, ErrNoBackends)
+}
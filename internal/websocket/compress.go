@@ -0,0 +1,151 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const maxWindow = 1 << 15
+
+// Every compressed message ends with an empty stored block that senders
+// strip; the extra final block lets the inflater hit a clean EOF.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// deflateParams holds the context takeover each side agreed to give up.
+// Keeping the context lets a message refer back to earlier ones, so the
+// server keeps its own unless the client asks otherwise.
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+}
+
+func (p *deflateParams) String() string {
+	s := "permessage-deflate"
+	if p.serverNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if p.clientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	return s
+}
+
+// negotiateDeflate picks the first permessage-deflate offer that can be
+// honoured. compress/flate always uses a 32KB window, so offers that
+// restrict the server's window are declined.
+func negotiateDeflate(header string) *deflateParams {
+	for _, offer := range strings.Split(header, ",") {
+		parts := strings.Split(offer, ";")
+		if strings.TrimSpace(parts[0]) != "permessage-deflate" {
+			continue
+		}
+		if params, ok := parseDeflateOffer(parts[1:]); ok {
+			return params
+		}
+	}
+	return nil
+}
+
+func parseDeflateOffer(rawParams []string) (*deflateParams, bool) {
+	params := &deflateParams{}
+	seen := map[string]bool{}
+	for _, raw := range rawParams {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(raw), "=")
+		name = strings.TrimSpace(name)
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if seen[name] {
+			return nil, false
+		}
+		seen[name] = true
+
+		switch name {
+		case "server_no_context_takeover":
+			if hasValue {
+				return nil, false
+			}
+			params.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			if hasValue {
+				return nil, false
+			}
+			params.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			if bits, err := strconv.Atoi(value); err != nil || bits != 15 {
+				return nil, false
+			}
+		case "client_max_window_bits":
+			if !hasValue {
+				continue
+			}
+			if bits, err := strconv.Atoi(value); err != nil || bits < 8 || bits > 15 {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+type deflater struct {
+	buf bytes.Buffer
+	fw  *flate.Writer
+}
+
+func (c *Conn) deflate(p []byte) ([]byte, error) {
+	if c.deflater == nil {
+		c.deflater = &deflater{}
+		fw, err := flate.NewWriter(&c.deflater.buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		c.deflater.fw = fw
+	} else if !c.writeContextTakeover {
+		c.deflater.fw.Reset(&c.deflater.buf)
+	}
+
+	d := c.deflater
+	d.buf.Reset()
+	if _, err := d.fw.Write(p); err != nil {
+		return nil, err
+	}
+	if err := d.fw.Flush(); err != nil {
+		return nil, err
+	}
+	out := bytes.TrimSuffix(d.buf.Bytes(), deflateTail[:4])
+	if len(out) == 0 {
+		out = []byte{0x00}
+	}
+	return bytes.Clone(out), nil
+}
+
+func (c *Conn) inflate(p []byte) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail))
+	var fr io.ReadCloser
+	if c.readContextTakeover {
+		fr = flate.NewReaderDict(src, c.inflateHistory)
+	} else {
+		fr = flate.NewReader(src)
+	}
+	defer fr.Close()
+
+	out, err := io.ReadAll(io.LimitReader(fr, c.maxSize+1))
+	if err != nil {
+		return nil, protocolError(CloseInvalidFramePayloadData, "invalid compressed data")
+	}
+	if int64(len(out)) > c.maxSize {
+		return nil, protocolError(CloseMessageTooBig, "message exceeds size limit")
+	}
+
+	if c.readContextTakeover {
+		history := append(c.inflateHistory, out...)
+		if len(history) > maxWindow {
+			history = history[len(history)-maxWindow:]
+		}
+		c.inflateHistory = bytes.Clone(history)
+	}
+	return out, nil
+}
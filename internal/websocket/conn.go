@@ -0,0 +1,477 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	continuationFrame MessageType = 0x0
+	TextMessage       MessageType = 0x1
+	BinaryMessage     MessageType = 0x2
+	CloseMessage      MessageType = 0x8
+	PingMessage       MessageType = 0x9
+	PongMessage       MessageType = 0xA
+)
+
+type CloseCode int
+
+const (
+	CloseNormalClosure           CloseCode = 1000
+	CloseGoingAway               CloseCode = 1001
+	CloseProtocolError           CloseCode = 1002
+	CloseUnsupportedData         CloseCode = 1003
+	CloseNoStatusReceived        CloseCode = 1005
+	CloseAbnormalClosure         CloseCode = 1006
+	CloseInvalidFramePayloadData CloseCode = 1007
+	ClosePolicyViolation         CloseCode = 1008
+	CloseMessageTooBig           CloseCode = 1009
+	CloseMandatoryExtension      CloseCode = 1010
+	CloseInternalServerErr       CloseCode = 1011
+)
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40
+	rsv2Bit = 0x20
+	rsv3Bit = 0x10
+	maskBit = 0x80
+)
+
+var ErrCloseSent = errors.New("websocket: close already sent")
+
+type CloseError struct {
+	Code CloseCode
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Text)
+}
+
+type Conn struct {
+	rwc          net.Conn
+	br           *bufio.Reader
+	isServer     bool
+	subprotocol  string
+	maxSize      int64
+	fragmentSize int
+
+	compression          bool
+	readContextTakeover  bool
+	writeContextTakeover bool
+	inflateHistory       []byte
+
+	writeMu   sync.Mutex
+	closeSent bool
+	deflater  *deflater
+
+	closeReceived bool
+	pongHandler   func(data []byte)
+}
+
+type frame struct {
+	fin     bool
+	rsv1    bool
+	opcode  MessageType
+	payload []byte
+}
+
+func newConn(rwc net.Conn, br *bufio.Reader, isServer bool, maxSize int64) *Conn {
+	if br == nil {
+		br = bufio.NewReader(rwc)
+	}
+	return &Conn{
+		rwc:      rwc,
+		br:       br,
+		isServer: isServer,
+		maxSize:  maxSize,
+	}
+}
+
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.rwc.RemoteAddr()
+}
+
+func (c *Conn) SetPongHandler(h func(data []byte)) {
+	c.pongHandler = h
+}
+
+// Close closes the underlying connection without a close handshake.
+func (c *Conn) Close() error {
+	return c.rwc.Close()
+}
+
+// ReadMessage returns the next complete data message. Pings are answered
+// and pongs dispatched while waiting. When the peer closes, the close is
+// echoed, the connection shut down, and a *CloseError returned. Protocol
+// violations fail the connection with the matching close code.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var (
+		messageType MessageType
+		compressed  bool
+		message     []byte
+		validated   int
+	)
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return 0, nil, c.failOnError(err)
+		}
+
+		switch f.opcode {
+		case PingMessage:
+			if err := c.writeControl(PongMessage, f.payload); err != nil && !errors.Is(err, ErrCloseSent) {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			if c.pongHandler != nil {
+				c.pongHandler(f.payload)
+			}
+			continue
+		case CloseMessage:
+			return 0, nil, c.handleClose(f.payload)
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "new data frame inside fragmented message")
+			}
+			messageType = f.opcode
+			compressed = f.rsv1
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "continuation frame without message")
+			}
+		}
+
+		if int64(len(message)+len(f.payload)) > c.maxSize {
+			return 0, nil, c.fail(CloseMessageTooBig, "message exceeds size limit")
+		}
+		message = append(message, f.payload...)
+
+		if messageType == TextMessage && !compressed {
+			n, ok := validUTF8Prefix(message[validated:], f.fin)
+			if !ok {
+				return 0, nil, c.fail(CloseInvalidFramePayloadData, "invalid utf-8 in text message")
+			}
+			validated += n
+		}
+
+		if !f.fin {
+			continue
+		}
+		if compressed {
+			message, err = c.inflate(message)
+			if err != nil {
+				return 0, nil, c.failOnError(err)
+			}
+			if messageType == TextMessage && !utf8.Valid(message) {
+				return 0, nil, c.fail(CloseInvalidFramePayloadData, "invalid utf-8 in text message")
+			}
+		}
+		if message == nil {
+			message = []byte{}
+		}
+		return messageType, message, nil
+	}
+}
+
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		if messageType == CloseMessage || messageType == PingMessage || messageType == PongMessage {
+			return c.writeControl(messageType, data)
+		}
+		return fmt.Errorf("websocket: unknown message type %d", messageType)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	compressed := false
+	if c.compression {
+		var err error
+		data, err = c.deflate(data)
+		if err != nil {
+			return err
+		}
+		compressed = true
+	}
+
+	size := c.fragmentSize
+	if size <= 0 || size > len(data) {
+		size = len(data)
+	}
+	opcode := messageType
+	for {
+		n := min(size, len(data))
+		fin := n == len(data)
+		if err := c.writeFrame(fin, compressed, opcode, data[:n]); err != nil {
+			return err
+		}
+		if fin {
+			return nil
+		}
+		data = data[n:]
+		opcode = continuationFrame
+		compressed = false
+	}
+}
+
+func (c *Conn) Ping(data []byte) error {
+	return c.writeControl(PingMessage, data)
+}
+
+// WriteClose starts the close handshake. The connection is shut down by
+// ReadMessage once the peer's close frame arrives.
+func (c *Conn) WriteClose(code CloseCode, reason string) error {
+	return c.writeControl(CloseMessage, closePayload(code, reason))
+}
+
+func (c *Conn) writeControl(opcode MessageType, payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return errors.New("websocket: control frame payload too large")
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+	return c.writeFrame(true, false, opcode, payload)
+}
+
+func (c *Conn) writeFrame(fin, rsv1 bool, opcode MessageType, payload []byte) error {
+	header := make([]byte, 2, 14)
+	header[0] = byte(opcode)
+	if fin {
+		header[0] |= finBit
+	}
+	if rsv1 {
+		header[0] |= rsv1Bit
+	}
+
+	switch {
+	case len(payload) <= 125:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+
+	buf := header
+	if !c.isServer {
+		header[1] |= maskBit
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(header, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(key, buf[start:])
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	_, err := c.rwc.Write(buf)
+	return err
+}
+
+func (c *Conn) readFrame() (*frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return nil, err
+	}
+
+	f := &frame{
+		fin:    head[0]&finBit != 0,
+		rsv1:   head[0]&rsv1Bit != 0,
+		opcode: MessageType(head[0] & 0x0F),
+	}
+	if head[0]&(rsv2Bit|rsv3Bit) != 0 {
+		return nil, protocolError(CloseProtocolError, "reserved bits set")
+	}
+
+	control := f.opcode >= CloseMessage
+	switch f.opcode {
+	case continuationFrame, TextMessage, BinaryMessage, CloseMessage, PingMessage, PongMessage:
+	default:
+		return nil, protocolError(CloseProtocolError, fmt.Sprintf("reserved opcode %d", f.opcode))
+	}
+	if f.rsv1 && (!c.compression || control || f.opcode == continuationFrame) {
+		return nil, protocolError(CloseProtocolError, "unexpected rsv1 bit")
+	}
+
+	masked := head[1]&maskBit != 0
+	if masked != c.isServer {
+		return nil, protocolError(CloseProtocolError, "incorrect frame masking")
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length&(1<<63) != 0 {
+			return nil, protocolError(CloseProtocolError, "invalid payload length")
+		}
+	}
+
+	if control && (!f.fin || length > maxControlPayload) {
+		return nil, protocolError(CloseProtocolError, "invalid control frame")
+	}
+	if length > uint64(c.maxSize) {
+		return nil, protocolError(CloseMessageTooBig, "frame exceeds size limit")
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, key[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	c.closeReceived = true
+	closeErr := &CloseError{Code: CloseNoStatusReceived}
+	var reply []byte
+
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, "invalid close payload")
+	case len(payload) >= 2:
+		closeErr.Code = CloseCode(binary.BigEndian.Uint16(payload))
+		closeErr.Text = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(CloseProtocolError, "invalid close code")
+		}
+		if !utf8.Valid(payload[2:]) {
+			return c.fail(CloseInvalidFramePayloadData, "invalid utf-8 in close reason")
+		}
+		reply = closePayload(closeErr.Code, "")
+	}
+
+	c.writeControl(CloseMessage, reply)
+	c.rwc.Close()
+	return closeErr
+}
+
+func (c *Conn) failOnError(err error) error {
+	var pe *CloseError
+	if errors.As(err, &pe) {
+		return c.fail(pe.Code, pe.Text)
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		c.rwc.Close()
+		return &CloseError{Code: CloseAbnormalClosure, Text: err.Error()}
+	}
+	return err
+}
+
+func (c *Conn) fail(code CloseCode, reason string) error {
+	c.writeControl(CloseMessage, closePayload(code, reason))
+	c.rwc.Close()
+	return &CloseError{Code: code, Text: reason}
+}
+
+func protocolError(code CloseCode, reason string) error {
+	return &CloseError{Code: code, Text: reason}
+}
+
+func closePayload(code CloseCode, reason string) []byte {
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(payload, reason...)
+}
+
+func validCloseCode(code CloseCode) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// validUTF8Prefix reports how many bytes of p form complete, valid UTF-8.
+// Unless final is set, a truncated sequence at the end is not an error so
+// fragmented text can be checked frame by frame.
+func validUTF8Prefix(p []byte, final bool) (int, bool) {
+	i := 0
+	for i < len(p) {
+		r, size := utf8.DecodeRune(p[i:])
+		if r == utf8.RuneError && size <= 1 {
+			if !final && !utf8.FullRune(p[i:]) && couldComplete(p[i:]) {
+				return i, true
+			}
+			return i, false
+		}
+		i += size
+	}
+	return i, true
+}
+
+func couldComplete(p []byte) bool {
+	var buf [utf8.UTFMax]byte
+	n := copy(buf[:], p)
+	for _, fill := range []byte{0x80, 0x9F, 0xA0, 0xBF, 0x90, 0x8F} {
+		for j := n; j < utf8.UTFMax; j++ {
+			buf[j] = fill
+		}
+		if r, size := utf8.DecodeRune(buf[:]); r != utf8.RuneError && size > n {
+			return true
+		}
+	}
+	return false
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
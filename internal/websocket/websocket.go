@@ -0,0 +1,165 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	DefaultMaxMessageSize = 32 << 20
+	maxControlPayload     = 125
+)
+
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+type Upgrader struct {
+	// Subprotocols lists the server's supported protocols in order of
+	// preference.
+	Subprotocols []string
+	// CheckOrigin returns true if the request Origin is acceptable. When
+	// nil, cross-origin requests are rejected.
+	CheckOrigin func(req *request.Request) bool
+	// EnableCompression negotiates permessage-deflate when the client
+	// offers it.
+	EnableCompression bool
+	// MaxMessageSize bounds a reassembled (and decompressed) message.
+	// Zero means DefaultMaxMessageSize.
+	MaxMessageSize int64
+	// WriteFragmentSize splits outgoing messages into frames of at most
+	// this many payload bytes. Zero sends every message as one frame.
+	WriteFragmentSize int
+}
+
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	if req.RequestLine.Method != "GET" {
+		return nil, u.fail(w, response.StatusMethodNotAllowed, "websocket: method must be GET")
+	}
+	if !headerContainsToken(req.Headers["connection"], "upgrade") {
+		return nil, u.fail(w, response.StatusBadRequest, "websocket: 'connection' header must contain 'upgrade'")
+	}
+	if !headerContainsToken(req.Headers["upgrade"], "websocket") {
+		return nil, u.fail(w, response.StatusBadRequest, "websocket: 'upgrade' header must be 'websocket'")
+	}
+	if req.Headers["sec-websocket-version"] != "13" {
+		return nil, u.fail(w, response.StatusUpgradeRequired, "websocket: unsupported version")
+	}
+	key := req.Headers["sec-websocket-key"]
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, u.fail(w, response.StatusBadRequest, "websocket: invalid 'sec-websocket-key'")
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return nil, u.fail(w, response.StatusForbidden, "websocket: origin not allowed")
+	}
+
+	h := response.GetDefaultHeaders(0)
+	h.Remove("content-length")
+	h.Remove("content-type")
+	h.Override("connection", "Upgrade")
+	h.Set("upgrade", "websocket")
+	h.Set("sec-websocket-accept", computeAccept(key))
+
+	subprotocol := u.selectSubprotocol(req)
+	if subprotocol != "" {
+		h.Set("sec-websocket-protocol", subprotocol)
+	}
+
+	var deflate *deflateParams
+	if u.EnableCompression {
+		deflate = negotiateDeflate(req.Headers["sec-websocket-extensions"])
+		if deflate != nil {
+			h.Set("sec-websocket-extensions", deflate.String())
+		}
+	}
+
+	if err := w.WriteStatusLine(response.StatusSwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	rwc, rw, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	maxSize := u.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	c := newConn(rwc, rw.Reader, true, maxSize)
+	c.subprotocol = subprotocol
+	c.fragmentSize = u.WriteFragmentSize
+	if deflate != nil {
+		c.compression = true
+		c.readContextTakeover = !deflate.clientNoContextTakeover
+		c.writeContextTakeover = !deflate.serverNoContextTakeover
+	}
+	return c, nil
+}
+
+func (u *Upgrader) fail(w *response.Writer, status response.StatusCode, reason string) error {
+	w.WriteStatusLine(status)
+	h := response.GetDefaultHeaders(len(reason))
+	if status == response.StatusUpgradeRequired {
+		h.Set("sec-websocket-version", "13")
+	}
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(reason))
+	return fmt.Errorf("%w: %s", ErrBadHandshake, reason)
+}
+
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	offered := strings.Split(req.Headers["sec-websocket-protocol"], ",")
+	for _, supported := range u.Subprotocols {
+		for _, p := range offered {
+			if strings.TrimSpace(p) == supported {
+				return supported
+			}
+		}
+	}
+	return ""
+}
+
+func IsUpgrade(req *request.Request) bool {
+	return headerContainsToken(req.Headers["connection"], "upgrade") &&
+		headerContainsToken(req.Headers["upgrade"], "websocket")
+}
+
+func computeAccept(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func sameOrigin(req *request.Request) bool {
+	origin := req.Headers["origin"]
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Headers["host"])
+}
+
+func headerContainsToken(value, token string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,367 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshake(t *testing.T) {
+	addr := startEchoServer(t, &Upgrader{Subprotocols: []string{"chat", "superchat"}})
+
+	// Test: Valid handshake selects subprotocol
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\n"+
+		"Host: "+addr+"\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Protocol: superchat, chat\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	status, h := readHandshake(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols", status)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", h["sec-websocket-accept"])
+	assert.Equal(t, "chat", h["sec-websocket-protocol"])
+
+	// Test: Missing key
+	conn2, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn2.Close()
+	fmt.Fprint(conn2, "GET /ws HTTP/1.1\r\nHost: "+addr+"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	status, _ = readHandshake(t, bufio.NewReader(conn2))
+	assert.Equal(t, "HTTP/1.1 400 Bad Request", status)
+
+	// Test: Unsupported version
+	conn3, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn3.Close()
+	fmt.Fprint(conn3, "GET /ws HTTP/1.1\r\nHost: "+addr+"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 8\r\n\r\n")
+	status, h = readHandshake(t, bufio.NewReader(conn3))
+	assert.True(t, strings.HasPrefix(status, "HTTP/1.1 426"))
+	assert.Equal(t, "13", h["sec-websocket-version"])
+
+	// Test: Cross-origin request rejected by default
+	conn4, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn4.Close()
+	fmt.Fprint(conn4, "GET /ws HTTP/1.1\r\nHost: "+addr+"\r\nOrigin: http://evil.example\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	status, _ = readHandshake(t, bufio.NewReader(conn4))
+	assert.True(t, strings.HasPrefix(status, "HTTP/1.1 403"))
+}
+
+// The cases below follow the sections of the Autobahn fuzzing suite: the
+// test acts as the client, sends raw frames, and checks the echo server's
+// replies and close codes.
+type rawFrame struct {
+	header  byte
+	payload []byte
+}
+
+func frameOf(fin bool, opcode MessageType, payload string) rawFrame {
+	h := byte(opcode)
+	if fin {
+		h |= finBit
+	}
+	return rawFrame{header: h, payload: []byte(payload)}
+}
+
+type expectation struct {
+	messages  []string
+	closeCode CloseCode
+}
+
+func TestAutobahnSuite(t *testing.T) {
+	cases := []struct {
+		name   string
+		frames []rawFrame
+		expect expectation
+	}{
+		// 1.* Framing
+		{"1.1.1 empty text", []rawFrame{frameOf(true, TextMessage, "")}, expectation{messages: []string{""}, closeCode: CloseNormalClosure}},
+		{"1.1.2 text 125", []rawFrame{frameOf(true, TextMessage, strings.Repeat("*", 125))}, expectation{messages: []string{strings.Repeat("*", 125)}, closeCode: CloseNormalClosure}},
+		{"1.1.3 text 126", []rawFrame{frameOf(true, TextMessage, strings.Repeat("*", 126))}, expectation{messages: []string{strings.Repeat("*", 126)}, closeCode: CloseNormalClosure}},
+		{"1.1.5 text 65535", []rawFrame{frameOf(true, TextMessage, strings.Repeat("*", 65535))}, expectation{messages: []string{strings.Repeat("*", 65535)}, closeCode: CloseNormalClosure}},
+		{"1.1.6 text 65536", []rawFrame{frameOf(true, TextMessage, strings.Repeat("*", 65536))}, expectation{messages: []string{strings.Repeat("*", 65536)}, closeCode: CloseNormalClosure}},
+		{"1.2.1 empty binary", []rawFrame{frameOf(true, BinaryMessage, "")}, expectation{messages: []string{""}, closeCode: CloseNormalClosure}},
+		{"1.2.3 binary 126", []rawFrame{frameOf(true, BinaryMessage, strings.Repeat("\xfe", 126))}, expectation{messages: []string{strings.Repeat("\xfe", 126)}, closeCode: CloseNormalClosure}},
+
+		// 2.* Pings and pongs
+		{"2.2 ping with payload", []rawFrame{frameOf(true, PingMessage, "Hello, world!")}, expectation{messages: []string{"pong:Hello, world!"}, closeCode: CloseNormalClosure}},
+		{"2.4 ping 125", []rawFrame{frameOf(true, PingMessage, strings.Repeat("\xfe", 125))}, expectation{messages: []string{"pong:" + strings.Repeat("\xfe", 125)}, closeCode: CloseNormalClosure}},
+		{"2.5 ping 126", []rawFrame{frameOf(true, PingMessage, strings.Repeat("\xfe", 126))}, expectation{closeCode: CloseProtocolError}},
+		{"2.6 unsolicited pong", []rawFrame{frameOf(true, PongMessage, "unsolicited"), frameOf(true, TextMessage, "after")}, expectation{messages: []string{"after"}, closeCode: CloseNormalClosure}},
+
+		// 3.* Reserved bits
+		{"3.1 rsv1 without extension", []rawFrame{{header: finBit | rsv1Bit | byte(TextMessage), payload: []byte("x")}}, expectation{closeCode: CloseProtocolError}},
+		{"3.2 rsv2", []rawFrame{{header: finBit | rsv2Bit | byte(TextMessage), payload: []byte("x")}}, expectation{closeCode: CloseProtocolError}},
+		{"3.7 rsv on ping", []rawFrame{{header: finBit | rsv3Bit | byte(PingMessage)}}, expectation{closeCode: CloseProtocolError}},
+
+		// 4.* Opcodes
+		{"4.1.1 reserved non-control opcode", []rawFrame{{header: finBit | 0x3}}, expectation{closeCode: CloseProtocolError}},
+		{"4.2.1 reserved control opcode", []rawFrame{{header: finBit | 0xB}}, expectation{closeCode: CloseProtocolError}},
+		{"4.2.3 reserved opcode after message", []rawFrame{frameOf(true, TextMessage, "ok"), {header: finBit | 0xD}}, expectation{messages: []string{"ok"}, closeCode: CloseProtocolError}},
+
+		// 5.* Fragmentation
+		{"5.1 fragmented ping", []rawFrame{frameOf(false, PingMessage, "a"), frameOf(true, continuationFrame, "b")}, expectation{closeCode: CloseProtocolError}},
+		{"5.3 fragmented text", []rawFrame{frameOf(false, TextMessage, "frag"), frameOf(true, continuationFrame, "ment")}, expectation{messages: []string{"fragment"}, closeCode: CloseNormalClosure}},
+		{"5.6 ping between fragments", []rawFrame{frameOf(false, TextMessage, "frag"), frameOf(true, PingMessage, "p"), frameOf(true, continuationFrame, "ment")}, expectation{messages: []string{"pong:p", "fragment"}, closeCode: CloseNormalClosure}},
+		{"5.9 continuation without start", []rawFrame{frameOf(true, continuationFrame, "x")}, expectation{closeCode: CloseProtocolError}},
+		{"5.18 text inside fragmented text", []rawFrame{frameOf(false, TextMessage, "a"), frameOf(true, TextMessage, "b")}, expectation{closeCode: CloseProtocolError}},
+		{"5.19 many fragments", []rawFrame{frameOf(false, TextMessage, "a"), frameOf(false, continuationFrame, "b"), frameOf(false, continuationFrame, ""), frameOf(true, continuationFrame, "c")}, expectation{messages: []string{"abc"}, closeCode: CloseNormalClosure}},
+
+		// 6.* UTF-8 handling
+		{"6.2.1 valid multibyte", []rawFrame{frameOf(true, TextMessage, "Hello-µ@ßöäüàá-UTF-8!!")}, expectation{messages: []string{"Hello-µ@ßöäüàá-UTF-8!!"}, closeCode: CloseNormalClosure}},
+		{"6.2.3 codepoint split across frames", []rawFrame{frameOf(false, TextMessage, "\xce"), frameOf(true, continuationFrame, "\xba")}, expectation{messages: []string{"κ"}, closeCode: CloseNormalClosure}},
+		{"6.3.1 invalid text", []rawFrame{frameOf(true, TextMessage, "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80edited")}, expectation{closeCode: CloseInvalidFramePayloadData}},
+		{"6.4.1 fail fast on invalid fragment", []rawFrame{frameOf(false, TextMessage, "\xf4\x90\x80\x80"), frameOf(true, continuationFrame, "ok")}, expectation{closeCode: CloseInvalidFramePayloadData}},
+		{"6.6.1 truncated sequence at end", []rawFrame{frameOf(true, TextMessage, "\xce")}, expectation{closeCode: CloseInvalidFramePayloadData}},
+
+		// 7.* Close handling
+		{"7.1.1 close after echo", []rawFrame{frameOf(true, TextMessage, "bye")}, expectation{messages: []string{"bye"}, closeCode: CloseNormalClosure}},
+		{"7.3.1 empty close", []rawFrame{frameOf(true, CloseMessage, "")}, expectation{closeCode: CloseNoStatusReceived}},
+		{"7.3.2 one byte close", []rawFrame{frameOf(true, CloseMessage, "\x03")}, expectation{closeCode: CloseProtocolError}},
+		{"7.1.3 data after close ignored", []rawFrame{{header: finBit | byte(CloseMessage), payload: closePayload(CloseNormalClosure, "")}, frameOf(true, TextMessage, "ignored")}, expectation{closeCode: CloseNormalClosure}},
+		{"7.5.1 invalid utf-8 reason", []rawFrame{{header: finBit | byte(CloseMessage), payload: append(closePayload(CloseNormalClosure, ""), 0xce, 0xba, 0xff)}}, expectation{closeCode: CloseInvalidFramePayloadData}},
+		{"7.7.1 valid code 1000", []rawFrame{{header: finBit | byte(CloseMessage), payload: closePayload(1000, "")}}, expectation{closeCode: 1000}},
+		{"7.7.6 valid code 1011", []rawFrame{{header: finBit | byte(CloseMessage), payload: closePayload(1011, "")}}, expectation{closeCode: 1011}},
+		{"7.7.12 valid code 3000", []rawFrame{{header: finBit | byte(CloseMessage), payload: closePayload(3000, "")}}, expectation{closeCode: 3000}},
+		{"7.7.13 valid code 4999", []rawFrame{{header: finBit | byte(CloseMessage), payload: closePayload(4999, "")}}, expectation{closeCode: 4999}},
+		{"7.9.1 invalid code 0", []rawFrame{{header: finBit | byte(CloseMessage), payload: closePayload(0, "")}}, expectation{closeCode: CloseProtocolError}},
+		{"7.9.4 invalid code 1005", []rawFrame{{header: finBit | byte(CloseMessage), payload: closePayload(1005, "")}}, expectation{closeCode: CloseProtocolError}},
+		{"7.9.6 invalid code 1015", []rawFrame{{header: finBit | byte(CloseMessage), payload: closePayload(1015, "")}}, expectation{closeCode: CloseProtocolError}},
+		{"7.9.9 invalid code 2999", []rawFrame{{header: finBit | byte(CloseMessage), payload: closePayload(2999, "")}}, expectation{closeCode: CloseProtocolError}},
+		{"7.13.1 invalid code 5000", []rawFrame{{header: finBit | byte(CloseMessage), payload: closePayload(5000, "")}}, expectation{closeCode: CloseProtocolError}},
+
+		// 9.* Limits
+		{"9.x message over limit", []rawFrame{frameOf(false, BinaryMessage, strings.Repeat("a", 600)), frameOf(true, continuationFrame, strings.Repeat("a", 600))}, expectation{closeCode: CloseMessageTooBig}},
+		{"9.x frame over limit", []rawFrame{frameOf(true, BinaryMessage, strings.Repeat("a", 1025))}, expectation{closeCode: CloseMessageTooBig}},
+	}
+
+	limited := map[string]bool{"9.x message over limit": true, "9.x frame over limit": true}
+	addr := startEchoServer(t, &Upgrader{})
+	limitedAddr := startEchoServer(t, &Upgrader{MaxMessageSize: 1024})
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			target := addr
+			if limited[tc.name] {
+				target = limitedAddr
+			}
+			c := dialClient(t, target, "")
+			defer c.Close()
+
+			for _, f := range tc.frames {
+				writeRawFrame(t, c.rwc, f)
+			}
+
+			var got []string
+			for {
+				f, err := c.readFrame()
+				require.NoError(t, err)
+				switch f.opcode {
+				case CloseMessage:
+					code := CloseNoStatusReceived
+					if len(f.payload) >= 2 {
+						code = CloseCode(binary.BigEndian.Uint16(f.payload))
+					}
+					assert.Equal(t, tc.expect.messages, got)
+					assert.Equal(t, tc.expect.closeCode, code)
+					return
+				case PongMessage:
+					got = append(got, "pong:"+string(f.payload))
+				default:
+					got = append(got, string(f.payload))
+				}
+				if len(got) == len(tc.expect.messages) && tc.expect.closeCode == CloseNormalClosure {
+					c.WriteClose(CloseNormalClosure, "")
+				}
+			}
+		})
+	}
+}
+
+func TestClientConnRoundTrip(t *testing.T) {
+	addr := startEchoServer(t, &Upgrader{WriteFragmentSize: 10})
+	c := dialClient(t, addr, "")
+	defer c.Close()
+
+	// Test: Fragmented writes from the server reassemble
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("a message longer than ten bytes")))
+	mt, msg, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, mt)
+	assert.Equal(t, "a message longer than ten bytes", string(msg))
+
+	// Test: Close handshake initiated by the client
+	require.NoError(t, c.WriteClose(CloseGoingAway, "done"))
+	_, _, err = c.ReadMessage()
+	var ce *CloseError
+	require.True(t, errors.As(err, &ce))
+	assert.Equal(t, CloseGoingAway, ce.Code)
+}
+
+func TestPerMessageDeflate(t *testing.T) {
+	addr := startEchoServer(t, &Upgrader{EnableCompression: true})
+
+	// Test: Negotiation
+	assert.Nil(t, negotiateDeflate("x-webkit-deflate-frame"))
+	assert.Nil(t, negotiateDeflate("permessage-deflate; server_max_window_bits=10"))
+	assert.NotNil(t, negotiateDeflate("permessage-deflate; server_max_window_bits=10, permessage-deflate"))
+	assert.Nil(t, negotiateDeflate("permessage-deflate; client_no_context_takeover; client_no_context_takeover"))
+	p := negotiateDeflate("permessage-deflate; client_max_window_bits; client_no_context_takeover")
+	require.NotNil(t, p)
+	assert.Equal(t, "permessage-deflate; client_no_context_takeover", p.String())
+	p = negotiateDeflate("permessage-deflate; server_no_context_takeover")
+	require.NotNil(t, p)
+	assert.Equal(t, "permessage-deflate; server_no_context_takeover", p.String())
+
+	// Test: Compressed round trips, with each side keeping its context
+	// unless the client's offer said otherwise
+	messages := []string{
+		strings.Repeat("compress me please ", 100),
+		strings.Repeat("compress me please ", 100),
+		"",
+		"short",
+	}
+	for _, offer := range []string{
+		"permessage-deflate; client_max_window_bits",
+		"permessage-deflate; server_no_context_takeover",
+		"permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+	} {
+		c := dialClient(t, addr, offer)
+		require.True(t, c.compression, offer)
+		assert.Equal(t, !strings.Contains(offer, "server_no"), c.readContextTakeover, offer)
+		assert.Equal(t, !strings.Contains(offer, "client_no"), c.writeContextTakeover, offer)
+		for _, m := range messages {
+			require.NoError(t, c.WriteMessage(TextMessage, []byte(m)), offer)
+			mt, msg, err := c.ReadMessage()
+			require.NoError(t, err, offer)
+			assert.Equal(t, TextMessage, mt)
+			assert.Equal(t, m, string(msg), offer)
+		}
+		c.Close()
+	}
+
+	// Test: Decompression bomb is rejected
+	c2 := dialClient(t, startEchoServer(t, &Upgrader{EnableCompression: true, MaxMessageSize: 1024}), "permessage-deflate")
+	defer c2.Close()
+	require.NoError(t, c2.WriteMessage(BinaryMessage, bytes.Repeat([]byte{0}, 4096)))
+	_, _, err := c2.ReadMessage()
+	var ce *CloseError
+	require.True(t, errors.As(err, &ce))
+	assert.Equal(t, CloseMessageTooBig, ce.Code)
+}
+
+func startEchoServer(t *testing.T, u *Upgrader) string {
+	t.Helper()
+	s, err := server.ServeAddr("tcp", "127.0.0.1:0", func(w *response.Writer, req *request.Request) {
+		c, err := u.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().String()
+}
+
+func dialClient(t *testing.T, addr, extensions string) *Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\n"+
+		"Host: "+addr+"\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n")
+	if extensions != "" {
+		fmt.Fprint(conn, "Sec-WebSocket-Extensions: "+extensions+"\r\n")
+	}
+	fmt.Fprint(conn, "\r\n")
+
+	br := bufio.NewReader(conn)
+	status, h := readHandshake(t, br)
+	require.Equal(t, "HTTP/1.1 101 Switching Protocols", status)
+
+	c := newConn(conn, br, false, DefaultMaxMessageSize)
+	if ext := h["sec-websocket-extensions"]; strings.HasPrefix(ext, "permessage-deflate") {
+		c.compression = true
+		c.readContextTakeover = !strings.Contains(ext, "server_no_context_takeover")
+		c.writeContextTakeover = !strings.Contains(ext, "client_no_context_takeover")
+	}
+	return c
+}
+
+func readHandshake(t *testing.T, br *bufio.Reader) (string, map[string]string) {
+	t.Helper()
+	status, err := br.ReadString('\n')
+	require.NoError(t, err)
+	h := map[string]string{}
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		h[strings.ToLower(name)] = strings.TrimSpace(value)
+	}
+	if n := h["content-length"]; n != "" && n != "0" {
+		var length int
+		fmt.Sscanf(n, "%d", &length)
+		io.CopyN(io.Discard, br, int64(length))
+	}
+	return strings.TrimRight(status, "\r\n"), h
+}
+
+func writeRawFrame(t *testing.T, w io.Writer, f rawFrame) {
+	t.Helper()
+	buf := []byte{f.header}
+	switch {
+	case len(f.payload) <= 125:
+		buf = append(buf, maskBit|byte(len(f.payload)))
+	case len(f.payload) <= 0xFFFF:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(f.payload)))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(f.payload)))
+	}
+	key := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	buf = append(buf, key[:]...)
+	start := len(buf)
+	buf = append(buf, f.payload...)
+	maskBytes(key, buf[start:])
+	_, err := w.Write(buf)
+	require.NoError(t, err)
+}